@@ -0,0 +1,386 @@
+// loadtest 信令压测工具
+// 模拟大量客户端按 JSON 协议加入房间，互相发送 offer/answer/candidate，统计连接耗时、转发耗时、丢失和服务端错误
+// 只允许压测本机的服务
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"webrtc/p2p-server/pkg/client"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	//会话Id前缀，后面是发送时间
+	sessionPrefix = "lt-"
+	//合成的 SDP，服务端只转发不解析
+	syntheticSdp = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=loadtest\r\nt=0 0\r\n"
+	//合成的 candidate
+	syntheticCandidate = "candidate:1 1 udp 2130706431 127.0.0.1 9 typ host"
+)
+
+// 压测参数
+type options struct {
+	url      string
+	clients  int
+	rooms    int
+	dist     string
+	roomSize int
+	ramp     int
+	rate     float64
+	duration time.Duration
+	drain    time.Duration
+	interval time.Duration
+	insecure bool
+}
+
+// 一个模拟客户端
+type simClient struct {
+	id     string
+	roomId string
+	c      *client.Client
+	st     *stats
+
+	mu sync.Mutex
+	//房间内的其他参与者
+	peers []string
+	//下一条消息的类型
+	next int
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "wss://127.0.0.1:8000/ws", "信令地址，只能是本机")
+	flag.IntVar(&opts.clients, "clients", 1000, "客户端数量")
+	flag.IntVar(&opts.rooms, "rooms", 100, "房间数量，dist=fill 时不使用")
+	flag.StringVar(&opts.dist, "dist", "uniform", "房间分布 uniform|zipf|fill")
+	flag.IntVar(&opts.roomSize, "room-size", 2, "dist=fill 时每个房间的人数")
+	flag.IntVar(&opts.ramp, "ramp", 200, "每秒新建的客户端数量")
+	flag.Float64Var(&opts.rate, "rate", 1, "每个客户端每秒发送的消息数")
+	flag.DurationVar(&opts.duration, "duration", time.Minute, "全部加入后发送消息的时长")
+	flag.DurationVar(&opts.drain, "drain", 3*time.Second, "停止发送后等待在途消息的时间")
+	flag.DurationVar(&opts.interval, "interval", 5*time.Second, "进度输出间隔")
+	flag.BoolVar(&opts.insecure, "insecure", true, "不校验服务端证书")
+	flag.Parse()
+
+	if err := opts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	run(ctx, &opts)
+}
+
+func (o *options) validate() error {
+	if o.clients <= 0 || o.ramp <= 0 || o.rate <= 0 {
+		return errors.New("clients、ramp、rate 必须大于0")
+	}
+	switch o.dist {
+	case "uniform", "zipf":
+		if o.rooms <= 0 {
+			return errors.New("rooms 必须大于0")
+		}
+	case "fill":
+		if o.roomSize <= 0 {
+			return errors.New("room-size 必须大于0")
+		}
+	default:
+		return fmt.Errorf("不支持的分布 %s", o.dist)
+	}
+	return checkLocal(o.url)
+}
+
+// 只允许本机地址
+func checkLocal(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("只能压测本机服务，%s 不是本机地址", host)
+}
+
+// 按分布给每个客户端分配房间
+func assignRooms(o *options) []string {
+	rooms := make([]string, o.clients)
+	r := rand.New(rand.NewPCG(1, 2))
+	zipf := rand.NewZipf(r, 1.1, 1, uint64(max(o.rooms-1, 0)))
+
+	for i := range rooms {
+		var n int
+		switch o.dist {
+		case "uniform":
+			n = i % o.rooms
+		case "zipf":
+			n = int(zipf.Uint64())
+		case "fill":
+			n = i / o.roomSize
+		}
+		rooms[i] = "loadtest-" + strconv.Itoa(n)
+	}
+	return rooms
+}
+
+func run(ctx context.Context, o *options) {
+	st := newStats()
+	rooms := assignRooms(o)
+	start := time.Now()
+
+	dialer := *websocket.DefaultDialer
+	if o.insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	//定时输出进度
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st.progress(os.Stdout, time.Since(start))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	//按 ramp 速度建立连接
+	fmt.Printf("建立 %d 个客户端，分布 %s\n", o.clients, o.dist)
+	clients := make([]*simClient, 0, o.clients)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ramp := time.NewTicker(time.Second / time.Duration(o.ramp))
+	for i := 0; i < o.clients; i++ {
+		select {
+		case <-ramp.C:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		sc := &simClient{
+			id:     fmt.Sprintf("lt-user-%d", i),
+			roomId: rooms[i],
+			st:     st,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sc.connect(ctx, o, &dialer); err != nil {
+				st.joinFailed.Add(1)
+				return
+			}
+			mu.Lock()
+			clients = append(clients, sc)
+			mu.Unlock()
+		}()
+	}
+	ramp.Stop()
+	wg.Wait()
+
+	fmt.Printf("加入完成 成功 %d 失败 %d，开始发送 %v\n", st.joined.Load(), st.joinFailed.Load(), o.duration)
+
+	//发送消息
+	trafficStart := time.Now()
+	traffic, cancel := context.WithTimeout(ctx, o.duration)
+	for _, sc := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.loop(traffic, o.rate)
+		}()
+	}
+	wg.Wait()
+	cancel()
+	elapsed := time.Since(trafficStart)
+
+	//等待在途消息
+	select {
+	case <-time.After(o.drain):
+	case <-ctx.Done():
+	}
+
+	st.report(os.Stdout, elapsed)
+
+	for _, sc := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.c.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// 连接并加入房间，房间不存在时创建
+func (sc *simClient) connect(ctx context.Context, o *options, dialer *websocket.Dialer) error {
+	sc.c = client.New(client.Options{
+		Url:    o.url,
+		Dialer: dialer,
+	}, client.Handlers{
+		OnUserList: sc.onUserList,
+		OnOffer: func(data *msg.Offer) {
+			sc.onRelay(data.SessionId)
+		},
+		OnAnswer: func(data *msg.Answer) {
+			sc.onRelay(data.SessionId)
+		},
+		OnCandidate: func(data *msg.Candidate) {
+			sc.onRelay(data.SessionId)
+		},
+		OnError: func(data *msg.ErrorData) {
+			sc.st.addError(data.Code)
+		},
+		OnDisconnect: func(err error) {
+			sc.st.disconnects.Add(1)
+		},
+	})
+
+	begin := time.Now()
+	if err := sc.c.Connect(ctx); err != nil {
+		return err
+	}
+
+	join := msg.JoinRoom{
+		Id:     sc.id,
+		Name:   sc.id,
+		RoomId: sc.roomId,
+	}
+	_, err := sc.c.Join(ctx, join)
+	var e *msg.ErrorMsg
+	if errors.As(err, &e) && e.Code == msg.ErrCodeNotFound {
+		_, err = sc.c.CreateRoom(ctx, msg.CreateRoom{
+			RoomId: sc.roomId,
+			Id:     sc.id,
+			Name:   sc.id,
+		})
+		//其他客户端同时创建了房间
+		if errors.As(err, &e) && e.Code == msg.ErrCodeConflict {
+			_, err = sc.c.Join(ctx, join)
+		}
+	}
+	if err != nil {
+		sc.c.Close()
+		return err
+	}
+
+	sc.st.joined.Add(1)
+	sc.st.addConnect(time.Since(begin))
+	return nil
+}
+
+func (sc *simClient) onUserList(users []client.UserInfo) {
+	peers := make([]string, 0, len(users))
+	for _, u := range users {
+		if u.Id != sc.id && u.Role != "viewer" {
+			peers = append(peers, u.Id)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.peers = peers
+	sc.mu.Unlock()
+}
+
+// 收到转发的消息，会话Id中带有发送时间
+func (sc *simClient) onRelay(sessionId string) {
+	sent, ok := strings.CutPrefix(sessionId, sessionPrefix)
+	if !ok {
+		return
+	}
+	nanos, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return
+	}
+	sc.st.addRelay(time.Since(time.Unix(0, nanos)))
+}
+
+// 按速率给房间内随机一个参与者发送消息，类型轮换
+func (sc *simClient) loop(ctx context.Context, rate float64) {
+	interval := time.Duration(float64(time.Second) / rate)
+
+	//错开各客户端的发送时间
+	select {
+	case <-time.After(rand.N(interval)):
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sc.send()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sc *simClient) send() {
+	sc.mu.Lock()
+	if len(sc.peers) == 0 {
+		sc.mu.Unlock()
+		return
+	}
+	to := sc.peers[rand.N(len(sc.peers))]
+	kind := sc.next
+	sc.next = (sc.next + 1) % 3
+	sc.mu.Unlock()
+
+	sessionId := sessionPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	var err error
+	switch kind {
+	case 0:
+		err = sc.c.SendOffer(sc.roomId, to, sessionId, "video", webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  syntheticSdp,
+		})
+	case 1:
+		err = sc.c.SendAnswer(sc.roomId, to, sessionId, "video", webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  syntheticSdp,
+		})
+	case 2:
+		err = sc.c.SendCandidate(sc.roomId, to, sessionId, webrtc.ICECandidateInit{
+			Candidate: syntheticCandidate,
+		})
+	}
+
+	if err != nil {
+		sc.st.sendFailed.Add(1)
+		return
+	}
+	sc.st.sent.Add(1)
+}
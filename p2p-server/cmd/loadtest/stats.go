@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 压测统计
+type stats struct {
+	//连接并加入房间成功/失败
+	joined     atomic.Int64
+	joinFailed atomic.Int64
+	//连接断开次数
+	disconnects atomic.Int64
+	//发出和收到的转发消息
+	sent     atomic.Int64
+	received atomic.Int64
+	//发送失败(连接已断开等)
+	sendFailed atomic.Int64
+
+	mu sync.Mutex
+	//连接并加入房间的耗时
+	connectLatency []time.Duration
+	//消息从发出到对方收到的耗时
+	relayLatency []time.Duration
+	//服务端错误，按错误码统计
+	serverErrors map[int]int64
+}
+
+func newStats() *stats {
+	return &stats{
+		serverErrors: make(map[int]int64),
+	}
+}
+
+func (s *stats) addConnect(d time.Duration) {
+	s.mu.Lock()
+	s.connectLatency = append(s.connectLatency, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addRelay(d time.Duration) {
+	s.received.Add(1)
+	s.mu.Lock()
+	s.relayLatency = append(s.relayLatency, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addError(code int) {
+	s.mu.Lock()
+	s.serverErrors[code]++
+	s.mu.Unlock()
+}
+
+// 按顺序排列的百分位
+func percentiles(samples []time.Duration, ps ...float64) []time.Duration {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	result := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return result
+	}
+	for i, p := range ps {
+		idx := int(float64(len(sorted)-1) * p / 100)
+		result[i] = sorted[idx]
+	}
+	return result
+}
+
+func latencyLine(name string, samples []time.Duration) string {
+	if len(samples) == 0 {
+		return fmt.Sprintf("%-10s 无数据", name)
+	}
+	p := percentiles(samples, 50, 90, 99, 100)
+	return fmt.Sprintf("%-10s n=%d p50=%v p90=%v p99=%v max=%v", name, len(samples),
+		p[0].Round(time.Microsecond), p[1].Round(time.Microsecond), p[2].Round(time.Microsecond), p[3].Round(time.Microsecond))
+}
+
+// 运行中的进度
+func (s *stats) progress(w io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(w, "[%v] 在线=%d 加入失败=%d 断开=%d 发送=%d 收到=%d\n",
+		elapsed.Round(time.Second), s.joined.Load()-s.disconnects.Load(), s.joinFailed.Load(),
+		s.disconnects.Load(), s.sent.Load(), s.received.Load())
+}
+
+// 最终报告
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, received := s.sent.Load(), s.received.Load()
+	loss := 0.0
+	if sent > 0 {
+		loss = float64(sent-received) / float64(sent) * 100
+	}
+
+	fmt.Fprintf(w, "\n==== 压测结果 (%v) ====\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "加入成功 %d  失败 %d  断开 %d\n", s.joined.Load(), s.joinFailed.Load(), s.disconnects.Load())
+	fmt.Fprintln(w, latencyLine("连接耗时", s.connectLatency))
+	fmt.Fprintln(w, latencyLine("转发耗时", s.relayLatency))
+	fmt.Fprintf(w, "消息 发送=%d 收到=%d 丢失=%d (%.2f%%) 发送失败=%d\n", sent, received, sent-received, loss, s.sendFailed.Load())
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "吞吐 %.1f msg/s\n", float64(received)/seconds)
+	}
+
+	if len(s.serverErrors) == 0 {
+		fmt.Fprintln(w, "服务端错误 无")
+		return
+	}
+	codes := make([]int, 0, len(s.serverErrors))
+	for code := range s.serverErrors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprint(w, "服务端错误")
+	for _, code := range codes {
+		fmt.Fprintf(w, " %d=%d", code, s.serverErrors[code])
+	}
+	fmt.Fprintln(w)
+}
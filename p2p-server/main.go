@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"webrtc/p2p-server/pkg/admin"
 	"webrtc/p2p-server/pkg/config"
 	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/metrics"
 	"webrtc/p2p-server/pkg/room"
 	"webrtc/p2p-server/pkg/server"
+	"webrtc/p2p-server/pkg/whip"
 )
 
 var CfgFile string
 
 func main() {
 	flag.StringVar(&CfgFile, "c", "./config/config.yaml", "config file")
+	flag.Parse()
 
 	cfg := config.InitConfig(CfgFile)
 	fmt.Println(cfg)
@@ -23,5 +32,39 @@ func main() {
 
 	server := server.NewServer(rm.HandleMsg, cfg)
 
-	server.Run()
+	if cfg.Metrics.Enable {
+		metrics.RegisterRooms(rm.UsersPerRoom)
+		metrics.Register(server, cfg.Metrics.Path)
+	}
+
+	if cfg.Admin.Enable {
+		admin.NewAdmin(rm, cfg).Register(server)
+	}
+
+	if cfg.Whip.Enable {
+		whip.NewWhip(rm, cfg).Register(server)
+	}
+
+	if cfg.Whep.Enable {
+		whip.NewWhep(rm, cfg).Register(server)
+	}
+
+	go func() {
+		if err := server.Run(); err != nil {
+			logger.Log.Fatalf("服务启动失败 %v", err)
+		}
+	}()
+
+	// 等待中断信号
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	//在下线等待之外留出关闭连接和 HTTP 服务的时间
+	ctx, cancel := context.WithTimeout(context.Background(), server.DrainTime()+10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx, rm.ActiveSessions); err != nil {
+		logger.Log.Errorf("服务关闭失败 %v", err)
+	}
 }
@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/room"
+	"webrtc/p2p-server/pkg/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultPath = "/admin/api"
+
+// Admin 房间和连接的管理接口
+type Admin struct {
+	rm  *room.RoomManager
+	cfg *config.Config
+}
+
+func NewAdmin(rm *room.RoomManager, cfg *config.Config) *Admin {
+	return &Admin{
+		rm:  rm,
+		cfg: cfg,
+	}
+}
+
+// Register 注册管理接口路由
+func (a *Admin) Register(r gin.IRouter) {
+	path := a.cfg.Admin.Path
+	if len(path) == 0 {
+		path = defaultPath
+	}
+
+	g := r.Group(path, a.authenticate)
+	g.GET("/rooms", a.listRooms)
+	g.GET("/rooms/:room_id", a.getRoom)
+	g.DELETE("/rooms/:room_id", a.closeRoom)
+	g.DELETE("/rooms/:room_id/users/:user_id", a.kickUser)
+	g.POST("/rooms/:room_id/broadcast", a.broadcast)
+}
+
+// 校验 Authorization: Bearer <token>
+func (a *Admin) authenticate(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || len(a.cfg.Admin.Token) == 0 ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Admin.Token)) != 1 {
+		server.Error(c, http.StatusUnauthorized, "未认证")
+		return
+	}
+	c.Next()
+}
+
+// 把房间错误转换为响应
+func (a *Admin) fail(c *gin.Context, err error) {
+	var e *msg.ErrorMsg
+	if errors.As(err, &e) && e.Code == msg.ErrCodeNotFound {
+		server.Error(c, http.StatusNotFound, e.Message)
+		return
+	}
+	server.Error(c, http.StatusBadRequest, err.Error())
+}
+
+func (a *Admin) listRooms(c *gin.Context) {
+	server.Success(c, a.rm.Rooms())
+}
+
+func (a *Admin) getRoom(c *gin.Context) {
+	detail, err := a.rm.RoomDetail(c.Param("room_id"))
+	if err != nil {
+		a.fail(c, err)
+		return
+	}
+	server.Success(c, detail)
+}
+
+func (a *Admin) closeRoom(c *gin.Context) {
+	if err := a.rm.CloseRoom(c.Param("room_id"), c.Query("reason")); err != nil {
+		a.fail(c, err)
+		return
+	}
+	server.Success(c, nil)
+}
+
+func (a *Admin) kickUser(c *gin.Context) {
+	if err := a.rm.KickUser(c.Param("room_id"), c.Param("user_id")); err != nil {
+		a.fail(c, err)
+		return
+	}
+	server.Success(c, nil)
+}
+
+type broadcastReq struct {
+	Text string `json:"text" binding:"required"`
+}
+
+func (a *Admin) broadcast(c *gin.Context) {
+	var req broadcastReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		server.Error(c, http.StatusBadRequest, "text不能为空")
+		return
+	}
+
+	if err := a.rm.SystemMessage(c.Param("room_id"), req.Text); err != nil {
+		a.fail(c, err)
+		return
+	}
+	server.Success(c, nil)
+}
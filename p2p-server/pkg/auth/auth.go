@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"webrtc/p2p-server/pkg/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultQueryParam = "token"
+	//通过 Sec-WebSocket-Protocol 传 token 时的协议名，格式为 "access_token, <jwt>"
+	TokenProtocol = "access_token"
+)
+
+var ErrNoToken = errors.New("没有token")
+
+// Identity 认证后的用户身份
+type Identity struct {
+	//用户Id
+	Subject string
+	Name    string
+	//允许进入的房间，为空表示不限制
+	Rooms []string
+}
+
+// CanJoin 是否允许进入房间
+func (i *Identity) CanJoin(roomId string) bool {
+	if len(i.Rooms) == 0 {
+		return true
+	}
+	for _, room := range i.Rooms {
+		if room == "*" || room == roomId {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims token 中的声明
+type Claims struct {
+	jwt.RegisteredClaims
+	Name  string   `json:"name"`
+	Rooms []string `json:"rooms"`
+}
+
+// Verifier 校验 JWT
+type Verifier struct {
+	cfg *config.AuthConfig
+	//HS256 密钥
+	hmacKey []byte
+	//RS256 公钥 kid -> key，PEM 文件中的公钥 kid 为空
+	rsaKeys map[string]*rsa.PublicKey
+}
+
+func NewVerifier(cfg *config.AuthConfig) (*Verifier, error) {
+	v := &Verifier{
+		cfg:     cfg,
+		rsaKeys: make(map[string]*rsa.PublicKey),
+	}
+
+	if len(cfg.HmacSecret) > 0 {
+		v.hmacKey = []byte(cfg.HmacSecret)
+	}
+
+	if len(cfg.RsaPublicKey) > 0 {
+		data, err := os.ReadFile(cfg.RsaPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		v.rsaKeys[""] = key
+	}
+
+	if len(cfg.JwksFile) > 0 {
+		if err := v.loadJwks(cfg.JwksFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.hmacKey == nil && len(v.rsaKeys) == 0 {
+		return nil, errors.New("没有配置token校验密钥")
+	}
+
+	return v, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// 加载 JWKS 文件中的 RSA 公钥
+func (v *Verifier) loadJwks(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("jwk [%s] n格式错误: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("jwk [%s] e格式错误: %v", k.Kid, err)
+		}
+		v.rsaKeys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return nil
+}
+
+// 根据签名算法和 kid 选择密钥
+func (v *Verifier) keyFunc(t *jwt.Token) (any, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if v.hmacKey == nil {
+			return nil, errors.New("没有配置HS256密钥")
+		}
+		return v.hmacKey, nil
+	case jwt.SigningMethodRS256.Alg():
+		//没有 kid 时使用 PEM 公钥，kid 未知时不回退
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("没有找到kid [%s] 对应的公钥", kid)
+	}
+	return nil, fmt.Errorf("不支持的签名算法 %s", t.Method.Alg())
+}
+
+// Verify 校验 token 并返回身份
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if len(v.cfg.Issuer) > 0 {
+		opts = append(opts, jwt.WithIssuer(v.cfg.Issuer))
+	}
+	if len(v.cfg.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(v.cfg.Audience))
+	}
+
+	var claims Claims
+	if _, err := jwt.ParseWithClaims(token, &claims, v.keyFunc, opts...); err != nil {
+		return nil, err
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("token没有sub")
+	}
+
+	return &Identity{
+		Subject: claims.Subject,
+		Name:    claims.Name,
+		Rooms:   claims.Rooms,
+	}, nil
+}
+
+// TokenFromRequest 从查询参数或 Sec-WebSocket-Protocol 中取 token
+// 通过协议头传递时返回需要回应的协议名
+func (v *Verifier) TokenFromRequest(r *http.Request) (token string, protocol string, err error) {
+	param := v.cfg.QueryParam
+	if len(param) == 0 {
+		param = defaultQueryParam
+	}
+	if token = r.URL.Query().Get(param); len(token) > 0 {
+		return token, "", nil
+	}
+
+	protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
+	for i := 0; i+1 < len(protocols); i++ {
+		if strings.TrimSpace(protocols[i]) == TokenProtocol {
+			return strings.TrimSpace(protocols[i+1]), TokenProtocol, nil
+		}
+	}
+
+	return "", "", ErrNoToken
+}
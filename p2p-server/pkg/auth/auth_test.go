@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testHmac = "hmac-secret"
+
+func hs256(t *testing.T, claims jwt.Claims, key string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func rs256(t *testing.T, claims jwt.Claims, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// 写入只有一个公钥的 JWKS 文件
+func writeJwks(t *testing.T, kid string, key *rsa.PublicKey) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func claims(sub string, exp time.Duration) Claims {
+	c := Claims{Name: "alice", Rooms: []string{"room"}}
+	c.Subject = sub
+	if exp != 0 {
+		c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(exp))
+	}
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewVerifier(&config.AuthConfig{
+		HmacSecret: testHmac,
+		JwksFile:   writeJwks(t, "k1", &key.PublicKey),
+		Issuer:     "issuer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withIssuer := func(c Claims) Claims {
+		c.Issuer = "issuer"
+		return c
+	}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, withIssuer(claims("alice", time.Hour))).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", hs256(t, withIssuer(claims("alice", time.Hour)), testHmac), true},
+		{"HS256密钥错误", hs256(t, withIssuer(claims("alice", time.Hour)), "wrong"), false},
+		{"没有exp", hs256(t, withIssuer(claims("alice", 0)), testHmac), false},
+		{"已过期", hs256(t, withIssuer(claims("alice", -time.Minute)), testHmac), false},
+		{"没有sub", hs256(t, withIssuer(claims("", time.Hour)), testHmac), false},
+		{"iss错误", hs256(t, claims("alice", time.Hour), testHmac), false},
+		{"alg为none", none, false},
+		{"RS256", rs256(t, withIssuer(claims("alice", time.Hour)), "k1", key), true},
+		{"RS256未知kid", rs256(t, withIssuer(claims("alice", time.Hour)), "k2", key), false},
+		{"RS256没有kid", rs256(t, withIssuer(claims("alice", time.Hour)), "", key), false},
+		{"RS256其他私钥", rs256(t, withIssuer(claims("alice", time.Hour)), "k1", other), false},
+		{"格式错误", "not.a.jwt", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			identity, err := v.Verify(c.token)
+			if c.ok != (err == nil) {
+				t.Fatalf("校验结果 %v", err)
+			}
+			if c.ok && (identity.Subject != "alice" || !identity.CanJoin("room") || identity.CanJoin("other")) {
+				t.Fatalf("身份 %+v", identity)
+			}
+		})
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	v, err := NewVerifier(&config.AuthConfig{HmacSecret: testHmac})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		url      string
+		protocol string
+		token    string
+		reply    string
+		err      error
+	}{
+		{"查询参数", "/ws?token=abc", "", "abc", "", nil},
+		{"协议头", "/ws", "access_token, abc", "abc", TokenProtocol, nil},
+		{"协议头没有token", "/ws", "access_token", "", "", ErrNoToken},
+		{"没有token", "/ws", "", "", "", ErrNoToken},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", c.url, nil)
+			if len(c.protocol) > 0 {
+				r.Header.Set("Sec-WebSocket-Protocol", c.protocol)
+			}
+			token, protocol, err := v.TokenFromRequest(r)
+			if token != c.token || protocol != c.reply || err != c.err {
+				t.Fatalf("返回 %q %q %v", token, protocol, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidInvite = errors.New("邀请无效")
+	ErrInviteExpired = errors.New("邀请已过期")
+)
+
+// Invite 房间邀请，签名后作为邀请链接中的 token
+type Invite struct {
+	RoomId string `json:"room_id"`
+	//加入后的角色
+	Role string `json:"role"`
+	//过期时间(unix秒)
+	Exp int64 `json:"exp"`
+	//房间实例的随机值，房间关闭后同Id的新房间不接受旧邀请
+	Nonce string `json:"nonce"`
+}
+
+// SignInvite 生成邀请 token，格式为 base64url(json).base64url(hmac-sha256)
+func SignInvite(secret string, invite *Invite) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("没有配置邀请密钥")
+	}
+
+	payload, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + base64.RawURLEncoding.EncodeToString(signInvite(secret, data)), nil
+}
+
+// ParseInvite 校验邀请 token 的签名和有效期
+func ParseInvite(secret string, token string) (*Invite, error) {
+	if len(secret) == 0 {
+		return nil, ErrInvalidInvite
+	}
+
+	data, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidInvite
+	}
+
+	expected, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(expected, signInvite(secret, data)) {
+		return nil, ErrInvalidInvite
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+
+	var invite Invite
+	if err := json.Unmarshal(payload, &invite); err != nil {
+		return nil, ErrInvalidInvite
+	}
+	if time.Now().Unix() >= invite.Exp {
+		return nil, ErrInviteExpired
+	}
+
+	return &invite, nil
+}
+
+func signInvite(secret string, data string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "invite-secret"
+
+func signTest(t *testing.T, secret string, invite *Invite) string {
+	t.Helper()
+	token, err := SignInvite(secret, invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseInvite(t *testing.T) {
+	invite := &Invite{RoomId: "room", Role: "participant", Exp: time.Now().Add(time.Hour).Unix(), Nonce: "nonce"}
+	valid := signTest(t, testSecret, invite)
+	data, sig, _ := strings.Cut(valid, ".")
+
+	//改写角色后沿用原签名
+	forged := *invite
+	forged.Role = "owner"
+	payload, err := json.Marshal(&forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := base64.RawURLEncoding.EncodeToString(payload) + "." + sig
+
+	cases := []struct {
+		name   string
+		secret string
+		token  string
+		err    error
+	}{
+		{"有效", testSecret, valid, nil},
+		{"密钥错误", "other-secret", valid, ErrInvalidInvite},
+		{"没有配置密钥", "", valid, ErrInvalidInvite},
+		{"篡改内容", testSecret, tampered, ErrInvalidInvite},
+		{"篡改签名", testSecret, data + "." + base64.RawURLEncoding.EncodeToString([]byte("sig")), ErrInvalidInvite},
+		{"签名不是base64", testSecret, data + ".!!", ErrInvalidInvite},
+		{"没有签名", testSecret, data, ErrInvalidInvite},
+		{"内容不是json", testSecret, signedData(testSecret, "not-json"), ErrInvalidInvite},
+		{"已过期", testSecret, signTest(t, testSecret, &Invite{RoomId: "room", Exp: time.Now().Add(-time.Second).Unix()}), ErrInviteExpired},
+		{"没有过期时间", testSecret, signTest(t, testSecret, &Invite{RoomId: "room"}), ErrInviteExpired},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseInvite(c.secret, c.token)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("返回 %v，期望 %v", err, c.err)
+			}
+			if c.err == nil && *got != *invite {
+				t.Fatalf("解析的邀请 %+v，期望 %+v", got, invite)
+			}
+		})
+	}
+}
+
+// 对任意内容签名
+func signedData(secret string, payload string) string {
+	data := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return data + "." + base64.RawURLEncoding.EncodeToString(signInvite(secret, data))
+}
+
+func TestSignInviteWithoutSecret(t *testing.T) {
+	if _, err := SignInvite("", &Invite{RoomId: "room"}); err == nil {
+		t.Fatal("没有密钥时签名成功")
+	}
+}
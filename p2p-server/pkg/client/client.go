@@ -0,0 +1,638 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultRequestTimeout    = 10 * time.Second
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = 30 * time.Second
+	defaultTokenParam        = "token"
+	writeTimeout             = 10 * time.Second
+)
+
+var (
+	// ErrClosed 客户端已关闭
+	ErrClosed = errors.New("client closed")
+	// ErrNotConnected 连接已断开
+	ErrNotConnected = errors.New("client not connected")
+	// ErrNotJoined 没有加入房间
+	ErrNotJoined = errors.New("room not joined")
+)
+
+// Options 客户端设置
+type Options struct {
+	//信令地址，如 ws://127.0.0.1:8000/ws，http(s) 地址会转换为 ws(s)
+	Url string
+	//开启认证时的 JWT，通过 query 参数传递
+	Token string
+	//token 的 query 参数名，默认 token
+	TokenParam string
+	//断线后自动重连
+	Reconnect bool
+	//第一次重连的等待时间，之后每次翻倍
+	ReconnectDelay time.Duration
+	//重连等待时间上限
+	MaxReconnectDelay time.Duration
+	//等待请求回复的超时时间
+	RequestTimeout time.Duration
+	//为空时使用 websocket.DefaultDialer，测试 TLS 服务时可以替换
+	Dialer *websocket.Dialer
+	//握手时附带的请求头
+	Header http.Header
+}
+
+// Client 信令客户端
+// 服务端消息在读协程中按顺序回调，断线重连后用 resume token 恢复已加入的房间
+type Client struct {
+	opts     Options
+	handlers Handlers
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	//已加入的房间，重连时用来重新加入
+	rooms map[string]*msg.JoinRoom
+	//等待回复的请求
+	waiters []*waiter
+	//接管信令的会话
+	peers  map[string]*Peer
+	closed bool
+	done   chan struct{}
+
+	writeMu sync.Mutex
+}
+
+// 等待回复的加入房间请求
+type waiter struct {
+	request string
+	roomId  string
+	join    msg.JoinRoom
+	ch      chan result
+}
+
+type result struct {
+	reply *JoinReply
+	err   error
+}
+
+func New(opts Options, handlers Handlers) *Client {
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = defaultReconnectDelay
+	}
+	if opts.MaxReconnectDelay <= 0 {
+		opts.MaxReconnectDelay = defaultMaxReconnectDelay
+	}
+	if len(opts.TokenParam) == 0 {
+		opts.TokenParam = defaultTokenParam
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+
+	return &Client{
+		opts:     opts,
+		handlers: handlers,
+		rooms:    make(map[string]*msg.JoinRoom),
+		peers:    make(map[string]*Peer),
+		done:     make(chan struct{}),
+	}
+}
+
+// Connect 连接信令服务器
+func (c *Client) Connect(ctx context.Context) error {
+	u, err := url.Parse(c.opts.Url)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	if len(c.opts.Token) > 0 {
+		q := u.Query()
+		q.Set(c.opts.TokenParam, c.opts.Token)
+		u.RawQuery = q.Encode()
+	}
+
+	conn, _, err := c.opts.Dialer.DialContext(ctx, u.String(), c.opts.Header)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	go c.readLoop(conn)
+	return nil
+}
+
+// Close 关闭连接，不再重连
+// 通过 NewPeer 接管的 PeerConnection 由调用方关闭
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	c.writeMu.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+	c.writeMu.Unlock()
+	return conn.Close()
+}
+
+// Send 发送任意类型的消息
+func (c *Client) Send(msgType string, data any) error {
+	b, err := json.Marshal(msg.Msg{
+		Type: msgType,
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// Join 加入房间，等待服务端回复
+func (c *Client) Join(ctx context.Context, req msg.JoinRoom) (*JoinReply, error) {
+	return c.request(ctx, &waiter{
+		request: JoinRoom,
+		roomId:  req.RoomId,
+		join:    req,
+	}, &req)
+}
+
+// CreateRoom 创建房间并以房主身份加入，room_id 为空时由服务端生成
+func (c *Client) CreateRoom(ctx context.Context, req msg.CreateRoom) (*JoinReply, error) {
+	return c.request(ctx, &waiter{
+		request: CreateRoom,
+		roomId:  req.RoomId,
+		join: msg.JoinRoom{
+			Id:       req.Id,
+			Name:     req.Name,
+			RoomId:   req.RoomId,
+			Password: req.Password,
+		},
+	}, &req)
+}
+
+func (c *Client) request(ctx context.Context, w *waiter, data any) (*JoinReply, error) {
+	w.ch = make(chan result, 1)
+
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+
+	if err := c.Send(w.request, data); err != nil {
+		c.removeWaiter(w)
+		return nil, err
+	}
+
+	timer := time.NewTimer(c.opts.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-w.ch:
+		return res.reply, res.err
+	case <-timer.C:
+		c.removeWaiter(w)
+		return nil, context.DeadlineExceeded
+	case <-ctx.Done():
+		c.removeWaiter(w)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeWaiter(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.waiters {
+		if o == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// 取出第一个符合条件的等待者，需要持有 mu
+func (c *Client) takeWaiter(match func(w *waiter) bool) *waiter {
+	for i, w := range c.waiters {
+		if match(w) {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return w
+		}
+	}
+	return nil
+}
+
+// UserId 在房间中的用户Id
+func (c *Client) UserId(roomId string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req, ok := c.rooms[roomId]; ok {
+		return req.Id, nil
+	}
+	return "", ErrNotJoined
+}
+
+func (c *Client) relay(roomId string, to string, sessionId string, mediaType string) (msg.Relay, error) {
+	from, err := c.UserId(roomId)
+	if err != nil {
+		return msg.Relay{}, err
+	}
+	return msg.Relay{
+		To:        to,
+		From:      from,
+		SessionId: sessionId,
+		RoomId:    roomId,
+		Type:      mediaType,
+	}, nil
+}
+
+// SendOffer 发送 offer
+func (c *Client) SendOffer(roomId string, to string, sessionId string, mediaType string, desc webrtc.SessionDescription) error {
+	relay, err := c.relay(roomId, to, sessionId, mediaType)
+	if err != nil {
+		return err
+	}
+	return c.Send(Offer, msg.Offer{
+		Relay: relay,
+		Description: &msg.Description{
+			Sdp:  desc.SDP,
+			Type: desc.Type.String(),
+		},
+	})
+}
+
+// SendAnswer 发送 answer
+func (c *Client) SendAnswer(roomId string, to string, sessionId string, mediaType string, desc webrtc.SessionDescription) error {
+	relay, err := c.relay(roomId, to, sessionId, mediaType)
+	if err != nil {
+		return err
+	}
+	return c.Send(Answer, msg.Answer{
+		Relay: relay,
+		Description: &msg.Description{
+			Sdp:  desc.SDP,
+			Type: desc.Type.String(),
+		},
+	})
+}
+
+// SendRenegotiate 通话中重新协商，reason 如 screenShare、iceRestart
+func (c *Client) SendRenegotiate(roomId string, to string, sessionId string, mediaType string, reason string, desc webrtc.SessionDescription) error {
+	relay, err := c.relay(roomId, to, sessionId, mediaType)
+	if err != nil {
+		return err
+	}
+	return c.Send(Renegotiate, msg.Renegotiate{
+		Offer: msg.Offer{
+			Relay: relay,
+			Description: &msg.Description{
+				Sdp:  desc.SDP,
+				Type: desc.Type.String(),
+			},
+		},
+		Reason: reason,
+	})
+}
+
+// SendCandidate 发送 candidate
+func (c *Client) SendCandidate(roomId string, to string, sessionId string, candidate webrtc.ICECandidateInit) error {
+	relay, err := c.relay(roomId, to, sessionId, "")
+	if err != nil {
+		return err
+	}
+	return c.Send(Candidate, msg.Candidate{
+		Relay: relay,
+		Candidate: &msg.IceCandidate{
+			Candidate:     candidate.Candidate,
+			SdpMid:        candidate.SDPMid,
+			SdpMLineIndex: candidate.SDPMLineIndex,
+		},
+	})
+}
+
+// Invite 呼叫房间内的用户
+func (c *Client) Invite(roomId string, to string, mediaType string) error {
+	return c.Send(Invite, msg.Invite{
+		To:     to,
+		RoomId: roomId,
+		Type:   mediaType,
+	})
+}
+
+// HangUp 挂断会话
+func (c *Client) HangUp(roomId string, sessionId string) error {
+	from, err := c.UserId(roomId)
+	if err != nil {
+		return err
+	}
+	return c.Send(HangUp, msg.HangUp{
+		SessionId: sessionId,
+		From:      from,
+		RoomId:    roomId,
+	})
+}
+
+func (c *Client) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			c.disconnected(conn, err)
+			return
+		}
+		c.dispatch(data)
+	}
+}
+
+// 连接断开，未完成的请求返回错误，开启重连时后台重连
+func (c *Client) disconnected(conn *websocket.Conn, err error) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	closed := c.closed
+	waiters := c.waiters
+	c.waiters = nil
+	c.mu.Unlock()
+
+	conn.Close()
+	for _, w := range waiters {
+		w.ch <- result{err: ErrNotConnected}
+	}
+	if closed {
+		return
+	}
+
+	if c.handlers.OnDisconnect != nil {
+		c.handlers.OnDisconnect(err)
+	}
+	if c.opts.Reconnect {
+		go c.reconnect()
+	}
+}
+
+// 按退避间隔重连，成功后用 resume token 重新加入房间
+func (c *Client) reconnect() {
+	delay := c.opts.ReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.RequestTimeout)
+		err := c.Connect(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+		delay = min(delay*2, c.opts.MaxReconnectDelay)
+	}
+
+	if c.handlers.OnReconnect != nil {
+		c.handlers.OnReconnect()
+	}
+
+	c.mu.Lock()
+	rooms := make([]msg.JoinRoom, 0, len(c.rooms))
+	for _, req := range c.rooms {
+		rooms = append(rooms, *req)
+	}
+	c.mu.Unlock()
+
+	//回复由 OnJoined 通知
+	for _, req := range rooms {
+		c.Send(JoinRoom, &req)
+	}
+}
+
+// 按类型分发服务端消息
+func (c *Client) dispatch(data []byte) {
+	var req msg.Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+
+	switch req.Type {
+	case JoinRoom:
+		var reply JoinReply
+		if err := json.Unmarshal(req.Data, &reply); err != nil {
+			return
+		}
+		c.joined(&reply)
+		if c.handlers.OnJoined != nil {
+			c.handlers.OnJoined(&reply)
+		}
+	case CreateRoom:
+		c.created(req.Data)
+		if c.handlers.OnMessage != nil {
+			c.handlers.OnMessage(req.Type, req.Data)
+		}
+	case UpdateUserList:
+		var users []UserInfo
+		if err := json.Unmarshal(req.Data, &users); err == nil && c.handlers.OnUserList != nil {
+			c.handlers.OnUserList(users)
+		}
+	case LeaveRoom:
+		var userId string
+		if err := json.Unmarshal(req.Data, &userId); err == nil && c.handlers.OnLeave != nil {
+			c.handlers.OnLeave(userId)
+		}
+	case HangUp:
+		var event HangUpEvent
+		if err := json.Unmarshal(req.Data, &event); err != nil {
+			return
+		}
+		if p := c.peer(event.SessionId); p != nil {
+			p.Close()
+		}
+		if c.handlers.OnHangUp != nil {
+			c.handlers.OnHangUp(&event)
+		}
+	case Heartbeat:
+		if c.handlers.OnHeartbeat != nil {
+			c.handlers.OnHeartbeat()
+		}
+	case Offer:
+		var offer msg.Offer
+		if err := json.Unmarshal(req.Data, &offer); err != nil || offer.Description == nil {
+			return
+		}
+		if p := c.peer(offer.SessionId); p != nil {
+			p.report(p.onOffer(&offer))
+		} else if c.handlers.OnOffer != nil {
+			c.handlers.OnOffer(&offer)
+		}
+	case Renegotiate:
+		var offer msg.Renegotiate
+		if err := json.Unmarshal(req.Data, &offer); err != nil || offer.Description == nil {
+			return
+		}
+		if p := c.peer(offer.SessionId); p != nil {
+			p.report(p.onOffer(&offer.Offer))
+		} else if c.handlers.OnRenegotiate != nil {
+			c.handlers.OnRenegotiate(&offer)
+		}
+	case Rollback:
+		var event RollbackEvent
+		if err := json.Unmarshal(req.Data, &event); err != nil {
+			return
+		}
+		if p := c.peer(event.SessionId); p != nil {
+			p.report(p.rollback())
+		}
+		if c.handlers.OnRollback != nil {
+			c.handlers.OnRollback(&event)
+		}
+	case Answer:
+		var answer msg.Answer
+		if err := json.Unmarshal(req.Data, &answer); err != nil || answer.Description == nil {
+			return
+		}
+		if p := c.peer(answer.SessionId); p != nil {
+			p.report(p.onAnswer(&answer))
+		} else if c.handlers.OnAnswer != nil {
+			c.handlers.OnAnswer(&answer)
+		}
+	case Candidate:
+		var candidate msg.Candidate
+		if err := json.Unmarshal(req.Data, &candidate); err != nil || candidate.Candidate == nil {
+			return
+		}
+		if p := c.peer(candidate.SessionId); p != nil {
+			p.report(p.onCandidate(&candidate))
+		} else if c.handlers.OnCandidate != nil {
+			c.handlers.OnCandidate(&candidate)
+		}
+	case DeliveryFailed:
+		var event DeliveryFailedEvent
+		if err := json.Unmarshal(req.Data, &event); err == nil && c.handlers.OnDeliveryFailed != nil {
+			c.handlers.OnDeliveryFailed(&event)
+		}
+	case msg.Error:
+		var e msg.ErrorData
+		if err := json.Unmarshal(req.Data, &e); err != nil {
+			return
+		}
+		c.failed(&e)
+		if c.handlers.OnError != nil {
+			c.handlers.OnError(&e)
+		}
+	default:
+		if c.handlers.OnMessage != nil {
+			c.handlers.OnMessage(req.Type, req.Data)
+		}
+	}
+}
+
+// 加入成功，记录 resume token 用于重连
+func (c *Client) joined(reply *JoinReply) {
+	c.mu.Lock()
+	w := c.takeWaiter(func(w *waiter) bool {
+		return w.roomId == reply.RoomId
+	})
+	if w != nil {
+		join := w.join
+		join.RoomId = reply.RoomId
+		c.rooms[reply.RoomId] = &join
+	}
+	if join, ok := c.rooms[reply.RoomId]; ok {
+		join.Id = reply.Id
+		join.ResumeToken = reply.ResumeToken
+		//恢复时不再需要邀请
+		join.InviteToken = ""
+	}
+	c.mu.Unlock()
+
+	if w != nil {
+		w.ch <- result{reply: reply}
+	}
+}
+
+// 服务端生成的房间Id
+func (c *Client) created(data json.RawMessage) {
+	var reply struct {
+		RoomId string `json:"room_id"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.waiters {
+		if w.request == CreateRoom && len(w.roomId) == 0 {
+			w.roomId = reply.RoomId
+			return
+		}
+	}
+}
+
+// 请求失败，交给等待该类型回复的第一个请求
+func (c *Client) failed(e *msg.ErrorData) {
+	c.mu.Lock()
+	w := c.takeWaiter(func(w *waiter) bool {
+		return w.request == e.Request
+	})
+	c.mu.Unlock()
+
+	if w != nil {
+		w.ch <- result{err: &msg.ErrorMsg{Code: e.Code, Message: e.Message}}
+	}
+}
+
+func (c *Client) peer(sessionId string) *Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[sessionId]
+}
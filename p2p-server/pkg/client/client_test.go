@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/room"
+	"webrtc/p2p-server/pkg/server"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// 启动真实的信令服务，返回服务和房间管理器
+func newTestServer(t *testing.T) (*httptest.Server, *room.RoomManager) {
+	cfg := &config.Config{}
+	cfg.Http.WsPath = "/ws"
+	cfg.Ws.HeartbeatTime = 30
+	cfg.Room.ResumeGrace = 5
+
+	rm := room.NewRoomManager(cfg)
+	s := server.NewServer(rm.HandleMsg, cfg)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts, rm
+}
+
+func newTestClient(t *testing.T, url string, opts Options, handlers Handlers) *Client {
+	opts.Url = url
+	c := New(opts, handlers)
+	t.Cleanup(func() { c.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func join(t *testing.T, c *Client, id string) *JoinReply {
+	reply, err := c.Join(context.Background(), msg.JoinRoom{RoomId: "room", Id: id, Name: id})
+	if err != nil {
+		t.Fatalf("%s 加入房间失败 %v", id, err)
+	}
+	return reply
+}
+
+// 房间内的用户数
+func roomUsers(t *testing.T, rm *room.RoomManager) int {
+	detail, err := rm.RoomDetail("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(detail.Users)
+}
+
+func TestConnectJoin(t *testing.T) {
+	ts, rm := newTestServer(t)
+	c := newTestClient(t, ts.URL+"/ws", Options{}, Handlers{})
+
+	reply := join(t, c, "alice")
+	if reply.RoomId != "room" || reply.Id != "alice" || reply.Resumed {
+		t.Fatalf("加入房间的回复 %+v", reply)
+	}
+	if len(reply.ResumeToken) == 0 {
+		t.Fatal("回复中没有 resume token")
+	}
+	if id, err := c.UserId("room"); err != nil || id != "alice" {
+		t.Fatalf("UserId 返回 %s %v", id, err)
+	}
+	if n := roomUsers(t, rm); n != 1 {
+		t.Fatalf("房间内有 %d 个用户", n)
+	}
+}
+
+// 服务端拒绝的请求把错误交给等待的请求
+func TestJoinError(t *testing.T) {
+	ts, _ := newTestServer(t)
+	alice := newTestClient(t, ts.URL+"/ws", Options{}, Handlers{})
+	join(t, alice, "alice")
+
+	other := newTestClient(t, ts.URL+"/ws", Options{}, Handlers{})
+	_, err := other.Join(context.Background(), msg.JoinRoom{RoomId: "room", Id: "alice", Name: "alice"})
+	var e *msg.ErrorMsg
+	if !errors.As(err, &e) || e.Code != msg.ErrCodeConflict {
+		t.Fatalf("重复的用户Id加入返回 %v", err)
+	}
+
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	if len(other.waiters) != 0 {
+		t.Fatalf("还有 %d 个等待的请求", len(other.waiters))
+	}
+}
+
+// 断线后自动重连，用 resume token 恢复原来的用户
+func TestReconnectResume(t *testing.T) {
+	ts, rm := newTestServer(t)
+
+	disconnected := make(chan struct{}, 1)
+	reconnected := make(chan struct{}, 1)
+	joined := make(chan *JoinReply, 2)
+	c := newTestClient(t, ts.URL+"/ws", Options{
+		Reconnect:      true,
+		ReconnectDelay: 50 * time.Millisecond,
+	}, Handlers{
+		OnJoined:     func(reply *JoinReply) { joined <- reply },
+		OnDisconnect: func(err error) { disconnected <- struct{}{} },
+		OnReconnect:  func() { reconnected <- struct{}{} },
+	})
+	first := join(t, c, "alice")
+	<-joined
+
+	//直接断开底层连接，服务端按异常断开处理
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	conn.UnderlyingConn().Close()
+
+	for _, ch := range []chan struct{}{disconnected, reconnected} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("没有断线重连")
+		}
+	}
+
+	select {
+	case reply := <-joined:
+		if !reply.Resumed || reply.Id != first.Id || reply.RoomId != "room" {
+			t.Fatalf("重连后的回复 %+v", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("重连后没有重新加入房间")
+	}
+	if n := roomUsers(t, rm); n != 1 {
+		t.Fatalf("恢复后房间内有 %d 个用户", n)
+	}
+}
+
+// 只完成握手、不回复任何消息的服务
+func newSilentServer(t *testing.T, onMessage func(conn *websocket.Conn)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			if onMessage != nil {
+				onMessage(conn)
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ts := newSilentServer(t, nil)
+	c := newTestClient(t, ts.URL, Options{RequestTimeout: 100 * time.Millisecond}, Handlers{})
+
+	_, err := c.Join(context.Background(), msg.JoinRoom{RoomId: "room", Id: "alice", Name: "alice"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("超时返回 %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.waiters) != 0 {
+		t.Fatalf("超时后还有 %d 个等待的请求", len(c.waiters))
+	}
+}
+
+// 等待回复时连接断开，请求返回 ErrNotConnected
+func TestRequestDisconnect(t *testing.T) {
+	ts := newSilentServer(t, func(conn *websocket.Conn) { conn.Close() })
+	c := newTestClient(t, ts.URL, Options{}, Handlers{})
+
+	_, err := c.Join(context.Background(), msg.JoinRoom{RoomId: "room", Id: "alice", Name: "alice"})
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("断线返回 %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"encoding/json"
+	"webrtc/p2p-server/pkg/ice"
+	"webrtc/p2p-server/pkg/msg"
+)
+
+// 服务端消息类型，与 room 中的定义一致
+const (
+	JoinRoom       = "joinRoom"       //加入房间
+	CreateRoom     = "createRoom"     //创建房间
+	Offer          = "offer"          //Offer消息
+	Answer         = "answer"         //Answer消息
+	Candidate      = "candidate"      //Candidate消息
+	HangUp         = "hangUp"         //挂断
+	LeaveRoom      = "leaveRoom"      //离开房间
+	UpdateUserList = "updateUserList" //更新房间用户列表
+	Invite         = "invite"         //发起呼叫
+	Heartbeat      = "heartbeat"      //心跳
+	DeliveryFailed = "deliveryFailed" //转发的消息没有送达
+	Renegotiate    = "renegotiate"    //通话中重新协商
+	Rollback       = "rollback"       //协商冲突，需要回滚自己的 offer
+)
+
+// UserInfo 房间内的用户
+type UserInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	//信令连接的往返时间(毫秒)
+	Rtt int64 `json:"rtt"`
+	//用户状态
+	State string `json:"state"`
+	//角色
+	Role string `json:"role"`
+}
+
+// JoinReply 加入房间的回复
+type JoinReply struct {
+	RoomId string `json:"room_id"`
+	Id     string `json:"id"`
+	//角色
+	Role string `json:"role"`
+	//断线重连凭证
+	ResumeToken string `json:"resume_token"`
+	//是否恢复了之前的连接
+	Resumed bool `json:"resumed"`
+	//STUN/TURN 配置，ice.WebRTC() 可以直接用于创建 PeerConnection
+	Ice *ice.Config `json:"ice"`
+}
+
+// HangUpEvent 会话结束
+type HangUpEvent struct {
+	//接收方
+	To        string `json:"to"`
+	SessionId string `json:"session_id"`
+	//会话双方
+	Users  []string `json:"users"`
+	State  string   `json:"state"`
+	Reason string   `json:"reason"`
+}
+
+// DeliveryFailedEvent 发出的 offer/answer/candidate 没有送达
+type DeliveryFailedEvent struct {
+	RoomId string `json:"room_id"`
+	//接收方
+	To string `json:"to"`
+	//原消息类型
+	Type      string `json:"type"`
+	SessionId string `json:"session_id"`
+	//expired/overflow/left
+	Reason string `json:"reason"`
+}
+
+// RollbackEvent 双方同时发出 offer，自己的 offer 没有转发
+type RollbackEvent struct {
+	RoomId string `json:"room_id"`
+	//被丢弃的 offer 所在的会话
+	SessionId string `json:"session_id"`
+	//继续协商的会话，对方的 offer 在这个会话中
+	ActiveSessionId string `json:"active_session_id"`
+	//胜出的一方
+	Winner string `json:"winner"`
+	//会话的礼貌方
+	Polite string `json:"polite"`
+}
+
+// Handlers 服务端消息的回调，在读协程中按收到的顺序调用
+// 已经通过 NewPeer 接管的会话，offer/answer/candidate 不再回调
+// 回调中不能同步等待 Join 等请求的回复，需要时另起协程
+type Handlers struct {
+	//加入房间成功，断线重连后恢复时 Resumed 为 true
+	OnJoined func(reply *JoinReply)
+	//房间用户列表更新
+	OnUserList func(users []UserInfo)
+	//用户离开房间
+	OnLeave func(userId string)
+	//会话结束
+	OnHangUp func(event *HangUpEvent)
+	//服务端心跳
+	OnHeartbeat func()
+	OnOffer     func(data *msg.Offer)
+	OnAnswer    func(data *msg.Answer)
+	OnCandidate func(data *msg.Candidate)
+	//通话中对方重新协商，用 SendAnswer 回复
+	OnRenegotiate func(data *msg.Renegotiate)
+	//协商冲突，自己的 offer 被丢弃，已接管的会话会自动回滚
+	OnRollback func(event *RollbackEvent)
+	//发出的信令没有送达
+	OnDeliveryFailed func(event *DeliveryFailedEvent)
+	//请求失败
+	OnError func(data *msg.ErrorData)
+	//接管的会话处理信令失败
+	OnPeerError func(p *Peer, err error)
+	//其他类型的消息
+	OnMessage func(msgType string, data json.RawMessage)
+	//连接断开，开启重连时随后会自动重连
+	OnDisconnect func(err error)
+	//重连成功，已加入的房间会用 resume token 重新加入
+	OnReconnect func()
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"sync"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Peer 把 pion 的 PeerConnection 接到一个会话的信令上
+// 自动发送本地 candidate，处理对方的 offer/answer/candidate
+type Peer struct {
+	RoomId string
+	//对方用户Id
+	RemoteId  string
+	SessionId string
+	//媒体类型 video/audio/screen
+	Type string
+	PC   *webrtc.PeerConnection
+	//礼貌方，双方同时发出 offer 时回滚自己的 offer，被叫是礼貌方
+	Polite bool
+
+	c  *Client
+	mu sync.Mutex
+	//设置远端描述前收到的 candidate
+	pending []webrtc.ICECandidateInit
+}
+
+// NewPeer 接管会话的信令，同一个会话只能有一个 Peer
+func (c *Client) NewPeer(roomId string, remoteId string, sessionId string, mediaType string, pc *webrtc.PeerConnection) *Peer {
+	p := &Peer{
+		RoomId:    roomId,
+		RemoteId:  remoteId,
+		SessionId: sessionId,
+		Type:      mediaType,
+		PC:        pc,
+		c:         c,
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		p.report(c.SendCandidate(roomId, remoteId, sessionId, candidate.ToJSON()))
+	})
+
+	c.mu.Lock()
+	c.peers[sessionId] = p
+	c.mu.Unlock()
+
+	return p
+}
+
+// Accept 接管收到的 offer 所在的会话并回复 answer
+func (c *Client) Accept(offer *msg.Offer, pc *webrtc.PeerConnection) (*Peer, error) {
+	p := c.NewPeer(offer.RoomId, offer.From, offer.SessionId, offer.Type, pc)
+	p.Polite = true
+	if err := p.onOffer(offer); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Offer 创建并发送 offer，首次呼叫和重新协商都可以调用
+func (p *Peer) Offer() error {
+	offer, err := p.PC.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	//先发送 offer 再开始收集 candidate
+	if err := p.c.SendOffer(p.RoomId, p.RemoteId, p.SessionId, p.Type, offer); err != nil {
+		return err
+	}
+	return p.PC.SetLocalDescription(offer)
+}
+
+// Renegotiate 通话中重新协商，如添加屏幕共享的轨道后调用
+// iceRestart 为 true 时重新收集 candidate
+func (p *Peer) Renegotiate(reason string, iceRestart bool) error {
+	offer, err := p.PC.CreateOffer(&webrtc.OfferOptions{ICERestart: iceRestart})
+	if err != nil {
+		return err
+	}
+	if err := p.c.SendRenegotiate(p.RoomId, p.RemoteId, p.SessionId, p.Type, reason, offer); err != nil {
+		return err
+	}
+	return p.PC.SetLocalDescription(offer)
+}
+
+// HangUp 挂断会话并关闭连接
+func (p *Peer) HangUp() error {
+	err := p.c.HangUp(p.RoomId, p.SessionId)
+	p.Close()
+	return err
+}
+
+// Close 关闭连接，不再接管会话的信令
+func (p *Peer) Close() error {
+	p.c.mu.Lock()
+	if p.c.peers[p.SessionId] == p {
+		delete(p.c.peers, p.SessionId)
+	}
+	p.c.mu.Unlock()
+
+	return p.PC.Close()
+}
+
+func (p *Peer) onOffer(offer *msg.Offer) error {
+	//双方同时发出 offer，不礼貌方忽略对方的 offer，礼貌方回滚自己的
+	if p.PC.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if !p.Polite {
+			return nil
+		}
+		if err := p.rollback(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.PC.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer.Description.Sdp,
+	}); err != nil {
+		return err
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	answer, err := p.PC.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := p.c.SendAnswer(p.RoomId, p.RemoteId, p.SessionId, p.Type, answer); err != nil {
+		return err
+	}
+	return p.PC.SetLocalDescription(answer)
+}
+
+// 回滚还没有收到 answer 的 offer
+func (p *Peer) rollback() error {
+	if p.PC.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return nil
+	}
+	return p.PC.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+}
+
+func (p *Peer) onAnswer(answer *msg.Answer) error {
+	if err := p.PC.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer.Description.Sdp,
+	}); err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+func (p *Peer) onCandidate(data *msg.Candidate) error {
+	candidate := webrtc.ICECandidateInit{
+		Candidate:     data.Candidate.Candidate,
+		SDPMid:        data.Candidate.SdpMid,
+		SDPMLineIndex: data.Candidate.SdpMLineIndex,
+	}
+
+	p.mu.Lock()
+	if p.PC.RemoteDescription() == nil {
+		p.pending = append(p.pending, candidate)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	return p.PC.AddICECandidate(candidate)
+}
+
+// 设置远端描述后添加之前收到的 candidate
+func (p *Peer) flush() error {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	for _, candidate := range pending {
+		if err := p.PC.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Peer) report(err error) {
+	if err != nil && p.c.handlers.OnPeerError != nil {
+		p.c.handlers.OnPeerError(p, err)
+	}
+}
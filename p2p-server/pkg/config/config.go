@@ -8,9 +8,19 @@ import (
 )
 
 type Config struct {
-	Http HttpConfig
-	Log  LogConfig
-	Ws   WsConfig
+	Http    HttpConfig
+	Log     LogConfig
+	Ws      WsConfig
+	Room    RoomConfig
+	Auth    AuthConfig
+	Admin   AdminConfig
+	Metrics MetricsConfig
+	Sfu     SfuConfig
+	Record  RecordConfig
+	Whip    WhipConfig
+	Whep    WhepConfig
+	Ice     IceConfig
+	Media   MediaConfig
 }
 
 type HttpConfig struct {
@@ -21,6 +31,10 @@ type HttpConfig struct {
 	Cert     string `mapstructure:"cert"`
 	HtmlRoot string `mapstructure:"html_root"`
 	WsPath   string `mapstructure:"ws_path"`
+	//下线时等待进行中通话结束的时间(秒)
+	DrainTime int `mapstructure:"drain_time"`
+	//允许发起 WebSocket 连接的页面来源，如 https://example.com，* 表示不限制，为空时只允许同源
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
 }
 
 type LogConfig struct {
@@ -29,6 +43,152 @@ type LogConfig struct {
 
 type WsConfig struct {
 	HeartbeatTime int `mapstructure:"heartbeat_time"`
+	//发送队列长度
+	SendQueueSize int `mapstructure:"send_queue_size"`
+	//发送队列满时的策略 drop_oldest|drop_newest|disconnect
+	OverflowPolicy string `mapstructure:"overflow_policy"`
+	//写超时(秒)
+	WriteTimeout int `mapstructure:"write_timeout"`
+	//ping间隔(秒)
+	PingTime int `mapstructure:"ping_time"`
+	//允许连续丢失的pong次数，超过后断开连接
+	MaxMissedPongs int `mapstructure:"max_missed_pongs"`
+	//每个连接每秒允许的消息数，0表示不限制
+	RateLimit float64 `mapstructure:"rate_limit"`
+	//允许的突发消息数
+	RateBurst int `mapstructure:"rate_burst"`
+}
+
+type RoomConfig struct {
+	//呼叫超时(秒)，多人通话在这个时间内没有建立的连接会被挂断，0表示不超时
+	InviteTimeout int `mapstructure:"invite_timeout"`
+	//断线重连宽限期(秒)，0表示断线立即离开房间
+	ResumeGrace int `mapstructure:"resume_grace"`
+	//断线或还没加入的用户最多缓存的转发消息数
+	ResumeBuffer int `mapstructure:"resume_buffer"`
+	//缓存的转发消息有效期(秒)，过期后通知发送方 deliveryFailed
+	PendingTtl int `mapstructure:"pending_ttl"`
+	//房间最多参与人数(不含观众)，0表示不限制
+	MaxParticipants int `mapstructure:"max_participants"`
+	//关闭 joinRoom 自动创建房间，只能通过 createRoom 创建
+	DisableAutoCreate bool `mapstructure:"disable_auto_create"`
+	//通过 createRoom 创建的房间变空后保留的时间(秒)
+	EmptyTimeout int `mapstructure:"empty_timeout"`
+	//邀请签名密钥
+	InviteSecret string `mapstructure:"invite_secret"`
+	//邀请默认有效期(秒)
+	InviteTtl int `mapstructure:"invite_ttl"`
+}
+
+type AuthConfig struct {
+	//是否开启token认证
+	Enable bool `mapstructure:"enable"`
+	//HS256 密钥
+	HmacSecret string `mapstructure:"hmac_secret"`
+	//RS256 公钥文件(PEM)
+	RsaPublicKey string `mapstructure:"rsa_public_key"`
+	//RS256 公钥 JWKS 文件
+	JwksFile string `mapstructure:"jwks_file"`
+	//校验 iss，为空不校验
+	Issuer string `mapstructure:"issuer"`
+	//校验 aud，为空不校验
+	Audience string `mapstructure:"audience"`
+	//token 所在的查询参数
+	QueryParam string `mapstructure:"query_param"`
+}
+
+type AdminConfig struct {
+	//是否开启管理接口
+	Enable bool `mapstructure:"enable"`
+	//接口路径前缀
+	Path string `mapstructure:"path"`
+	//Bearer token
+	Token string `mapstructure:"token"`
+}
+
+type MetricsConfig struct {
+	//是否开启 Prometheus 指标
+	Enable bool `mapstructure:"enable"`
+	//指标路径
+	Path string `mapstructure:"path"`
+}
+
+type SfuConfig struct {
+	//是否允许创建 SFU 模式的房间
+	Enable bool `mapstructure:"enable"`
+	//STUN/TURN 服务器地址
+	IceServers []string `mapstructure:"ice_servers"`
+	//UDP 端口范围，0表示不限制
+	PortMin uint16 `mapstructure:"port_min"`
+	PortMax uint16 `mapstructure:"port_max"`
+	//服务器公网IP，部署在 NAT 后面时填写
+	PublicIps []string `mapstructure:"public_ips"`
+}
+
+type RecordConfig struct {
+	//是否允许录制
+	Enable bool `mapstructure:"enable"`
+	//录制文件目录
+	Dir string `mapstructure:"dir"`
+}
+
+type WhipConfig struct {
+	//是否开启 WHIP 推流接口
+	Enable bool `mapstructure:"enable"`
+	//接口路径前缀
+	Path string `mapstructure:"path"`
+	//未开启认证时使用的 Bearer token
+	Token string `mapstructure:"token"`
+}
+
+type WhepConfig struct {
+	//是否开启 WHEP 播放接口
+	Enable bool `mapstructure:"enable"`
+	//接口路径前缀
+	Path string `mapstructure:"path"`
+	//未开启认证时使用的 Bearer token
+	Token string `mapstructure:"token"`
+}
+
+type IceConfig struct {
+	//STUN 地址，如 stun:stun.example.com:3478
+	Stun []string `mapstructure:"stun"`
+	//TURN 地址，可以同时列出 UDP/TCP/TLS，如 turn:host:3478?transport=udp、turns:host:5349?transport=tcp
+	Turn []string `mapstructure:"turn"`
+	//与 turn-server 共享的密钥(turn_key)，为空时不下发 TURN
+	Secret string `mapstructure:"secret"`
+	//TURN 凭证有效期(秒)
+	Ttl int `mapstructure:"ttl"`
+	//默认的 ICE 传输策略 all|relay，创建房间时可以单独指定
+	Policy string `mapstructure:"policy"`
+	//转发 candidate 时的过滤规则，对所有房间生效
+	Filter IceFilterConfig `mapstructure:"filter"`
+	//按角色的过滤规则，发送方或接收方的角色有规则时都会生效
+	Roles map[string]IceFilterConfig `mapstructure:"roles"`
+}
+
+type IceFilterConfig struct {
+	//移除 host candidate，隐藏内网地址
+	StripHost bool `mapstructure:"strip_host"`
+	//移除 srflx/prflx candidate，隐藏公网地址
+	StripSrflx bool `mapstructure:"strip_srflx"`
+	//只转发 relay candidate
+	RelayOnly bool `mapstructure:"relay_only"`
+	//移除这些网段的 candidate，如 10.0.0.0/8
+	BlockCidrs []string `mapstructure:"block_cidrs"`
+}
+
+type MediaConfig struct {
+	//允许的媒体类型 audio|video|application，为空表示不限制
+	Kinds []string `mapstructure:"kinds"`
+	//允许的编码，如 opus、VP8、H264，为空表示不限制
+	Codecs []string `mapstructure:"codecs"`
+	//编码优先顺序，排在前面的优先
+	Prefer []string `mapstructure:"prefer"`
+	//音频码率上限(kbps)，0表示不限制
+	AudioBitrate uint64 `mapstructure:"audio_bitrate"`
+	//视频码率上限(kbps)，0表示不限制
+	VideoBitrate uint64 `mapstructure:"video_bitrate"`
 }
 
 var conf Config
@@ -0,0 +1,201 @@
+package ice
+
+import (
+	"net"
+	"strings"
+)
+
+// candidate 类型
+const (
+	typeHost  = "host"
+	typeSrflx = "srflx"
+	typePrflx = "prflx"
+	typeRelay = "relay"
+)
+
+// Filter candidate 过滤规则，防止把用户的内网和公网地址泄露给对端
+type Filter struct {
+	//移除 host candidate
+	StripHost bool
+	//移除 srflx/prflx candidate
+	StripSrflx bool
+	//只保留 relay candidate
+	RelayOnly bool
+	//移除这些网段的 candidate
+	Block []*net.IPNet
+}
+
+// ParseCidrs 解析网段列表
+func ParseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Merge 合并两组规则，任意一组要求过滤的都会过滤
+func (f Filter) Merge(o Filter) Filter {
+	return Filter{
+		StripHost:  f.StripHost || o.StripHost,
+		StripSrflx: f.StripSrflx || o.StripSrflx,
+		RelayOnly:  f.RelayOnly || o.RelayOnly,
+		Block:      append(f.Block[:len(f.Block):len(f.Block)], o.Block...),
+	}
+}
+
+// Empty 没有任何规则
+func (f Filter) Empty() bool {
+	return !f.StripHost && !f.StripSrflx && !f.RelayOnly && len(f.Block) == 0
+}
+
+func (f Filter) blocked(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.Block {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否隐藏 candidate 的 raddr，srflx 的 raddr 是内网地址，relay 的 raddr 是公网地址
+func (f Filter) hideRelated(typ string, raddr string) bool {
+	if f.blocked(raddr) {
+		return true
+	}
+	switch typ {
+	case typeSrflx, typePrflx:
+		return f.StripHost || f.RelayOnly
+	case typeRelay:
+		return f.StripSrflx || f.RelayOnly
+	}
+	return false
+}
+
+func (f Filter) allow(typ string, addr string) bool {
+	if f.blocked(addr) {
+		return false
+	}
+	switch typ {
+	case typeHost:
+		return !f.StripHost && !f.RelayOnly
+	case typeSrflx, typePrflx:
+		return !f.StripSrflx && !f.RelayOnly
+	}
+	return true
+}
+
+// Candidate 过滤一条 candidate，返回改写后的 candidate，不允许转发时返回 false
+// 空 candidate(收集结束)和无法解析的 candidate 原样返回
+func (f Filter) Candidate(candidate string) (string, bool) {
+	if f.Empty() {
+		return candidate, true
+	}
+
+	fields := strings.Fields(candidate)
+	//candidate:foundation component transport priority address port typ type [raddr addr rport port] ...
+	if len(fields) < 8 || fields[6] != "typ" {
+		return candidate, true
+	}
+	typ := fields[7]
+	if !f.allow(typ, fields[4]) {
+		return "", false
+	}
+
+	changed := false
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			if f.hideRelated(typ, fields[i+1]) {
+				fields[i+1] = unspecified(fields[i+1])
+				changed = true
+			}
+		case "rport":
+			if changed {
+				fields[i+1] = "0"
+			}
+		}
+	}
+	if !changed {
+		return candidate, true
+	}
+	return strings.Join(fields, " "), true
+}
+
+// 与地址同类型的未指定地址
+func unspecified(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// Sdp 移除 SDP 中不允许的 a=candidate 行并隐藏 raddr
+// 过滤掉 candidate 的 SDP 中 c= 行的默认地址也会泄露地址，改为未指定地址
+func (f Filter) Sdp(sdp string) (string, bool) {
+	if f.Empty() {
+		return sdp, false
+	}
+
+	sep := "\r\n"
+	if !strings.Contains(sdp, sep) {
+		sep = "\n"
+	}
+	lines := strings.Split(sdp, sep)
+
+	//保留的 candidate 地址，c= 行只能使用这些地址
+	kept := make(map[string]bool)
+	out := make([]string, 0, len(lines))
+	changed := false
+	for _, line := range lines {
+		c, ok := strings.CutPrefix(line, "a=")
+		if !ok || !strings.HasPrefix(c, "candidate:") {
+			out = append(out, line)
+			continue
+		}
+		filtered, ok := f.Candidate(c)
+		if !ok {
+			changed = true
+			continue
+		}
+		if fields := strings.Fields(filtered); len(fields) > 4 {
+			kept[fields[4]] = true
+		}
+		if filtered != c {
+			changed = true
+		}
+		out = append(out, "a="+filtered)
+	}
+
+	for i, line := range out {
+		//c=IN IP4 addr
+		if fields := strings.Fields(line); strings.HasPrefix(line, "c=") && len(fields) == 3 {
+			addr := fields[2]
+			if addr != unspecified(addr) && !kept[addr] && !f.allowDefault(addr) {
+				out[i] = "c=" + strings.TrimPrefix(fields[0], "c=") + " " + fields[1] + " " + unspecified(addr)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return sdp, false
+	}
+	return strings.Join(out, sep), true
+}
+
+// c= 行的默认地址在只过滤网段时，不在网段内的可以保留
+func (f Filter) allowDefault(addr string) bool {
+	if f.StripHost || f.StripSrflx || f.RelayOnly {
+		return false
+	}
+	return !f.blocked(addr)
+}
@@ -0,0 +1,142 @@
+package ice
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	hostCandidate  = "candidate:1 1 udp 2122260223 192.168.1.10 50000 typ host generation 0"
+	srflxCandidate = "candidate:2 1 udp 1686052607 203.0.113.5 50001 typ srflx raddr 192.168.1.10 rport 50000 generation 0"
+	relayCandidate = "candidate:3 1 udp 41885439 198.51.100.7 3478 typ relay raddr 203.0.113.5 rport 50001 generation 0"
+	ipv6Candidate  = "candidate:4 1 udp 2122262783 fd00::1 50002 typ host generation 0"
+)
+
+func mustCidrs(t *testing.T, cidrs ...string) Filter {
+	t.Helper()
+	nets, err := ParseCidrs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Filter{Block: nets}
+}
+
+func TestCandidate(t *testing.T) {
+	private := mustCidrs(t, "192.168.0.0/16", "fd00::/8")
+
+	cases := []struct {
+		name      string
+		filter    Filter
+		candidate string
+		ok        bool
+		want      string
+	}{
+		{"没有规则", Filter{}, hostCandidate, true, hostCandidate},
+		{"收集结束", Filter{RelayOnly: true}, "", true, ""},
+		{"无法解析", Filter{RelayOnly: true}, "candidate:bad", true, "candidate:bad"},
+		{"StripHost移除host", Filter{StripHost: true}, hostCandidate, false, ""},
+		{"StripHost隐藏srflx的raddr", Filter{StripHost: true}, srflxCandidate, true,
+			"candidate:2 1 udp 1686052607 203.0.113.5 50001 typ srflx raddr 0.0.0.0 rport 0 generation 0"},
+		{"StripHost保留relay", Filter{StripHost: true}, relayCandidate, true, relayCandidate},
+		{"StripSrflx移除srflx", Filter{StripSrflx: true}, srflxCandidate, false, ""},
+		{"StripSrflx隐藏relay的raddr", Filter{StripSrflx: true}, relayCandidate, true,
+			"candidate:3 1 udp 41885439 198.51.100.7 3478 typ relay raddr 0.0.0.0 rport 0 generation 0"},
+		{"StripSrflx保留host", Filter{StripSrflx: true}, hostCandidate, true, hostCandidate},
+		{"RelayOnly移除host", Filter{RelayOnly: true}, hostCandidate, false, ""},
+		{"RelayOnly移除srflx", Filter{RelayOnly: true}, srflxCandidate, false, ""},
+		{"RelayOnly保留relay", Filter{RelayOnly: true}, relayCandidate, true,
+			"candidate:3 1 udp 41885439 198.51.100.7 3478 typ relay raddr 0.0.0.0 rport 0 generation 0"},
+		{"网段内的地址", private, hostCandidate, false, ""},
+		{"网段内的IPv6地址", private, ipv6Candidate, false, ""},
+		{"网段内的raddr", private, srflxCandidate, true,
+			"candidate:2 1 udp 1686052607 203.0.113.5 50001 typ srflx raddr 0.0.0.0 rport 0 generation 0"},
+		{"网段外的地址", private, relayCandidate, true, relayCandidate},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := c.filter.Candidate(c.candidate)
+			if ok != c.ok || (ok && got != c.want) {
+				t.Fatalf("返回 %q %v，期望 %q %v", got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func testSdp(sep string) string {
+	return strings.Join([]string{
+		"v=0",
+		"o=- 1 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=audio 50000 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 192.168.1.10",
+		"a=" + hostCandidate,
+		"a=" + srflxCandidate,
+		"a=" + relayCandidate,
+		"a=end-of-candidates",
+		"",
+	}, sep)
+}
+
+func TestSdp(t *testing.T) {
+	cases := []struct {
+		name    string
+		filter  Filter
+		sep     string
+		changed bool
+		//过滤后应包含和不应包含的行
+		has []string
+		not []string
+	}{
+		{"没有规则", Filter{}, "\r\n", false, []string{"c=IN IP4 192.168.1.10", "a=" + hostCandidate}, nil},
+		{"RelayOnly", Filter{RelayOnly: true}, "\r\n", true,
+			[]string{"c=IN IP4 0.0.0.0", "typ relay raddr 0.0.0.0 rport 0", "a=end-of-candidates"},
+			[]string{"typ host", "typ srflx", "192.168.1.10", "203.0.113.5"}},
+		{"LF换行", Filter{StripHost: true}, "\n", true,
+			[]string{"c=IN IP4 0.0.0.0\n", "typ srflx raddr 0.0.0.0 rport 0", "a=" + relayCandidate},
+			[]string{"typ host", "\r\n"}},
+		{"网段", mustCidrs(t, "192.168.0.0/16"), "\r\n", true,
+			[]string{"c=IN IP4 0.0.0.0", "a=" + relayCandidate},
+			[]string{"192.168.1.10"}},
+		//c= 行的地址不在网段内时保留
+		{"网段外的默认地址", mustCidrs(t, "10.0.0.0/8"), "\r\n", false, []string{"c=IN IP4 192.168.1.10"}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := testSdp(c.sep)
+			got, changed := c.filter.Sdp(raw)
+			if changed != c.changed || (!changed && got != raw) {
+				t.Fatalf("是否改写 %v\n%s", changed, got)
+			}
+			for _, s := range c.has {
+				if !strings.Contains(got, s) {
+					t.Fatalf("没有 %q\n%s", s, got)
+				}
+			}
+			for _, s := range c.not {
+				if strings.Contains(got, s) {
+					t.Fatalf("还有 %q\n%s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := mustCidrs(t, "10.0.0.0/8")
+	b := mustCidrs(t, "192.168.0.0/16")
+	a.StripHost = true
+	b.RelayOnly = true
+
+	m := a.Merge(b)
+	if !m.StripHost || m.StripSrflx || !m.RelayOnly || len(m.Block) != 2 {
+		t.Fatalf("合并结果 %+v", m)
+	}
+	//合并不修改原来的规则
+	if len(a.Block) != 1 || len(b.Block) != 1 {
+		t.Fatal("合并修改了原来的网段")
+	}
+	if _, err := ParseCidrs([]string{"not a cidr"}); err == nil {
+		t.Fatal("错误的网段没有返回错误")
+	}
+}
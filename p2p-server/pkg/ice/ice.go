@@ -0,0 +1,162 @@
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICE 传输策略，与 RTCIceTransportPolicy 一致
+const (
+	PolicyAll   = "all"   //使用所有类型的 candidate
+	PolicyRelay = "relay" //只使用 TURN 中继
+)
+
+const defaultTtl = 24 * time.Hour
+
+// Server 下发给客户端的 ICE 服务器，字段与 RTCIceServer 一致
+type Server struct {
+	Urls       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Config 下发给客户端的 ICE 配置，可以直接作为 RTCPeerConnection 的配置
+type Config struct {
+	IceServers         []Server `json:"iceServers"`
+	IceTransportPolicy string   `json:"iceTransportPolicy"`
+	//TURN 凭证的过期时间(unix 秒)，没有 TURN 时为0
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// WebRTC 转换为 pion 的配置，供 Go 客户端使用
+func (c *Config) WebRTC() webrtc.Configuration {
+	conf := webrtc.Configuration{
+		ICETransportPolicy: webrtc.NewICETransportPolicy(c.IceTransportPolicy),
+	}
+	for _, s := range c.IceServers {
+		conf.ICEServers = append(conf.ICEServers, webrtc.ICEServer{
+			URLs:       s.Urls,
+			Username:   s.Username,
+			Credential: s.Credential,
+		})
+	}
+	return conf
+}
+
+// Provider 按配置生成 ICE 配置
+// TURN 使用 REST 凭证：用户名为 "过期时间:用户Id"，密码为用共享密钥对用户名做 HMAC-SHA1 后的 base64
+type Provider struct {
+	stun   []string
+	turn   []string
+	secret []byte
+	ttl    time.Duration
+	policy string
+	//所有房间的 candidate 过滤规则
+	filter Filter
+	//按角色的过滤规则
+	roles map[string]Filter
+}
+
+func NewProvider(cfg *config.Config) *Provider {
+	p := &Provider{
+		stun:   cfg.Ice.Stun,
+		turn:   cfg.Ice.Turn,
+		secret: []byte(cfg.Ice.Secret),
+		ttl:    time.Duration(cfg.Ice.Ttl) * time.Second,
+		policy: cfg.Ice.Policy,
+	}
+	if p.ttl <= 0 {
+		p.ttl = defaultTtl
+	}
+	if !ValidPolicy(p.policy) {
+		p.policy = PolicyAll
+	}
+	p.filter = newFilter(cfg.Ice.Filter)
+	p.roles = make(map[string]Filter, len(cfg.Ice.Roles))
+	for role, fc := range cfg.Ice.Roles {
+		p.roles[role] = newFilter(fc)
+	}
+	return p
+}
+
+func newFilter(fc config.IceFilterConfig) Filter {
+	block, err := ParseCidrs(fc.BlockCidrs)
+	if err != nil {
+		logger.Log.Errorf("candidate 过滤网段配置错误 %v", err)
+	}
+	return Filter{
+		StripHost:  fc.StripHost,
+		StripSrflx: fc.StripSrflx,
+		RelayOnly:  fc.RelayOnly,
+		Block:      block,
+	}
+}
+
+// Filter 合并服务端、房间和角色的过滤规则，relay 策略的房间只转发 relay candidate
+func (p *Provider) Filter(room Filter, policy string, roles ...string) Filter {
+	f := p.filter.Merge(room)
+	if p.Policy(policy) == PolicyRelay {
+		f.RelayOnly = true
+	}
+	for _, role := range roles {
+		if rf, ok := p.roles[role]; ok {
+			f = f.Merge(rf)
+		}
+	}
+	return f
+}
+
+// ValidPolicy 是否是支持的传输策略，空表示使用默认策略
+func ValidPolicy(policy string) bool {
+	return len(policy) == 0 || policy == PolicyAll || policy == PolicyRelay
+}
+
+// Policy 实际使用的传输策略，policy 为空时使用默认策略
+func (p *Provider) Policy(policy string) string {
+	if len(policy) == 0 {
+		return p.policy
+	}
+	return policy
+}
+
+// Config 为用户生成 ICE 配置，policy 为空时使用默认策略
+// 没有配置共享密钥时不下发 TURN
+func (p *Provider) Config(userId string, policy string) *Config {
+	policy = p.Policy(policy)
+	c := &Config{
+		IceServers:         make([]Server, 0, 2),
+		IceTransportPolicy: policy,
+	}
+
+	if len(p.stun) > 0 && policy != PolicyRelay {
+		c.IceServers = append(c.IceServers, Server{Urls: p.stun})
+	}
+
+	if len(p.turn) > 0 && len(p.secret) > 0 {
+		expires := time.Now().Add(p.ttl)
+		username, credential := Credential(p.secret, userId, expires)
+		c.IceServers = append(c.IceServers, Server{
+			Urls:       p.turn,
+			Username:   username,
+			Credential: credential,
+		})
+		c.Expires = expires.Unix()
+	}
+
+	return c
+}
+
+// Credential 生成 TURN REST 凭证，与 turn-server 的校验方式一致
+func Credential(secret []byte, userId string, expires time.Time) (username string, credential string) {
+	username = strconv.FormatInt(expires.Unix(), 10) + ":" + userId
+	hash := hmac.New(sha1.New, secret)
+	hash.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,360 @@
+package media
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/pion/sdp/v3"
+)
+
+// 媒体类型
+const (
+	KindAudio       = "audio"
+	KindVideo       = "video"
+	KindApplication = "application" //DataChannel
+)
+
+const (
+	//重传编码，跟随原编码保留
+	codecRtx = "rtx"
+	//b= 带宽类型
+	bandwidthAs   = "AS"
+	bandwidthTias = "TIAS"
+)
+
+// Section 一个 m= 段的协商信息
+type Section struct {
+	Mid       string `json:"mid,omitempty"`
+	Kind      string `json:"kind"`
+	Direction string `json:"direction"`
+	//按优先顺序排列的编码
+	Codecs []string `json:"codecs,omitempty"`
+	//端口为0，对端拒绝了这个媒体
+	Rejected bool `json:"rejected,omitempty"`
+	//码率上限(kbps)，0表示没有限制
+	Bitrate uint64 `json:"bitrate,omitempty"`
+}
+
+// Description SDP 中的媒体信息
+type Description struct {
+	Media []Section `json:"media"`
+}
+
+// Policy 媒体策略
+type Policy struct {
+	//允许的媒体类型，为空表示不限制
+	Kinds []string
+	//允许的编码，为空表示不限制，rtx 跟随原编码
+	Codecs []string
+	//编码优先顺序
+	Prefer []string
+	//音频码率上限(kbps)，0表示不限制
+	AudioBitrate uint64
+	//视频码率上限(kbps)，0表示不限制
+	VideoBitrate uint64
+}
+
+func NewPolicy(cfg *config.Config) Policy {
+	return Policy{
+		Kinds:        cfg.Media.Kinds,
+		Codecs:       cfg.Media.Codecs,
+		Prefer:       cfg.Media.Prefer,
+		AudioBitrate: cfg.Media.AudioBitrate,
+		VideoBitrate: cfg.Media.VideoBitrate,
+	}
+}
+
+// Merge 合并房间的策略，允许列表取交集，码率取较小值，优先顺序使用房间的
+func (p Policy) Merge(o Policy) Policy {
+	m := Policy{
+		Kinds:        intersect(p.Kinds, o.Kinds),
+		Codecs:       intersect(p.Codecs, o.Codecs),
+		Prefer:       p.Prefer,
+		AudioBitrate: minBitrate(p.AudioBitrate, o.AudioBitrate),
+		VideoBitrate: minBitrate(p.VideoBitrate, o.VideoBitrate),
+	}
+	if len(o.Prefer) > 0 {
+		m.Prefer = o.Prefer
+	}
+	return m
+}
+
+// 空列表表示不限制
+func intersect(a []string, b []string) []string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]string, 0, len(a))
+	for _, v := range a {
+		if contains(b, v) {
+			out = append(out, v)
+		}
+	}
+	//交集为空时不允许任何值，而不是不限制
+	if len(out) == 0 {
+		out = append(out, "")
+	}
+	return out
+}
+
+func minBitrate(a uint64, b uint64) uint64 {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Empty 没有任何限制
+func (p Policy) Empty() bool {
+	return len(p.Kinds) == 0 && len(p.Codecs) == 0 && len(p.Prefer) == 0 && p.AudioBitrate == 0 && p.VideoBitrate == 0
+}
+
+// 编码名不区分大小写
+func contains(list []string, name string) bool {
+	return slices.ContainsFunc(list, func(v string) bool {
+		return strings.EqualFold(v, name)
+	})
+}
+
+// 编码在优先列表中的位置，不在列表中的排在最后
+func (p Policy) rank(name string) int {
+	i := slices.IndexFunc(p.Prefer, func(v string) bool {
+		return strings.EqualFold(v, name)
+	})
+	if i < 0 {
+		return len(p.Prefer)
+	}
+	return i
+}
+
+func (p Policy) bitrate(kind string) uint64 {
+	switch kind {
+	case KindAudio:
+		return p.AudioBitrate
+	case KindVideo:
+		return p.VideoBitrate
+	}
+	return 0
+}
+
+// Apply 解析 SDP 并按策略改写，返回改写后的 SDP、媒体信息和是否改写
+// 包含不允许的媒体类型或没有可用的编码时返回错误
+// 没有策略时 SDP 无法解析不算错误，只是不记录媒体信息
+func (p Policy) Apply(raw string) (string, *Description, bool, error) {
+	var s sdp.SessionDescription
+	if err := s.UnmarshalString(raw); err != nil {
+		if p.Empty() {
+			return raw, nil, false, nil
+		}
+		return "", nil, false, msg.NewError(msg.ErrCodeInvalidParam, "sdp格式错误 %v", err)
+	}
+
+	desc := &Description{Media: make([]Section, 0, len(s.MediaDescriptions))}
+	changed := false
+	for _, md := range s.MediaDescriptions {
+		section, c, err := p.apply(md)
+		if err != nil {
+			return "", nil, false, err
+		}
+		changed = changed || c
+		desc.Media = append(desc.Media, section)
+	}
+
+	if !changed {
+		return raw, desc, false, nil
+	}
+	b, err := s.Marshal()
+	if err != nil {
+		return "", nil, false, msg.NewError(msg.ErrCodeInternal, "%v", err)
+	}
+	return string(b), desc, true, nil
+}
+
+// 处理一个 m= 段
+func (p Policy) apply(md *sdp.MediaDescription) (Section, bool, error) {
+	section := Section{
+		Kind:      md.MediaName.Media,
+		Direction: direction(md),
+		Rejected:  md.MediaName.Port.Value == 0,
+	}
+	section.Mid, _ = md.Attribute("mid")
+
+	changed := false
+	if !section.Rejected {
+		if len(p.Kinds) > 0 && !contains(p.Kinds, section.Kind) {
+			return section, false, msg.NewError(msg.ErrCodeForbidden, "房间不允许%s媒体", section.Kind)
+		}
+		if section.Kind == KindAudio || section.Kind == KindVideo {
+			c, err := p.applyCodecs(md)
+			if err != nil {
+				return section, false, err
+			}
+			changed = c
+			if limit := p.bitrate(section.Kind); limit > 0 {
+				changed = limitBitrate(md, limit) || changed
+			}
+		}
+	}
+
+	codecs := codecsOf(md)
+	for _, pt := range md.MediaName.Formats {
+		if name, ok := codecs[pt]; ok && name != codecRtx && !slices.Contains(section.Codecs, name) {
+			section.Codecs = append(section.Codecs, name)
+		}
+	}
+	for _, b := range md.Bandwidth {
+		if b.Type == bandwidthAs {
+			section.Bitrate = b.Bandwidth
+		}
+	}
+
+	return section, changed, nil
+}
+
+// 移除不允许的编码并按优先顺序排列
+func (p Policy) applyCodecs(md *sdp.MediaDescription) (bool, error) {
+	if len(p.Codecs) == 0 && len(p.Prefer) == 0 {
+		return false, nil
+	}
+
+	codecs := codecsOf(md)
+	apt := aptOf(md)
+
+	formats := md.MediaName.Formats
+	if len(p.Codecs) > 0 {
+		allowed := func(pt string) bool {
+			name, ok := codecs[pt]
+			//没有 rtpmap 的静态编码按编号处理
+			return ok && contains(p.Codecs, name) || !ok && contains(p.Codecs, pt)
+		}
+		kept := make([]string, 0, len(formats))
+		for _, pt := range formats {
+			if allowed(pt) {
+				kept = append(kept, pt)
+			}
+		}
+		if len(kept) == 0 {
+			return false, msg.NewError(msg.ErrCodeForbidden, "%s没有允许的编码", md.MediaName.Media)
+		}
+		for _, pt := range formats {
+			if codecs[pt] == codecRtx && slices.Contains(kept, apt[pt]) && !slices.Contains(kept, pt) {
+				kept = append(kept, pt)
+			}
+		}
+		formats = kept
+	}
+
+	if len(p.Prefer) > 0 {
+		formats = slices.Clone(formats)
+		slices.SortStableFunc(formats, func(a string, b string) int {
+			return p.rank(codecs[a]) - p.rank(codecs[b])
+		})
+	}
+
+	if slices.Equal(formats, md.MediaName.Formats) {
+		return false, nil
+	}
+
+	//移除被删除编码的属性
+	removed := make(map[string]bool)
+	for _, pt := range md.MediaName.Formats {
+		if !slices.Contains(formats, pt) {
+			removed[pt] = true
+		}
+	}
+	md.Attributes = slices.DeleteFunc(md.Attributes, func(a sdp.Attribute) bool {
+		switch a.Key {
+		case "rtpmap", "fmtp", "rtcp-fb":
+			pt, _, _ := strings.Cut(a.Value, " ")
+			return removed[pt]
+		}
+		return false
+	})
+	md.MediaName.Formats = formats
+	return true, nil
+}
+
+// 设置 b=AS 和 b=TIAS，已有更小的限制时保留
+func limitBitrate(md *sdp.MediaDescription, limit uint64) bool {
+	want := map[string]uint64{
+		bandwidthAs:   limit,
+		bandwidthTias: limit * 1000,
+	}
+
+	changed := false
+	for i, b := range md.Bandwidth {
+		w, ok := want[b.Type]
+		if !ok || b.Experimental {
+			continue
+		}
+		if b.Bandwidth > w {
+			md.Bandwidth[i].Bandwidth = w
+			changed = true
+		}
+		delete(want, b.Type)
+	}
+	for _, t := range []string{bandwidthAs, bandwidthTias} {
+		if w, ok := want[t]; ok {
+			md.Bandwidth = append(md.Bandwidth, sdp.Bandwidth{Type: t, Bandwidth: w})
+			changed = true
+		}
+	}
+	return changed
+}
+
+// payload type 到编码名
+func codecsOf(md *sdp.MediaDescription) map[string]string {
+	codecs := make(map[string]string)
+	for _, a := range md.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+		//96 VP8/90000
+		pt, rest, ok := strings.Cut(a.Value, " ")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, "/")
+		codecs[pt] = name
+	}
+	return codecs
+}
+
+// rtx 的 payload type 到原编码的 payload type
+func aptOf(md *sdp.MediaDescription) map[string]string {
+	apt := make(map[string]string)
+	for _, a := range md.Attributes {
+		if a.Key != "fmtp" {
+			continue
+		}
+		//97 apt=96
+		pt, params, ok := strings.Cut(a.Value, " ")
+		if !ok {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "apt="); ok {
+				if _, err := strconv.Atoi(v); err == nil {
+					apt[pt] = v
+				}
+			}
+		}
+	}
+	return apt
+}
+
+func direction(md *sdp.MediaDescription) string {
+	for _, a := range md.Attributes {
+		switch a.Key {
+		case "sendrecv", "sendonly", "recvonly", "inactive":
+			return a.Key
+		}
+	}
+	return "sendrecv"
+}
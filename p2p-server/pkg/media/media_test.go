@@ -0,0 +1,188 @@
+package media
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"webrtc/p2p-server/pkg/msg"
+)
+
+const testSdp = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=sendrecv\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:2000\r\n" +
+	"a=mid:1\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtcp-fb:96 nack\r\n" +
+	"a=rtpmap:97 rtx/90000\r\n" +
+	"a=fmtp:97 apt=96\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"a=rtcp-fb:102 nack\r\n" +
+	"a=fmtp:102 profile-level-id=42e01f\r\n" +
+	"a=rtpmap:103 rtx/90000\r\n" +
+	"a=fmtp:103 apt=102\r\n"
+
+func errorCode(err error) int {
+	var e *msg.ErrorMsg
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return 0
+}
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  Policy
+		code    int
+		changed bool
+		//期望的 m= 段 payload type
+		audio []string
+		video []string
+	}{
+		{"没有策略", Policy{}, 0, false, []string{"111", "0"}, []string{"96", "97", "102", "103"}},
+		{"允许的媒体类型", Policy{Kinds: []string{"audio", "video"}}, 0, false, []string{"111", "0"}, []string{"96", "97", "102", "103"}},
+		{"不允许视频", Policy{Kinds: []string{"audio"}}, msg.ErrCodeForbidden, false, nil, nil},
+		{"过滤编码保留rtx", Policy{Codecs: []string{"opus", "h264"}}, 0, true, []string{"111"}, []string{"102", "103"}},
+		{"静态编码按编号", Policy{Codecs: []string{"0", "vp8"}}, 0, true, []string{"0"}, []string{"96", "97"}},
+		{"没有允许的编码", Policy{Codecs: []string{"opus"}}, msg.ErrCodeForbidden, false, nil, nil},
+		{"优先顺序", Policy{Prefer: []string{"H264"}}, 0, true, []string{"111", "0"}, []string{"102", "96", "97", "103"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, desc, changed, err := c.policy.Apply(testSdp)
+			if code := errorCode(err); code != c.code {
+				t.Fatalf("错误码 %d，期望 %d %v", code, c.code, err)
+			}
+			if err != nil {
+				return
+			}
+			if changed != c.changed || (!changed && out != testSdp) {
+				t.Fatalf("是否改写 %v", changed)
+			}
+			if len(desc.Media) != 2 {
+				t.Fatalf("媒体信息 %+v", desc)
+			}
+			for i, want := range [][]string{c.audio, c.video} {
+				if got := formats(t, out, i); !slices.Equal(got, want) {
+					t.Fatalf("第%d个m=段的编码 %v，期望 %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// 第 i 个 m= 行的 payload type
+func formats(t *testing.T, raw string, i int) []string {
+	t.Helper()
+	var lines []string
+	for _, line := range strings.Split(raw, "\r\n") {
+		if strings.HasPrefix(line, "m=") {
+			lines = append(lines, line)
+		}
+	}
+	if i >= len(lines) {
+		t.Fatalf("没有第%d个m=段", i)
+	}
+	return strings.Fields(lines[i])[3:]
+}
+
+// 被移除编码的 rtpmap/fmtp/rtcp-fb 一起移除
+func TestApplyRemovesAttributes(t *testing.T) {
+	out, desc, _, err := Policy{Codecs: []string{"opus", "vp8"}}.Apply(testSdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, attr := range []string{"a=rtpmap:102", "a=rtcp-fb:102", "a=fmtp:102", "a=rtpmap:103", "a=fmtp:103"} {
+		if strings.Contains(out, attr) {
+			t.Fatalf("没有移除 %s", attr)
+		}
+	}
+	if !strings.Contains(out, "a=rtcp-fb:96 nack") {
+		t.Fatal("移除了保留编码的属性")
+	}
+
+	video := desc.Media[1]
+	if video.Mid != "1" || video.Kind != KindVideo || video.Direction != "sendonly" || !slices.Equal(video.Codecs, []string{"VP8"}) {
+		t.Fatalf("视频媒体信息 %+v", video)
+	}
+}
+
+func TestApplyBitrate(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit uint64
+		as    string
+		tias  string
+	}{
+		//已有 b=AS:2000，更小的限制覆盖
+		{"覆盖更大的限制", 500, "b=AS:500", "b=TIAS:500000"},
+		//已有更小的限制时保留
+		{"保留更小的限制", 3000, "b=AS:2000", "b=TIAS:3000000"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, desc, changed, err := Policy{VideoBitrate: c.limit, AudioBitrate: 32}.Apply(testSdp)
+			if err != nil || !changed {
+				t.Fatalf("改写返回 %v %v", changed, err)
+			}
+			_, video, _ := strings.Cut(out, "m=video")
+			audio, _, _ := strings.Cut(out, "m=video")
+			if !strings.Contains(video, c.as+"\r\n") || !strings.Contains(video, c.tias+"\r\n") {
+				t.Fatalf("视频码率限制\n%s", video)
+			}
+			if !strings.Contains(audio, "b=AS:32\r\n") || !strings.Contains(audio, "b=TIAS:32000\r\n") {
+				t.Fatalf("音频码率限制\n%s", audio)
+			}
+			if desc.Media[0].Bitrate != 32 {
+				t.Fatalf("音频码率 %d", desc.Media[0].Bitrate)
+			}
+		})
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	out, desc, changed, err := Policy{}.Apply("not sdp")
+	if err != nil || changed || desc != nil || out != "not sdp" {
+		t.Fatalf("没有策略时返回 %q %v %v %v", out, desc, changed, err)
+	}
+	if _, _, _, err := (Policy{Kinds: []string{"audio"}}).Apply("not sdp"); errorCode(err) != msg.ErrCodeInvalidParam {
+		t.Fatalf("有策略时返回 %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	server := Policy{Kinds: []string{"audio", "video"}, Codecs: []string{"opus", "vp8"}, Prefer: []string{"vp8"}, VideoBitrate: 1000}
+	cases := []struct {
+		name string
+		room Policy
+		want Policy
+	}{
+		{"房间没有策略", Policy{}, server},
+		{"取交集和较小码率", Policy{Kinds: []string{"audio"}, Prefer: []string{"opus"}, AudioBitrate: 64, VideoBitrate: 2000},
+			Policy{Kinds: []string{"audio"}, Codecs: []string{"opus", "vp8"}, Prefer: []string{"opus"}, AudioBitrate: 64, VideoBitrate: 1000}},
+		//交集为空时不允许任何编码
+		{"交集为空", Policy{Codecs: []string{"h264"}},
+			Policy{Kinds: []string{"audio", "video"}, Codecs: []string{""}, Prefer: []string{"vp8"}, VideoBitrate: 1000}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := server.Merge(c.room)
+			if !slices.Equal(got.Kinds, c.want.Kinds) || !slices.Equal(got.Codecs, c.want.Codecs) || !slices.Equal(got.Prefer, c.want.Prefer) ||
+				got.AudioBitrate != c.want.AudioBitrate || got.VideoBitrate != c.want.VideoBitrate {
+				t.Fatalf("合并结果 %+v，期望 %+v", got, c.want)
+			}
+		})
+	}
+}
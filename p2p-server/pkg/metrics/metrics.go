@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "p2p_server"
+
+var (
+	// Connections 当前 WebSocket 连接数
+	Connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_connections",
+		Help:      "Active WebSocket connections.",
+	})
+
+	// MessagesIn 收到的消息数
+	MessagesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_in_total",
+		Help:      "Signaling messages received by type.",
+	}, []string{"type"})
+
+	// MessagesOut 写出到连接的消息数
+	MessagesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_out_total",
+		Help:      "Signaling messages written to the connection by type.",
+	}, []string{"type"})
+
+	// MessageErrors 处理失败的消息数
+	MessageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "message_errors_total",
+		Help:      "Signaling messages answered with an error frame, by request type and error code.",
+	}, []string{"type", "code"})
+
+	// RelayFailures 转发失败数
+	RelayFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_failures_total",
+		Help:      "Relayed offer/answer/candidate messages that could not be delivered.",
+	}, []string{"type"})
+
+	// CandidatesFiltered 按过滤规则丢弃的 candidate 数
+	CandidatesFiltered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "candidates_filtered_total",
+		Help:      "Relayed ICE candidates dropped by the candidate filter policy.",
+	})
+
+	// HeartbeatErrors 心跳发送失败数
+	HeartbeatErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_errors_total",
+		Help:      "Heartbeat messages that failed to send.",
+	})
+
+	// QueueDepth 所有连接发送队列中的消息总数
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_send_queue_depth",
+		Help:      "Messages waiting in outbound queues across all connections.",
+	})
+
+	// QueueDropped 发送队列丢弃的消息数
+	QueueDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_send_queue_dropped_total",
+		Help:      "Messages dropped because an outbound queue was full.",
+	})
+)
+
+// RegisterRooms 注册房间指标，usersPerRoom 在采集时返回每个房间的用户数
+func RegisterRooms(usersPerRoom func() []int) {
+	prometheus.MustRegister(&roomCollector{usersPerRoom: usersPerRoom})
+}
+
+var (
+	roomsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "rooms"),
+		"Active rooms.", nil, nil)
+	usersPerRoomDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "users_per_room"),
+		"Distribution of users per room.", nil, nil)
+	usersPerRoomBuckets = []float64{1, 2, 3, 4, 6, 8, 12, 16, 32, 64}
+)
+
+// 采集时从房间快照生成房间数和每房间用户数直方图
+type roomCollector struct {
+	usersPerRoom func() []int
+}
+
+func (rc *roomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsDesc
+	ch <- usersPerRoomDesc
+}
+
+func (rc *roomCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := rc.usersPerRoom()
+
+	buckets := make(map[float64]uint64, len(usersPerRoomBuckets))
+	var sum float64
+	for _, n := range counts {
+		sum += float64(n)
+		for _, b := range usersPerRoomBuckets {
+			if float64(n) <= b {
+				buckets[b]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(len(counts)))
+	ch <- prometheus.MustNewConstHistogram(usersPerRoomDesc, uint64(len(counts)), sum, buckets)
+}
+
+// Register 注册 /metrics 路由
+func Register(r gin.IRouter, path string) {
+	if len(path) == 0 {
+		path = "/metrics"
+	}
+	r.GET(path, gin.WrapH(promhttp.Handler()))
+}
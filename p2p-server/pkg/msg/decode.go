@@ -0,0 +1,43 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Validator 请求数据校验
+type Validator interface {
+	Validate() error
+}
+
+// Request 客户端发来的原始请求，data 延迟解析
+type Request struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	//原始消息
+	Raw []byte `json:"-"`
+}
+
+// Decode 解析请求外层结构
+func Decode(message []byte) (*Request, error) {
+	var req Request
+	if err := json.Unmarshal(message, &req); err != nil {
+		return nil, NewError(ErrCodeBadRequest, "消息格式错误: %v", err)
+	}
+	if len(req.Type) == 0 {
+		return nil, NewError(ErrCodeBadRequest, "没有type")
+	}
+	if len(req.Data) == 0 || bytes.Equal(req.Data, []byte("null")) {
+		return nil, NewError(ErrCodeBadRequest, "没有data")
+	}
+	req.Raw = message
+	return &req, nil
+}
+
+// Bind 解析 data 到 v 并校验
+func (r *Request) Bind(v Validator) error {
+	if err := json.Unmarshal(r.Data, v); err != nil {
+		return NewError(ErrCodeBadRequest, "data格式错误: %v", err)
+	}
+	return v.Validate()
+}
@@ -0,0 +1,67 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	Error = "error" //错误回复
+)
+
+// 错误码
+const (
+	ErrCodeBadRequest   = 400 //请求格式错误
+	ErrCodeUnauthorized = 401 //未认证
+	ErrCodeForbidden    = 403 //无权限
+	ErrCodeNotFound     = 404 //目标不存在
+	ErrCodeUnknownType  = 405 //未知的消息类型
+	ErrCodeConflict     = 409 //状态冲突
+	ErrCodeInvalidParam = 422 //参数校验失败
+	ErrCodeRoomLocked   = 423 //房间已锁定
+	ErrCodeRateLimited  = 429 //请求过于频繁
+	ErrCodeRoomFull     = 430 //房间人数已满，不是标准 HTTP 状态码
+	ErrCodeInternal     = 500 //服务器内部错误
+)
+
+// ErrorMsg 请求处理失败时返回给客户端的错误
+type ErrorMsg struct {
+	Code    int
+	Message string
+}
+
+func (e *ErrorMsg) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// NewError 创建错误
+func NewError(code int, format string, args ...any) *ErrorMsg {
+	return &ErrorMsg{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// ErrorData 错误回复的数据
+type ErrorData struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Request string `json:"request"` //原始请求类型
+}
+
+// NewErrorReply 根据错误生成错误回复，非 ErrorMsg 的错误统一视为内部错误
+func NewErrorReply(request string, err error) Msg {
+	var e *ErrorMsg
+	if !errors.As(err, &e) {
+		e = NewError(ErrCodeInternal, "%v", err)
+	}
+
+	return Msg{
+		Type: Error,
+		Data: ErrorData{
+			Code:    e.Code,
+			Message: e.Message,
+			Request: request,
+		},
+	}
+}
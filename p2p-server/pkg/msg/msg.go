@@ -1,6 +1,29 @@
 package msg
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 type Msg struct {
 	Type string `json:"type"`
 	Data any    `json:"data"`
 }
+
+// PeekType 取出消息的 type，解析失败返回空
+// 服务端生成的消息 type 都在最前面，优先直接截取
+func PeekType(data []byte) string {
+	if rest, ok := bytes.CutPrefix(data, []byte(`{"type":"`)); ok {
+		if i := bytes.IndexByte(rest, '"'); i >= 0 {
+			return string(rest[:i])
+		}
+	}
+
+	var m struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ""
+	}
+	return m.Type
+}
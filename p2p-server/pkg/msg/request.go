@@ -0,0 +1,464 @@
+package msg
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// Description SDP信息
+type Description struct {
+	Sdp  string `json:"sdp"`
+	Type string `json:"type"`
+}
+
+// IceCandidate Candidate数据
+type IceCandidate struct {
+	Candidate     string  `json:"candidate"`
+	SdpMid        *string `json:"sdpMid,omitempty"`
+	SdpMLineIndex *uint16 `json:"sdpMLineIndex,omitempty"`
+}
+
+// JoinRoom 加入房间
+type JoinRoom struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	RoomId string `json:"room_id"`
+	//断线重连凭证
+	ResumeToken string `json:"resume_token,omitempty"`
+	//以观众身份加入时为 viewer
+	Role string `json:"role,omitempty"`
+	//房间密码
+	Password string `json:"password,omitempty"`
+	//邀请 token
+	InviteToken string `json:"invite_token,omitempty"`
+}
+
+func (r *JoinRoom) Validate() error {
+	if len(r.Id) == 0 {
+		return NewError(ErrCodeInvalidParam, "id不能为空")
+	}
+	if len(r.Name) == 0 {
+		return NewError(ErrCodeInvalidParam, "name不能为空")
+	}
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if len(r.Role) > 0 && r.Role != "viewer" {
+		return NewError(ErrCodeInvalidParam, "role只能为viewer")
+	}
+	return nil
+}
+
+// Relay offer/answer/candidate 的公共字段
+type Relay struct {
+	To        string `json:"to"`
+	From      string `json:"from"`
+	SessionId string `json:"session_id"`
+	RoomId    string `json:"room_id"`
+	//媒体类型
+	Type string `json:"type,omitempty"`
+}
+
+func (r *Relay) Validate() error {
+	if len(r.To) == 0 {
+		return NewError(ErrCodeInvalidParam, "to不能为空")
+	}
+	if len(r.From) == 0 {
+		return NewError(ErrCodeInvalidParam, "from不能为空")
+	}
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// Offer 提议
+type Offer struct {
+	Relay
+	Description *Description `json:"description"`
+}
+
+func (r *Offer) Validate() error {
+	if err := r.Relay.Validate(); err != nil {
+		return err
+	}
+	if r.Description == nil || len(r.Description.Sdp) == 0 {
+		return NewError(ErrCodeInvalidParam, "description不能为空")
+	}
+	return nil
+}
+
+// Renegotiate 通话中重新协商，如开始共享屏幕、ICE 重启，对方用 answer 回复
+type Renegotiate struct {
+	Offer
+	//重新协商的原因，如 screenShare、iceRestart
+	Reason string `json:"reason,omitempty"`
+}
+
+func (r *Renegotiate) Validate() error {
+	if err := r.Offer.Validate(); err != nil {
+		return err
+	}
+	if len(r.SessionId) == 0 {
+		return NewError(ErrCodeInvalidParam, "session_id不能为空")
+	}
+	return nil
+}
+
+// Answer 应答
+type Answer struct {
+	Relay
+	Description *Description `json:"description"`
+}
+
+func (r *Answer) Validate() error {
+	if err := r.Relay.Validate(); err != nil {
+		return err
+	}
+	if r.Description == nil || len(r.Description.Sdp) == 0 {
+		return NewError(ErrCodeInvalidParam, "description不能为空")
+	}
+	return nil
+}
+
+// Candidate ICE候选
+type Candidate struct {
+	Relay
+	Candidate *IceCandidate `json:"candidate"`
+}
+
+func (r *Candidate) Validate() error {
+	if err := r.Relay.Validate(); err != nil {
+		return err
+	}
+	if r.Candidate == nil {
+		return NewError(ErrCodeInvalidParam, "candidate不能为空")
+	}
+	return nil
+}
+
+// HangUp 挂断
+type HangUp struct {
+	SessionId string `json:"session_id"`
+	From      string `json:"from"`
+	RoomId    string `json:"room_id"`
+}
+
+func (r *HangUp) Validate() error {
+	if len(r.SessionId) == 0 {
+		return NewError(ErrCodeInvalidParam, "session_id不能为空")
+	}
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// Invite 发起呼叫
+type Invite struct {
+	To     string `json:"to"`
+	RoomId string `json:"room_id"`
+	//媒体类型
+	Type string `json:"type"`
+}
+
+func (r *Invite) Validate() error {
+	if len(r.To) == 0 {
+		return NewError(ErrCodeInvalidParam, "to不能为空")
+	}
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// SessionReply 被叫方对呼叫的回复 ringing/accept/reject/busy
+type SessionReply struct {
+	SessionId string `json:"session_id"`
+	RoomId    string `json:"room_id"`
+}
+
+func (r *SessionReply) Validate() error {
+	if len(r.SessionId) == 0 {
+		return NewError(ErrCodeInvalidParam, "session_id不能为空")
+	}
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// Moderation 房间管理命令 kick/muteRequest/transferOwner/setRole
+type Moderation struct {
+	RoomId string `json:"room_id"`
+	//目标用户
+	Target string `json:"target"`
+	//muteRequest 的媒体类型 audio|video
+	Kind string `json:"kind,omitempty"`
+	//setRole 的角色
+	Role string `json:"role,omitempty"`
+}
+
+func (r *Moderation) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if len(r.Target) == 0 {
+		return NewError(ErrCodeInvalidParam, "target不能为空")
+	}
+	return nil
+}
+
+// LockRoom 锁定/解锁房间
+type LockRoom struct {
+	RoomId string `json:"room_id"`
+	Locked bool   `json:"locked"`
+}
+
+func (r *LockRoom) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// CreateRoom 创建房间，创建者以房主身份加入
+type CreateRoom struct {
+	//为空时由服务端生成
+	RoomId string `json:"room_id"`
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	//房间密码，为空表示不需要密码
+	Password string `json:"password,omitempty"`
+	//只能通过邀请加入
+	InviteOnly bool `json:"invite_only,omitempty"`
+	//p2p 或 sfu，默认 p2p
+	Mode string `json:"mode,omitempty"`
+	//ICE 传输策略 all 或 relay，为空时使用服务端配置
+	IcePolicy string `json:"ice_policy,omitempty"`
+	//转发 candidate 时的过滤规则，与服务端配置的规则合并
+	IceFilter *IceFilter `json:"ice_filter,omitempty"`
+	//媒体策略，与服务端配置的策略合并
+	Media *MediaPolicy `json:"media,omitempty"`
+}
+
+// MediaPolicy 房间的媒体策略
+type MediaPolicy struct {
+	//允许的媒体类型 audio|video|application
+	Kinds []string `json:"kinds,omitempty"`
+	//允许的编码
+	Codecs []string `json:"codecs,omitempty"`
+	//编码优先顺序
+	Prefer []string `json:"prefer,omitempty"`
+	//音频码率上限(kbps)
+	AudioBitrate uint64 `json:"audio_bitrate,omitempty"`
+	//视频码率上限(kbps)
+	VideoBitrate uint64 `json:"video_bitrate,omitempty"`
+}
+
+// IceFilter candidate 过滤规则
+type IceFilter struct {
+	//移除 host candidate
+	StripHost bool `json:"strip_host,omitempty"`
+	//移除 srflx/prflx candidate
+	StripSrflx bool `json:"strip_srflx,omitempty"`
+	//只转发 relay candidate
+	RelayOnly bool `json:"relay_only,omitempty"`
+	//移除这些网段的 candidate
+	BlockCidrs []string `json:"block_cidrs,omitempty"`
+}
+
+func (r *CreateRoom) Validate() error {
+	if len(r.Id) == 0 {
+		return NewError(ErrCodeInvalidParam, "id不能为空")
+	}
+	if len(r.Name) == 0 {
+		return NewError(ErrCodeInvalidParam, "name不能为空")
+	}
+	if len(r.Mode) > 0 && r.Mode != "p2p" && r.Mode != "sfu" {
+		return NewError(ErrCodeInvalidParam, "mode只能为p2p或sfu")
+	}
+	if len(r.IcePolicy) > 0 && r.IcePolicy != "all" && r.IcePolicy != "relay" {
+		return NewError(ErrCodeInvalidParam, "ice_policy只能为all或relay")
+	}
+	if r.IceFilter != nil {
+		for _, cidr := range r.IceFilter.BlockCidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return NewError(ErrCodeInvalidParam, "block_cidrs格式错误 %s", cidr)
+			}
+		}
+	}
+	if r.Media != nil {
+		for _, kind := range r.Media.Kinds {
+			if kind != "audio" && kind != "video" && kind != "application" {
+				return NewError(ErrCodeInvalidParam, "kinds只能为audio、video或application")
+			}
+		}
+	}
+	return nil
+}
+
+// CreateInvite 生成房间邀请
+type CreateInvite struct {
+	RoomId string `json:"room_id"`
+	//加入后的角色，默认 participant
+	Role string `json:"role,omitempty"`
+	//有效期(秒)
+	Ttl int `json:"ttl,omitempty"`
+}
+
+func (r *CreateInvite) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if r.Ttl < 0 {
+		return NewError(ErrCodeInvalidParam, "ttl不能小于0")
+	}
+	return nil
+}
+
+// Broadcast 转发给房间内其他所有用户
+type Broadcast struct {
+	RoomId string `json:"room_id"`
+	From   string `json:"from"`
+	//转发的内容，服务端不解析
+	Data json.RawMessage `json:"data"`
+}
+
+func (r *Broadcast) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if len(r.From) == 0 {
+		return NewError(ErrCodeInvalidParam, "from不能为空")
+	}
+	if len(r.Data) == 0 {
+		return NewError(ErrCodeInvalidParam, "data不能为空")
+	}
+	return nil
+}
+
+// StartGroupCall 发起多人通话
+type StartGroupCall struct {
+	RoomId string `json:"room_id"`
+	//媒体类型
+	Type string `json:"type,omitempty"`
+	//参与的用户，为空表示房间内所有非观众用户
+	Users []string `json:"users,omitempty"`
+}
+
+func (r *StartGroupCall) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// PairConnected 客户端上报与对方的连接已建立
+type PairConnected struct {
+	RoomId    string `json:"room_id"`
+	SessionId string `json:"session_id"`
+}
+
+func (r *PairConnected) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if len(r.SessionId) == 0 {
+		return NewError(ErrCodeInvalidParam, "session_id不能为空")
+	}
+	return nil
+}
+
+// Publish SFU 模式下发布轨道，description 为发布连接的 offer
+type Publish struct {
+	RoomId      string       `json:"room_id"`
+	Description *Description `json:"description"`
+}
+
+func (r *Publish) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if r.Description == nil || len(r.Description.Sdp) == 0 || r.Description.Type != "offer" {
+		return NewError(ErrCodeInvalidParam, "description必须是offer")
+	}
+	return nil
+}
+
+// Subscribe SFU 模式下订阅轨道
+type Subscribe struct {
+	RoomId string `json:"room_id"`
+	//订阅的发布者，为空表示所有人
+	Publishers []string `json:"publishers,omitempty"`
+}
+
+func (r *Subscribe) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// Unpublish SFU 模式下取消发布
+type Unpublish struct {
+	RoomId string `json:"room_id"`
+	//取消发布的轨道Id，为空表示所有轨道
+	Tracks []string `json:"tracks,omitempty"`
+}
+
+func (r *Unpublish) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
+
+// SfuAnswer 订阅连接的 answer
+type SfuAnswer struct {
+	RoomId      string       `json:"room_id"`
+	Description *Description `json:"description"`
+}
+
+func (r *SfuAnswer) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if r.Description == nil || len(r.Description.Sdp) == 0 || r.Description.Type != "answer" {
+		return NewError(ErrCodeInvalidParam, "description必须是answer")
+	}
+	return nil
+}
+
+// SfuCandidate 发给 SFU 的 candidate
+type SfuCandidate struct {
+	RoomId string `json:"room_id"`
+	//publisher 或 subscriber
+	Target    string        `json:"target"`
+	Candidate *IceCandidate `json:"candidate"`
+}
+
+func (r *SfuCandidate) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	if r.Target != "publisher" && r.Target != "subscriber" {
+		return NewError(ErrCodeInvalidParam, "target只能为publisher或subscriber")
+	}
+	if r.Candidate == nil {
+		return NewError(ErrCodeInvalidParam, "candidate不能为空")
+	}
+	return nil
+}
+
+// Recording 开始/停止录制
+type Recording struct {
+	RoomId string `json:"room_id"`
+}
+
+func (r *Recording) Validate() error {
+	if len(r.RoomId) == 0 {
+		return NewError(ErrCodeInvalidParam, "room_id不能为空")
+	}
+	return nil
+}
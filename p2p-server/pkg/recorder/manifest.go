@@ -0,0 +1,58 @@
+package recorder
+
+import "time"
+
+// Manifest 一次录制的描述文件
+type Manifest struct {
+	RecordingId string `json:"recording_id"`
+	RoomId      string `json:"room_id"`
+	//发起录制的用户
+	StartedBy    string         `json:"started_by"`
+	StartedAt    time.Time      `json:"started_at"`
+	StoppedAt    time.Time      `json:"stopped_at"`
+	Participants []*Participant `json:"participants"`
+	Files        []*FileInfo    `json:"files"`
+}
+
+// Participant 录制期间在房间内的用户
+type Participant struct {
+	UserId   string     `json:"user_id"`
+	Name     string     `json:"name"`
+	JoinedAt time.Time  `json:"joined_at"`
+	LeftAt   *time.Time `json:"left_at,omitempty"`
+}
+
+// FileInfo 一个轨道的录制文件
+type FileInfo struct {
+	UserId string `json:"user_id"`
+	//audio 或 video
+	Kind      string    `json:"kind"`
+	Codec     string    `json:"codec"`
+	Path      string    `json:"path"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+}
+
+// 记录参与者加入，离开后重新加入时清除离开时间
+func (m *Manifest) join(userId string, name string) {
+	for _, p := range m.Participants {
+		if p.UserId == userId {
+			p.LeftAt = nil
+			return
+		}
+	}
+	m.Participants = append(m.Participants, &Participant{
+		UserId:   userId,
+		Name:     name,
+		JoinedAt: time.Now(),
+	})
+}
+
+func (m *Manifest) leave(userId string) {
+	for _, p := range m.Participants {
+		if p.UserId == userId && p.LeftAt == nil {
+			now := time.Now()
+			p.LeftAt = &now
+		}
+	}
+}
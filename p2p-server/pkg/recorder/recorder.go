@@ -0,0 +1,131 @@
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/serverpeer"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ErrClosed 录制已停止
+var ErrClosed = errors.New("recorder closed")
+
+// Config 录制设置
+type Config struct {
+	//录制文件目录
+	Dir string
+	//STUN/TURN 服务器
+	ICEServers []webrtc.ICEServer
+	//录制的媒体类型，为空表示音频和视频
+	Kinds []webrtc.RTPCodecType
+}
+
+// Recorder 以只接收媒体的服务端用户加入房间，录制每个参与者的音视频
+// 实现房间的 Conn 接口，房间转发给录制端的消息由服务端用户处理
+type Recorder struct {
+	*serverpeer.Peer
+	//录制Id
+	Id string
+	//本次录制的目录
+	dir string
+
+	mu sync.Mutex
+	//文件序号
+	seq      int
+	manifest Manifest
+	closed   bool
+	//未写完的文件
+	writers sync.WaitGroup
+}
+
+// New 创建录制，startedBy 为发起录制的用户
+func New(roomId string, startedBy string, api *webrtc.API, cfg Config, relay serverpeer.Relay, s *sfu.SFU) (*Recorder, error) {
+	id := utils.NewId()
+	dir := filepath.Join(cfg.Dir, safeName(roomId), id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		Id:  id,
+		dir: dir,
+		manifest: Manifest{
+			RecordingId:  id,
+			RoomId:       roomId,
+			StartedBy:    startedBy,
+			StartedAt:    time.Now(),
+			Participants: []*Participant{},
+			Files:        []*FileInfo{},
+		},
+	}
+	r.Peer = serverpeer.New(roomId, "recorder-"+id[:8], api, serverpeer.Config{
+		ICEServers: cfg.ICEServers,
+		Kinds:      cfg.Kinds,
+	}, relay, s, serverpeer.Handlers{
+		OnTrack: r.record,
+		OnJoin:  r.join,
+		OnLeave: r.leave,
+	})
+	return r, nil
+}
+
+// Stop 停止录制，等待文件写完后生成 manifest，返回 manifest 路径
+func (r *Recorder) Stop() (string, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return "", ErrClosed
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	r.Peer.Close()
+	r.writers.Wait()
+
+	r.mu.Lock()
+	r.manifest.StoppedAt = time.Now()
+	data, err := json.MarshalIndent(&r.manifest, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(r.dir, "manifest.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// 参与者加入
+func (r *Recorder) join(userId string, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.manifest.join(userId, name)
+	}
+}
+
+// 参与者离开
+func (r *Recorder) leave(userId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifest.leave(userId)
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// 用户Id和房间Id用作文件名前去掉特殊字符
+func safeName(s string) string {
+	return unsafeChars.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,118 @@
+package recorder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// 请求关键帧的间隔
+const keyframeInterval = 3 * time.Second
+
+type mediaWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// 按编码创建文件，音频 Ogg/Opus，视频 IVF(VP8/VP9) 或 Annex-B H.264
+func newWriter(path string, codec webrtc.RTPCodecParameters) (mediaWriter, string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		path += ".ogg"
+		w, err := oggwriter.New(path, codec.ClockRate, codec.Channels)
+		return w, path, err
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		path += ".ivf"
+		w, err := ivfwriter.New(path, ivfwriter.WithCodec(codec.MimeType))
+		return w, path, err
+	case strings.ToLower(webrtc.MimeTypeH264):
+		path += ".h264"
+		w, err := h264writer.New(path)
+		return w, path, err
+	}
+	return nil, "", fmt.Errorf("不支持录制的编码 %s", codec.MimeType)
+}
+
+// 录制一个轨道直到轨道结束
+func (r *Recorder) record(userId string, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	codec := track.Codec()
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.seq++
+	name := fmt.Sprintf("%s-%s-%d", safeName(userId), track.Kind(), r.seq)
+	w, path, err := newWriter(filepath.Join(r.dir, name), codec)
+	if err != nil {
+		r.mu.Unlock()
+		logger.Log.Errorf("录制 [%s] 用户 [%s] 创建文件失败 %v", r.Id, userId, err)
+		return
+	}
+	file := &FileInfo{
+		UserId:    userId,
+		Kind:      track.Kind().String(),
+		Codec:     codec.MimeType,
+		Path:      path,
+		StartedAt: time.Now(),
+	}
+	r.manifest.Files = append(r.manifest.Files, file)
+	r.writers.Add(1)
+	r.mu.Unlock()
+
+	defer r.writers.Done()
+
+	logger.Log.Infof("录制 [%s] 用户 [%s] 开始录制 %s %s", r.Id, userId, file.Kind, path)
+
+	done := make(chan struct{})
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go requestKeyframes(pc, uint32(track.SSRC()), done)
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			break
+		}
+		if err := w.WriteRTP(packet); err != nil {
+			logger.Log.Errorf("录制 [%s] 用户 [%s] 写入失败 %v", r.Id, userId, err)
+			break
+		}
+	}
+	close(done)
+
+	if err := w.Close(); err != nil {
+		logger.Log.Errorf("录制 [%s] 用户 [%s] 关闭文件失败 %v", r.Id, userId, err)
+	}
+
+	r.mu.Lock()
+	file.EndedAt = time.Now()
+	r.mu.Unlock()
+}
+
+// 定时请求关键帧，保证文件可以从任意位置开始播放
+func requestKeyframes(pc *webrtc.PeerConnection, ssrc uint32, done chan struct{}) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package room
+
+import (
+	"crypto/subtle"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/ice"
+	"webrtc/p2p-server/pkg/media"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	CreateRoom   = "createRoom"   //创建房间
+	CreateInvite = "createInvite" //生成邀请
+
+	defaultInviteTtl = 24 * time.Hour
+)
+
+// RoomOptions 房间访问设置
+type RoomOptions struct {
+	//房间密码的 bcrypt 哈希，为空表示不需要密码
+	PasswordHash []byte
+	//只能通过邀请加入
+	InviteOnly bool
+	//房间变空后保留的时间，0表示立即关闭
+	KeepEmpty time.Duration
+	//房间模式 p2p|sfu
+	Mode string
+	//ICE 传输策略 all|relay，为空时使用服务端配置
+	IcePolicy string
+	//转发 candidate 时的过滤规则，与服务端配置的规则合并
+	IceFilter ice.Filter
+	//媒体策略，与服务端配置的策略合并
+	Media media.Policy
+}
+
+// HashPassword 生成房间密码哈希
+func HashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// 设置房间访问控制，只能在房间发布到 RoomManager 之前调用
+func (r *Room) configure(opts RoomOptions) {
+	r.opts = opts
+	r.media = r.media.Merge(opts.Media)
+}
+
+// 以下方法只能在房间协程中调用
+
+// 校验加入房间的凭证，有邀请时按邀请设置角色
+// 邀请必须由这个房间实例签发，房间关闭后重建的同Id房间不接受旧邀请
+func (r *Room) admit(user *User, password string, invite *auth.Invite) error {
+	if invite != nil {
+		if invite.RoomId != r.Id || subtle.ConstantTimeCompare([]byte(invite.Nonce), []byte(r.inviteNonce)) != 1 {
+			return msg.NewError(msg.ErrCodeUnauthorized, "邀请已失效")
+		}
+		if len(invite.Role) > 0 {
+			user.info.Role = invite.Role
+		}
+		return nil
+	}
+
+	if r.opts.InviteOnly {
+		return msg.NewError(msg.ErrCodeForbidden, "房间只能通过邀请加入")
+	}
+
+	if len(r.opts.PasswordHash) > 0 {
+		if len(password) == 0 {
+			return msg.NewError(msg.ErrCodeUnauthorized, "需要房间密码")
+		}
+		if bcrypt.CompareHashAndPassword(r.opts.PasswordHash, []byte(password)) != nil {
+			return msg.NewError(msg.ErrCodeUnauthorized, "房间密码错误")
+		}
+	}
+	return nil
+}
+
+// 生成邀请，只能邀请比自己角色低的用户
+func (r *Room) createInvite(from string, data *msg.CreateInvite, secret string, defaultTtl time.Duration) error {
+	actor, _, err := r.checkModerator(from, "", RoleModerator)
+	if err != nil {
+		return err
+	}
+
+	role := data.Role
+	if len(role) == 0 {
+		role = RoleParticipant
+	}
+	if rank, ok := roleRank[role]; !ok || rank >= roleRank[actor.info.Role] {
+		return msg.NewError(msg.ErrCodeForbidden, "不能邀请角色 [%s]", role)
+	}
+
+	ttl := time.Duration(data.Ttl) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTtl
+	}
+
+	invite := &auth.Invite{
+		RoomId: r.Id,
+		Role:   role,
+		Exp:    time.Now().Add(ttl).Unix(),
+		Nonce:  r.inviteNonce,
+	}
+	token, err := auth.SignInvite(secret, invite)
+	if err != nil {
+		return msg.NewError(msg.ErrCodeInternal, "%v", err)
+	}
+
+	return actor.conn.Send(utils.Marshal(msg.Msg{
+		Type: CreateInvite,
+		Data: map[string]any{
+			"room_id":    r.Id,
+			"role":       role,
+			"token":      token,
+			"expires_at": invite.Exp,
+		},
+	}))
+}
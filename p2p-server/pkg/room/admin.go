@@ -0,0 +1,231 @@
+package room
+
+import (
+	"errors"
+	"webrtc/p2p-server/pkg/media"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+	"webrtc/p2p-server/pkg/ws"
+)
+
+const (
+	RoomClosed    = "roomClosed"    //房间被关闭
+	SystemMessage = "systemMessage" //系统消息
+
+	//管理员操作时的操作者
+	adminId = "admin"
+)
+
+// RoomSummary 房间概要
+type RoomSummary struct {
+	RoomId       string `json:"room_id"`
+	UserCount    int    `json:"user_count"`
+	SessionCount int    `json:"session_count"`
+	Locked       bool   `json:"locked"`
+	InviteOnly   bool   `json:"invite_only"`
+	Password     bool   `json:"password"`
+	Mode         string `json:"mode"`
+	IcePolicy    string `json:"ice_policy"`
+}
+
+// UserDetail 房间内用户详情
+type UserDetail struct {
+	UserInfo
+	//发送队列统计，非 WebSocket 连接时为空
+	Queue *ws.QueueStats `json:"queue,omitempty"`
+}
+
+// RoomDetail 房间详情
+type RoomDetail struct {
+	RoomSummary
+	Users    []UserDetail    `json:"users"`
+	Sessions []SessionDetail `json:"sessions"`
+}
+
+// SessionDetail 会话详情
+type SessionDetail struct {
+	SessionInfo
+	//最近一次 offer/answer 中的媒体
+	Offer  *media.Description `json:"offer,omitempty"`
+	Answer *media.Description `json:"answer,omitempty"`
+	//等待 answer 的 offer 的发送方
+	OfferFrom string `json:"offer_from,omitempty"`
+	//重新协商次数
+	Renegotiations int `json:"renegotiations"`
+}
+
+// 当前所有房间
+func (rm *RoomManager) roomList() []*Room {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	rooms := make([]*Room, 0, len(rm.rooms))
+	for _, room := range rm.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Rooms 返回所有房间的概要
+func (rm *RoomManager) Rooms() []RoomSummary {
+	rooms := rm.roomList()
+
+	summaries := make([]RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		var summary RoomSummary
+		if room.Do(func() {
+			summary = room.summary()
+		}) == nil {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// UsersPerRoom 返回每个房间的用户数
+func (rm *RoomManager) UsersPerRoom() []int {
+	rooms := rm.Rooms()
+	counts := make([]int, 0, len(rooms))
+	for _, room := range rooms {
+		counts = append(counts, room.UserCount)
+	}
+	return counts
+}
+
+// ActiveSessions 返回所有房间中已接听的通话数
+func (rm *RoomManager) ActiveSessions() int {
+	rooms := rm.roomList()
+
+	count := 0
+	for _, room := range rooms {
+		room.Do(func() {
+			for _, s := range room.sessions {
+				if s.State == SessionAccepted && !s.server {
+					count++
+				}
+			}
+		})
+	}
+	return count
+}
+
+// RoomDetail 返回房间详情
+func (rm *RoomManager) RoomDetail(roomId string) (*RoomDetail, error) {
+	var detail *RoomDetail
+	err := rm.doRoom(roomId, func(r *Room) {
+		detail = r.detail()
+	})
+	return detail, err
+}
+
+// KickUser 管理员踢出用户
+func (rm *RoomManager) KickUser(roomId string, userId string) error {
+	var err error
+	if e := rm.doRoom(roomId, func(r *Room) {
+		err = r.kickByAdmin(userId)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// CloseRoom 通知所有用户后关闭房间
+func (rm *RoomManager) CloseRoom(roomId string, reason string) error {
+	return rm.doRoom(roomId, func(r *Room) {
+		r.closeAll(reason)
+	})
+}
+
+// SystemMessage 给房间内所有用户发送系统消息
+func (rm *RoomManager) SystemMessage(roomId string, text string) error {
+	if len(text) == 0 {
+		return errors.New("消息不能为空")
+	}
+	return rm.doRoom(roomId, func(r *Room) {
+		r.broadcast(utils.Marshal(msg.Msg{
+			Type: SystemMessage,
+			Data: map[string]any{
+				"room_id": r.Id,
+				"text":    text,
+			},
+		}), nil)
+	})
+}
+
+// 以下方法只能在房间协程中调用
+
+func (r *Room) summary() RoomSummary {
+	return RoomSummary{
+		RoomId:       r.Id,
+		UserCount:    len(r.users),
+		SessionCount: len(r.sessions),
+		Locked:       r.locked,
+		InviteOnly:   r.opts.InviteOnly,
+		Password:     len(r.opts.PasswordHash) > 0,
+		Mode:         r.mode(),
+		IcePolicy:    r.ice.Policy(r.opts.IcePolicy),
+	}
+}
+
+func (r *Room) detail() *RoomDetail {
+	detail := &RoomDetail{
+		RoomSummary: r.summary(),
+		Users:       make([]UserDetail, 0, len(r.users)),
+		Sessions:    make([]SessionDetail, 0, len(r.sessions)),
+	}
+
+	for _, user := range r.users {
+		ud := UserDetail{UserInfo: user.Info()}
+		if c, ok := user.conn.(interface{ Stats() ws.QueueStats }); ok {
+			stats := c.Stats()
+			ud.Queue = &stats
+		}
+		detail.Users = append(detail.Users, ud)
+	}
+
+	for _, s := range r.sessions {
+		detail.Sessions = append(detail.Sessions, SessionDetail{
+			SessionInfo:    s.info(r.Id, ""),
+			Offer:          s.offer,
+			Answer:         s.answer,
+			OfferFrom:      s.offerFrom,
+			Renegotiations: s.renegotiations,
+		})
+	}
+
+	return detail
+}
+
+func (r *Room) kickByAdmin(userId string) error {
+	user, ok := r.users[userId]
+	if !ok {
+		return msg.NewError(msg.ErrCodeNotFound, "用户 [%s] 不存在", userId)
+	}
+
+	user.conn.Send(utils.Marshal(msg.Msg{
+		Type: Kick,
+		Data: map[string]any{
+			"room_id": r.Id,
+			"by":      adminId,
+		},
+	}))
+
+	r.leave(userId, user.conn)
+	return nil
+}
+
+// 通知所有用户房间关闭，移除所有用户并关闭房间
+func (r *Room) closeAll(reason string) {
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: RoomClosed,
+		Data: map[string]any{
+			"room_id": r.Id,
+			"reason":  reason,
+		},
+	}), nil)
+
+	for id, user := range r.users {
+		r.leave(id, user.conn)
+	}
+
+	r.close()
+}
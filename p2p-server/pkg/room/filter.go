@@ -0,0 +1,73 @@
+package room
+
+import (
+	"webrtc/p2p-server/pkg/ice"
+	"webrtc/p2p-server/pkg/metrics"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+// 以下方法只能在房间协程中调用
+
+// 发送方和接收方之间的 candidate 过滤规则
+// 接收方还没加入时只使用发送方角色的规则
+func (r *Room) candidateFilter(from string, to string) ice.Filter {
+	roles := make([]string, 0, 2)
+	for _, id := range []string{from, to} {
+		if user, ok := r.users[id]; ok {
+			roles = append(roles, user.info.Role)
+		}
+	}
+	return r.ice.Filter(r.opts.IceFilter, r.opts.IcePolicy, roles...)
+}
+
+// 按房间的策略处理 offer/answer/candidate，返回要转发的消息
+// candidate 被过滤时返回 false，违反媒体策略时返回错误，改写过的消息重新序列化
+func (r *Room) filterSignal(msgType string, data any, raw string) (string, bool, error) {
+	var err error
+	changed := false
+	switch d := data.(type) {
+	case *msg.Offer:
+		changed, err = r.filterDescription(&d.Relay, d.Description, true)
+	case *msg.Renegotiate:
+		changed, err = r.filterDescription(&d.Relay, d.Description, true)
+	case *msg.Answer:
+		changed, err = r.filterDescription(&d.Relay, d.Description, false)
+	case *msg.Candidate:
+		candidate, ok := r.candidateFilter(d.From, d.To).Candidate(d.Candidate.Candidate)
+		if !ok {
+			metrics.CandidatesFiltered.Inc()
+			return "", false, nil
+		}
+		changed = candidate != d.Candidate.Candidate
+		d.Candidate.Candidate = candidate
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if !changed {
+		return raw, true, nil
+	}
+	return utils.Marshal(msg.Msg{
+		Type: msgType,
+		Data: data,
+	}), true, nil
+}
+
+// 执行媒体策略并移除 SDP 中被过滤的 candidate，记录会话协商的媒体
+func (r *Room) filterDescription(relay *msg.Relay, desc *msg.Description, offer bool) (bool, error) {
+	sdp, info, changed, err := r.media.Apply(desc.Sdp)
+	if err != nil {
+		return false, err
+	}
+
+	var filtered bool
+	desc.Sdp, filtered = r.candidateFilter(relay.From, relay.To).Sdp(sdp)
+
+	if s, ok := r.sessions[relay.SessionId]; ok && info != nil {
+		s.setMedia(info, offer)
+	}
+	return changed || filtered, nil
+}
@@ -0,0 +1,258 @@
+package room
+
+import (
+	"slices"
+	"time"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+const (
+	Broadcast          = "broadcast"          //转发给房间内所有人
+	StartGroupCall     = "startGroupCall"     //发起多人通话
+	PairConnected      = "pairConnected"      //两人之间的连接已建立
+	GroupCallConnected = "groupCallConnected" //多人通话所有连接已建立
+)
+
+// GroupCall 多人 mesh 通话，每两人之间是一个会话，只在房间协程中访问
+type GroupCall struct {
+	Id string
+	//发起人
+	Initiator string
+	//媒体类型
+	Type string
+	//参与的用户，按Id排序
+	Members []string
+	//会话Id -> 是否已连接
+	pairs map[string]bool
+	//是否已通知所有连接建立
+	connected bool
+	//连接建立超时
+	timer *time.Timer
+}
+
+// GroupCallPeer 需要建立连接的对方
+type GroupCallPeer struct {
+	User      string `json:"user"`
+	SessionId string `json:"session_id"`
+}
+
+// GroupCallPlan 发给每个参与者的连接分配
+type GroupCallPlan struct {
+	CallId    string   `json:"call_id"`
+	RoomId    string   `json:"room_id"`
+	Initiator string   `json:"initiator"`
+	Type      string   `json:"type,omitempty"`
+	Members   []string `json:"members"`
+	//需要主动发 offer 的对象
+	OfferTo []GroupCallPeer `json:"offer_to"`
+	//等待对方发 offer
+	AnswerFrom []GroupCallPeer `json:"answer_from"`
+}
+
+// 以下方法只能在房间协程中调用
+
+// 转发给房间内除发送者外的所有用户，断线重连中的用户先缓存
+func (r *Room) broadcastFrom(from string, data *msg.Broadcast, raw string) error {
+	if data.From != from {
+		return msg.NewError(msg.ErrCodeForbidden, "from与当前用户不一致")
+	}
+
+	for id := range r.users {
+		if id != from {
+			r.relay(id, raw)
+		}
+	}
+	return nil
+}
+
+// 发起多人通话
+// 参与者按Id排序，每对用户中Id较小的一方发 offer，双方不会同时发 offer
+func (r *Room) startGroupCall(from string, data *msg.StartGroupCall) error {
+	if r.groupCall != nil {
+		return msg.NewError(msg.ErrCodeConflict, "已有进行中的多人通话")
+	}
+	if u, ok := r.users[from]; !ok || u.info.Role == RoleViewer {
+		return msg.NewError(msg.ErrCodeForbidden, "观众不能发起呼叫")
+	}
+	if r.busy(from) {
+		return msg.NewError(msg.ErrCodeConflict, "已经在通话中")
+	}
+
+	candidates := data.Users
+	if len(candidates) == 0 {
+		for id := range r.users {
+			candidates = append(candidates, id)
+		}
+	}
+
+	//观众和通话中的用户不参加
+	members := []string{from}
+	for _, id := range candidates {
+		u, ok := r.users[id]
+		if !ok || u.info.Role == RoleViewer || r.busy(id) || slices.Contains(members, id) {
+			continue
+		}
+		members = append(members, id)
+	}
+	if len(members) < 2 {
+		return msg.NewError(msg.ErrCodeInvalidParam, "可以参加通话的用户不足")
+	}
+	slices.Sort(members)
+
+	call := &GroupCall{
+		Id:        utils.NewId(),
+		Initiator: from,
+		Type:      data.Type,
+		Members:   members,
+		pairs:     make(map[string]bool),
+	}
+
+	plans := make(map[string]*GroupCallPlan, len(members))
+	for _, id := range members {
+		plans[id] = &GroupCallPlan{
+			CallId:     call.Id,
+			RoomId:     r.Id,
+			Initiator:  from,
+			Type:       data.Type,
+			Members:    members,
+			OfferTo:    []GroupCallPeer{},
+			AnswerFrom: []GroupCallPeer{},
+		}
+	}
+
+	for i := 0; i < len(members); i++ {
+		for j := i + 1; j < len(members); j++ {
+			s := newSession("", members[i], members[j], data.Type, SessionAccepted)
+			r.sessions[s.Id] = s
+			call.pairs[s.Id] = false
+
+			plans[s.From].OfferTo = append(plans[s.From].OfferTo, GroupCallPeer{User: s.To, SessionId: s.Id})
+			plans[s.To].AnswerFrom = append(plans[s.To].AnswerFrom, GroupCallPeer{User: s.From, SessionId: s.Id})
+		}
+	}
+	r.groupCall = call
+
+	if r.inviteTimeout > 0 {
+		id := call.Id
+		call.timer = time.AfterFunc(r.inviteTimeout, func() {
+			r.Post(func() {
+				r.timeoutGroupCall(id)
+			})
+		})
+	}
+
+	for id, plan := range plans {
+		r.relay(id, utils.Marshal(msg.Msg{
+			Type: StartGroupCall,
+			Data: plan,
+		}))
+	}
+	return nil
+}
+
+// 参与者上报与对方的连接已建立
+func (r *Room) pairConnected(from string, data *msg.PairConnected) error {
+	call := r.groupCall
+	if call == nil {
+		return msg.NewError(msg.ErrCodeNotFound, "没有进行中的多人通话")
+	}
+	if _, ok := call.pairs[data.SessionId]; !ok {
+		return msg.NewError(msg.ErrCodeNotFound, "会话 [%s] 不属于多人通话", data.SessionId)
+	}
+	if s := r.sessions[data.SessionId]; s == nil || !s.Has(from) {
+		return msg.NewError(msg.ErrCodeForbidden, "不是会话 [%s] 的参与方", data.SessionId)
+	}
+
+	call.pairs[data.SessionId] = true
+	r.checkGroupConnected()
+	return nil
+}
+
+// 会话结束时从多人通话中移除，没有剩余的会话时通话结束
+func (r *Room) dropGroupPair(sessionId string) {
+	call := r.groupCall
+	if call == nil {
+		return
+	}
+	if _, ok := call.pairs[sessionId]; !ok {
+		return
+	}
+
+	delete(call.pairs, sessionId)
+
+	//只保留仍有会话的参与者，不足两人时通话结束
+	call.Members = slices.DeleteFunc(call.Members, func(id string) bool {
+		for sid := range call.pairs {
+			if s := r.sessions[sid]; s != nil && s.Has(id) {
+				return false
+			}
+		}
+		return true
+	})
+	if len(call.Members) < 2 {
+		r.clearGroupCall()
+		return
+	}
+	r.checkGroupConnected()
+}
+
+// 超时后仍有连接没有建立，结束这些会话，已建立的连接作为普通会话保留
+func (r *Room) timeoutGroupCall(id string) {
+	call := r.groupCall
+	if call == nil || call.Id != id || call.connected {
+		return
+	}
+
+	var pending []*Session
+	for sid, connected := range call.pairs {
+		if s := r.sessions[sid]; s != nil && !connected {
+			pending = append(pending, s)
+		}
+	}
+
+	r.clearGroupCall()
+	for _, s := range pending {
+		r.endSession(s, ReasonTimeout)
+	}
+}
+
+// 清除多人通话，不影响其中的会话
+func (r *Room) clearGroupCall() {
+	if r.groupCall == nil {
+		return
+	}
+	if r.groupCall.timer != nil {
+		r.groupCall.timer.Stop()
+	}
+	r.groupCall = nil
+}
+
+// 所有连接都建立后通知参与者，只通知一次
+func (r *Room) checkGroupConnected() {
+	call := r.groupCall
+	if call.connected {
+		return
+	}
+	for _, connected := range call.pairs {
+		if !connected {
+			return
+		}
+	}
+
+	call.connected = true
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+	data := utils.Marshal(msg.Msg{
+		Type: GroupCallConnected,
+		Data: map[string]any{
+			"call_id": call.Id,
+			"room_id": r.Id,
+			"members": call.Members,
+		},
+	})
+	for _, id := range call.Members {
+		r.relay(id, data)
+	}
+}
@@ -0,0 +1,55 @@
+package room
+
+import (
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/sfu"
+)
+
+// Ingest 外部推流端(WHIP)以参与者身份加入 SFU 房间，返回房间的 SFU
+// HTTP 认证只确认推流端的身份，进入房间与 joinRoom 一样需要房间密码或邀请
+func (rm *RoomManager) Ingest(conn Conn, roomId string, userId string, name string, password string, inviteToken string) (*sfu.SFU, error) {
+	if err := rm.checkIdentity(conn, userId, roomId, &name); err != nil {
+		return nil, err
+	}
+	invite, err := rm.parseInvite(roomId, inviteToken)
+	if err != nil {
+		return nil, err
+	}
+	if invite != nil && invite.Role == RoleViewer {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "观众邀请不能推流")
+	}
+
+	user := &User{
+		info: UserInfo{
+			Id:   userId,
+			Name: name,
+		},
+		conn: conn,
+	}
+
+	var s *sfu.SFU
+	err = rm.joinRoom(conn, roomId, userId, func() *Room {
+		return rm.GetRoom(roomId)
+	}, func(r *Room) (bool, error) {
+		if r.sfu == nil {
+			return false, msg.NewError(msg.ErrCodeConflict, "房间 [%s] 不是SFU模式", roomId)
+		}
+		if u, ok := r.users[userId]; ok && u.conn != conn {
+			return false, msg.NewError(msg.ErrCodeConflict, "用户 [%s] 已在房间中", userId)
+		}
+		s = r.sfu
+		return r.join(user, "", password, invite)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LeaveRoom 连接离开房间，用于没有 WebSocket 的连接
+func (rm *RoomManager) LeaveRoom(conn Conn, roomId string) error {
+	return rm.doAsUser(conn, roomId, func(r *Room, from string) error {
+		r.leave(from, conn)
+		return nil
+	})
+}
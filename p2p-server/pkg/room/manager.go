@@ -0,0 +1,711 @@
+package room
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/ice"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/media"
+	"webrtc/p2p-server/pkg/metrics"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/recorder"
+	"webrtc/p2p-server/pkg/router"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+	"webrtc/p2p-server/pkg/ws"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+// RoomManager 房间管理
+// mu 只保护 rooms 和 conns 两个索引，持有 mu 时不能等待房间命令
+type RoomManager struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+	//连接加入的房间 conn -> roomId -> userId
+	conns  map[Conn]map[string]string
+	cfg    *config.Config
+	router *router.Router
+	//SFU 和录制共用的 pion API，都未开启时为 nil
+	api    *webrtc.API
+	sfuCfg sfu.Config
+}
+
+func NewRoomManager(cfg *config.Config) *RoomManager {
+	rm := &RoomManager{
+		rooms:  make(map[string]*Room),
+		conns:  make(map[Conn]map[string]string),
+		cfg:    cfg,
+		router: router.New(),
+	}
+	if cfg.Sfu.Enable || cfg.Record.Enable || cfg.Whep.Enable {
+		rm.sfuCfg = SfuConfig(cfg)
+		api, err := sfu.NewAPI(rm.sfuCfg)
+		if err != nil {
+			logger.Log.Errorf("WebRTC初始化失败 %v", err)
+		}
+		rm.api = api
+	}
+	rm.registerHandlers()
+	return rm
+}
+
+// AddRoom 获取房间，不存在则创建
+func (rm *RoomManager) AddRoom(id string) *Room {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if room, ok := rm.rooms[id]; ok {
+		return room
+	}
+
+	room := rm.newRoom(id)
+	rm.rooms[id] = room
+	return room
+}
+
+func (rm *RoomManager) newRoom(id string) *Room {
+	return NewRoom(id, rm.cfg, RoomHooks{
+		OnEmpty: rm.removeEmptyRoom,
+		OnLeave: func(r *Room, userId string, conn Conn) {
+			rm.unbindConn(conn, r.Id)
+		},
+	})
+}
+
+func (rm *RoomManager) RemoveRoom(id string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.rooms, id)
+}
+
+// 房间变空后从索引中移除，房间可能已经被新的同名房间替换
+func (rm *RoomManager) removeEmptyRoom(r *Room) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.rooms[r.Id] == r {
+		delete(rm.rooms, r.Id)
+	}
+}
+
+func (rm *RoomManager) GetRoom(id string) *Room {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.rooms[id]
+}
+
+func (rm *RoomManager) Exists(id string) bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	_, ok := rm.rooms[id]
+	return ok
+}
+
+// 记录连接加入的房间，返回之前的记录
+func (rm *RoomManager) bindConn(conn Conn, roomId string, userId string) (string, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := rm.conns[conn]; !ok {
+		rm.conns[conn] = make(map[string]string)
+	}
+	prev, ok := rm.conns[conn][roomId]
+	rm.conns[conn][roomId] = userId
+	return prev, ok
+}
+
+// 移除连接加入的房间记录
+func (rm *RoomManager) unbindConn(conn Conn, roomId string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rooms, ok := rm.conns[conn]; ok {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(rm.conns, conn)
+		}
+	}
+}
+
+// 取出并移除连接加入的所有房间
+func (rm *RoomManager) takeConn(conn Conn) map[string]string {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rooms := rm.conns[conn]
+	delete(rm.conns, conn)
+	return rooms
+}
+
+// 连接在房间中对应的用户Id
+func (rm *RoomManager) userOf(conn Conn, roomId string) (string, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if userId, ok := rm.conns[conn][roomId]; ok {
+		return userId, nil
+	}
+	return "", msg.NewError(msg.ErrCodeForbidden, "没有加入房间 [%s]", roomId)
+}
+
+// 以连接在房间中的用户身份，在房间协程中执行 fn
+func (rm *RoomManager) doAsUser(conn Conn, roomId string, fn func(r *Room, from string) error) error {
+	from, err := rm.userOf(conn, roomId)
+	if err != nil {
+		return err
+	}
+
+	if e := rm.doRoom(roomId, func(r *Room) {
+		err = fn(r, from)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// 在房间协程中执行 fn，房间不存在时返回错误
+func (rm *RoomManager) doRoom(roomId string, fn func(r *Room)) error {
+	room := rm.GetRoom(roomId)
+	if room == nil {
+		return msg.NewError(msg.ErrCodeNotFound, "房间 [%s] 不存在", roomId)
+	}
+
+	if err := room.Do(func() { fn(room) }); err != nil {
+		return msg.NewError(msg.ErrCodeNotFound, "房间 [%s] 不存在", roomId)
+	}
+	return nil
+}
+
+func (rm *RoomManager) HandleMsg(conn *ws.WsConn, c *gin.Context) {
+	conn.On("message", func(message []byte) {
+		rm.router.Dispatch(conn, message)
+	})
+
+	conn.On("close", func(message []byte) {
+		var data msg.Close
+		json.Unmarshal(message, &data)
+
+		rm.onClose(conn, data.Code)
+		rm.router.ConnClosed(conn)
+	})
+}
+
+// Router 信令消息路由，嵌入的应用可以注册自己的消息类型和中间件
+func (rm *RoomManager) Router() *router.Router {
+	return rm.router
+}
+
+// 注册信令消息处理函数
+func (rm *RoomManager) registerHandlers() {
+	r := rm.router
+	r.Use(router.Recovery())
+	//限流在日志和统计之前，超过速率的消息不再记录
+	if rm.cfg.Ws.RateLimit > 0 {
+		r.Use(r.RateLimit(rm.cfg.Ws.RateLimit, max(rm.cfg.Ws.RateBurst, 1)))
+	}
+	r.Use(router.Logging(), r.Metrics())
+	//加入或创建房间前只能发送 joinRoom 和 createRoom
+	r.Use(router.Auth(rm.checkJoined, JoinRoom, CreateRoom))
+
+	router.Handle(r, JoinRoom, rm.onJoinRoom)
+	router.Handle(r, CreateRoom, rm.onCreateRoom)
+	router.Handle(r, CreateInvite, rm.onCreateInvite)
+	router.Handle(r, Offer, rm.onOffer)
+	router.Handle(r, Renegotiate, rm.onRenegotiate)
+	router.Handle(r, Answer, rm.onAnswer)
+	router.Handle(r, Candidate, rm.onCandidate)
+	router.Handle(r, HangUp, rm.onHangUp)
+	router.Handle(r, Invite, rm.onInvite)
+	for _, t := range []string{Ringing, Accept, Reject, Busy} {
+		router.Handle(r, t, rm.onSessionReply)
+	}
+	for _, t := range []string{Kick, MuteRequest, TransferOwner, SetRole} {
+		router.Handle(r, t, rm.onModeration)
+	}
+	router.Handle(r, LockRoom, rm.onLockRoom)
+	router.Handle(r, Broadcast, rm.onBroadcast)
+	router.Handle(r, StartGroupCall, rm.onStartGroupCall)
+	router.Handle(r, PairConnected, rm.onPairConnected)
+	router.Handle(r, sfu.Publish, rm.onPublish)
+	router.Handle(r, sfu.Subscribe, rm.onSubscribe)
+	router.Handle(r, sfu.Unpublish, rm.onUnpublish)
+	router.Handle(r, sfu.SfuAnswer, rm.onSfuAnswer)
+	router.Handle(r, sfu.SfuCandidate, rm.onSfuCandidate)
+	router.Handle(r, StartRecording, rm.onStartRecording)
+	router.Handle(r, StopRecording, rm.onStopRecording)
+}
+
+// 连接是否已加入房间，未知的消息类型交给路由回复错误
+func (rm *RoomManager) checkJoined(ctx *router.Context) error {
+	if !rm.router.Known(ctx.Type) {
+		return nil
+	}
+
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if len(rm.conns[ctx.Conn]) == 0 {
+		return msg.NewError(msg.ErrCodeForbidden, "请先加入房间")
+	}
+	return nil
+}
+
+// 开启认证时校验用户Id与token一致，并使用token中的名字
+func (rm *RoomManager) checkIdentity(conn Conn, userId string, roomId string, name *string) error {
+	identity := conn.Identity()
+	if identity == nil {
+		return nil
+	}
+	if userId != identity.Subject {
+		return msg.NewError(msg.ErrCodeForbidden, "id与token不一致")
+	}
+	if len(roomId) > 0 && !identity.CanJoin(roomId) {
+		return msg.NewError(msg.ErrCodeForbidden, "没有进入房间 [%s] 的权限", roomId)
+	}
+	if len(identity.Name) > 0 {
+		*name = identity.Name
+	}
+	return nil
+}
+
+// 校验邀请 token，邀请必须属于 roomId，token 为空时返回 nil
+func (rm *RoomManager) parseInvite(roomId string, token string) (*auth.Invite, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+	invite, err := auth.ParseInvite(rm.cfg.Room.InviteSecret, token)
+	if err != nil {
+		return nil, msg.NewError(msg.ErrCodeUnauthorized, "%v", err)
+	}
+	if invite.RoomId != roomId {
+		return nil, msg.NewError(msg.ErrCodeUnauthorized, "邀请不属于房间 [%s]", roomId)
+	}
+	return invite, nil
+}
+
+func (rm *RoomManager) onJoinRoom(ctx *router.Context, data *msg.JoinRoom) error {
+	conn := ctx.Conn
+
+	if err := rm.checkIdentity(conn, data.Id, data.RoomId, &data.Name); err != nil {
+		return err
+	}
+
+	invite, err := rm.parseInvite(data.RoomId, data.InviteToken)
+	if err != nil {
+		return err
+	}
+
+	user := &User{
+		info: UserInfo{
+			Id:   data.Id,
+			Name: data.Name,
+			Role: data.Role,
+		},
+		conn: conn,
+	}
+
+	return rm.joinRoom(conn, data.RoomId, data.Id, func() *Room {
+		if room := rm.GetRoom(data.RoomId); room != nil {
+			return room
+		}
+		//邀请只对签发它的房间有效，房间关闭后不能凭邀请重建
+		if invite != nil {
+			return nil
+		}
+		if rm.cfg.Room.DisableAutoCreate {
+			return nil
+		}
+		return rm.AddRoom(data.RoomId)
+	}, func(r *Room) (bool, error) {
+		return r.join(user, data.ResumeToken, data.Password, invite)
+	})
+}
+
+// 用户加入房间，getRoom 返回 nil 表示房间不存在
+func (rm *RoomManager) joinRoom(conn Conn, roomId string, userId string, getRoom func() *Room, join func(r *Room) (bool, error)) error {
+	//先登记连接，保证并发的 close 能找到这个房间
+	prev, bound := rm.bindConn(conn, roomId, userId)
+	restore := func() {
+		if bound {
+			rm.bindConn(conn, roomId, prev)
+		} else {
+			rm.unbindConn(conn, roomId)
+		}
+	}
+
+	for {
+		room := getRoom()
+		if room == nil {
+			restore()
+			return msg.NewError(msg.ErrCodeNotFound, "房间 [%s] 不存在", roomId)
+		}
+
+		joined := false
+		var joinErr error
+		err := room.Do(func() {
+			joined, joinErr = join(room)
+		})
+		if err == ErrRoomClosed {
+			//房间刚好变空关闭，重新获取
+			continue
+		}
+
+		if !joined {
+			restore()
+		}
+		return joinErr
+	}
+}
+
+// 创建房间，房间已存在时返回 nil
+func (rm *RoomManager) createRoom(id string, opts RoomOptions) *Room {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if _, ok := rm.rooms[id]; ok {
+		return nil
+	}
+
+	room := rm.newRoom(id)
+	room.configure(opts)
+	if opts.Mode == ModeSFU {
+		room.enableSFU(rm.api, rm.sfuCfg)
+	}
+	rm.rooms[id] = room
+	return room
+}
+
+func (rm *RoomManager) onCreateRoom(ctx *router.Context, data *msg.CreateRoom) error {
+	conn := ctx.Conn
+
+	if len(data.RoomId) == 0 {
+		data.RoomId = utils.NewId()
+	}
+
+	if err := rm.checkIdentity(conn, data.Id, data.RoomId, &data.Name); err != nil {
+		return err
+	}
+
+	if data.Mode == ModeSFU && (!rm.cfg.Sfu.Enable || rm.api == nil) {
+		return msg.NewError(msg.ErrCodeForbidden, "没有开启SFU")
+	}
+
+	opts := RoomOptions{
+		InviteOnly: data.InviteOnly,
+		KeepEmpty:  time.Duration(rm.cfg.Room.EmptyTimeout) * time.Second,
+		Mode:       data.Mode,
+		IcePolicy:  data.IcePolicy,
+	}
+	if f := data.IceFilter; f != nil {
+		block, err := ice.ParseCidrs(f.BlockCidrs)
+		if err != nil {
+			return msg.NewError(msg.ErrCodeInvalidParam, "%v", err)
+		}
+		opts.IceFilter = ice.Filter{
+			StripHost:  f.StripHost,
+			StripSrflx: f.StripSrflx,
+			RelayOnly:  f.RelayOnly,
+			Block:      block,
+		}
+	}
+	if m := data.Media; m != nil {
+		opts.Media = media.Policy{
+			Kinds:        m.Kinds,
+			Codecs:       m.Codecs,
+			Prefer:       m.Prefer,
+			AudioBitrate: m.AudioBitrate,
+			VideoBitrate: m.VideoBitrate,
+		}
+	}
+	if len(data.Password) > 0 {
+		hash, err := HashPassword(data.Password)
+		if err != nil {
+			return msg.NewError(msg.ErrCodeInternal, "%v", err)
+		}
+		opts.PasswordHash = hash
+	}
+
+	room := rm.createRoom(data.RoomId, opts)
+	if room == nil {
+		return msg.NewError(msg.ErrCodeConflict, "房间 [%s] 已存在", data.RoomId)
+	}
+
+	conn.Send(utils.Marshal(msg.Msg{
+		Type: CreateRoom,
+		Data: map[string]any{
+			"room_id":     data.RoomId,
+			"invite_only": data.InviteOnly,
+			"password":    len(data.Password) > 0,
+			"mode":        room.mode(),
+			"ice_policy":  room.ice.Policy(data.IcePolicy),
+		},
+	}))
+
+	user := &User{
+		info: UserInfo{
+			Id:   data.Id,
+			Name: data.Name,
+			Role: RoleOwner,
+		},
+		conn: conn,
+	}
+
+	created := false
+	return rm.joinRoom(conn, data.RoomId, data.Id, func() *Room {
+		//只加入刚创建的房间，房间在加入前关闭时不再重建
+		if created {
+			return nil
+		}
+		created = true
+		return room
+	}, func(r *Room) (bool, error) {
+		//创建者不需要校验密码和邀请
+		return r.join(user, "", "", &auth.Invite{RoomId: r.Id, Role: RoleOwner, Nonce: r.inviteNonce})
+	})
+}
+
+func (rm *RoomManager) onCreateInvite(ctx *router.Context, data *msg.CreateInvite) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.createInvite(from, data, rm.cfg.Room.InviteSecret, rm.inviteTtl())
+	})
+}
+
+// 邀请默认有效期
+func (rm *RoomManager) inviteTtl() time.Duration {
+	if rm.cfg.Room.InviteTtl > 0 {
+		return time.Duration(rm.cfg.Room.InviteTtl) * time.Second
+	}
+	return defaultInviteTtl
+}
+
+func (rm *RoomManager) onOffer(ctx *router.Context, data *msg.Offer) error {
+	return rm.relayOffer(ctx, &data.Relay, data)
+}
+
+func (rm *RoomManager) onRenegotiate(ctx *router.Context, data *msg.Renegotiate) error {
+	return rm.relayOffer(ctx, &data.Relay, data)
+}
+
+// 转发 offer/renegotiate，登记会话并处理双方同时发出 offer 的冲突
+// 冲突中失败的 offer 不转发，发送方会收到 rollback
+func (rm *RoomManager) relayOffer(ctx *router.Context, data *msg.Relay, signal any) error {
+	if err := rm.checkSender(ctx.Conn, data); err != nil {
+		return err
+	}
+
+	var err error
+	if e := rm.doRoom(data.RoomId, func(r *Room) {
+		err = r.forwardOffer(ctx.Type, data, signal, string(ctx.Request.Raw))
+	}); e != nil {
+		err = e
+	}
+	if err != nil {
+		metrics.RelayFailures.WithLabelValues(ctx.Type).Inc()
+	}
+	return err
+}
+
+func (rm *RoomManager) onAnswer(ctx *router.Context, data *msg.Answer) error {
+	return rm.relay(ctx, &data.Relay, data)
+}
+
+func (rm *RoomManager) onCandidate(ctx *router.Context, data *msg.Candidate) error {
+	return rm.relay(ctx, &data.Relay, data)
+}
+
+// 校验 from 是连接在房间中绑定的用户，防止冒充
+func (rm *RoomManager) checkSender(conn Conn, data *msg.Relay) error {
+	from, err := rm.userOf(conn, data.RoomId)
+	if err != nil {
+		return err
+	}
+	if from != data.From {
+		return msg.NewError(msg.ErrCodeForbidden, "from与当前用户不一致")
+	}
+	return nil
+}
+
+// 转发 answer/candidate 给目标用户，按房间的策略改写 SDP 和移除 candidate
+// 被过滤的 candidate 直接丢弃，不返回错误
+func (rm *RoomManager) relay(ctx *router.Context, data *msg.Relay, signal any) error {
+	if err := rm.checkSender(ctx.Conn, data); err != nil {
+		return err
+	}
+
+	var err error
+	if e := rm.doRoom(data.RoomId, func(r *Room) {
+		err = r.forwardSignal(ctx.Type, data, signal, string(ctx.Request.Raw))
+	}); e != nil {
+		err = e
+	}
+	if err != nil {
+		metrics.RelayFailures.WithLabelValues(ctx.Type).Inc()
+	}
+	return err
+}
+
+func (rm *RoomManager) onHangUp(ctx *router.Context, data *msg.HangUp) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.hangUp(from, data.SessionId)
+	})
+}
+
+func (rm *RoomManager) onInvite(ctx *router.Context, data *msg.Invite) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.invite(from, data)
+	})
+}
+
+func (rm *RoomManager) onSessionReply(ctx *router.Context, data *msg.SessionReply) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.replySession(from, ctx.Type, data)
+	})
+}
+
+func (rm *RoomManager) onModeration(ctx *router.Context, data *msg.Moderation) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		switch ctx.Type {
+		case Kick:
+			return r.kick(from, data)
+		case MuteRequest:
+			return r.muteRequest(from, data)
+		case TransferOwner:
+			return r.transferOwner(from, data)
+		default:
+			return r.changeRole(from, data)
+		}
+	})
+}
+
+func (rm *RoomManager) onLockRoom(ctx *router.Context, data *msg.LockRoom) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.lock(from, data)
+	})
+}
+
+func (rm *RoomManager) onBroadcast(ctx *router.Context, data *msg.Broadcast) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.broadcastFrom(from, data, string(ctx.Request.Raw))
+	})
+}
+
+func (rm *RoomManager) onStartGroupCall(ctx *router.Context, data *msg.StartGroupCall) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.startGroupCall(from, data)
+	})
+}
+
+func (rm *RoomManager) onPairConnected(ctx *router.Context, data *msg.PairConnected) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.pairConnected(from, data)
+	})
+}
+
+// 获取连接所在房间的 SFU 和用户Id
+func (rm *RoomManager) sfuOf(conn Conn, roomId string, publish bool) (*sfu.SFU, string, error) {
+	var s *sfu.SFU
+	var userId string
+	err := rm.doAsUser(conn, roomId, func(r *Room, from string) error {
+		var err error
+		s, err = r.sfuFor(from, publish)
+		userId = from
+		return err
+	})
+	return s, userId, err
+}
+
+func (rm *RoomManager) onPublish(ctx *router.Context, data *msg.Publish) error {
+	s, from, err := rm.sfuOf(ctx.Conn, data.RoomId, true)
+	if err != nil {
+		return err
+	}
+
+	return s.Publish(from, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  data.Description.Sdp,
+	})
+}
+
+func (rm *RoomManager) onSubscribe(ctx *router.Context, data *msg.Subscribe) error {
+	s, from, err := rm.sfuOf(ctx.Conn, data.RoomId, false)
+	if err != nil {
+		return err
+	}
+
+	tracks, err := s.Subscribe(from, data.Publishers)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Conn.Send(utils.Marshal(msg.Msg{
+		Type: sfu.Subscribe,
+		Data: map[string]any{
+			"room_id": data.RoomId,
+			"tracks":  tracks,
+		},
+	}))
+}
+
+func (rm *RoomManager) onUnpublish(ctx *router.Context, data *msg.Unpublish) error {
+	s, from, err := rm.sfuOf(ctx.Conn, data.RoomId, false)
+	if err != nil {
+		return err
+	}
+	return s.Unpublish(from, data.Tracks)
+}
+
+func (rm *RoomManager) onSfuAnswer(ctx *router.Context, data *msg.SfuAnswer) error {
+	s, from, err := rm.sfuOf(ctx.Conn, data.RoomId, false)
+	if err != nil {
+		return err
+	}
+	return s.Answer(from, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  data.Description.Sdp,
+	})
+}
+
+func (rm *RoomManager) onSfuCandidate(ctx *router.Context, data *msg.SfuCandidate) error {
+	s, from, err := rm.sfuOf(ctx.Conn, data.RoomId, false)
+	if err != nil {
+		return err
+	}
+	return s.Candidate(from, data.Target, webrtc.ICECandidateInit{
+		Candidate:     data.Candidate.Candidate,
+		SDPMid:        data.Candidate.SdpMid,
+		SDPMLineIndex: data.Candidate.SdpMLineIndex,
+	})
+}
+
+func (rm *RoomManager) onStartRecording(ctx *router.Context, data *msg.Recording) error {
+	if !rm.cfg.Record.Enable || rm.api == nil {
+		return msg.NewError(msg.ErrCodeForbidden, "没有开启录制")
+	}
+
+	cfg := recorder.Config{
+		Dir:        rm.cfg.Record.Dir,
+		ICEServers: rm.sfuCfg.ICEServers,
+	}
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.startRecording(from, rm.api, cfg)
+	})
+}
+
+func (rm *RoomManager) onStopRecording(ctx *router.Context, data *msg.Recording) error {
+	return rm.doAsUser(ctx.Conn, data.RoomId, func(r *Room, from string) error {
+		return r.stopRecording(from)
+	})
+}
+
+func (rm *RoomManager) onClose(conn Conn, code int) {
+	rooms := rm.takeConn(conn)
+	if len(rooms) == 0 {
+		logger.Log.Errorf("没有查找到退出的房间")
+		return
+	}
+
+	for roomId, userId := range rooms {
+		rm.doRoom(roomId, func(r *Room) {
+			r.disconnect(userId, conn, code)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package room
+
+import (
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+// 房间角色
+const (
+	RoleOwner       = "owner"       //房主
+	RoleModerator   = "moderator"   //主持人
+	RoleParticipant = "participant" //参与者
+	RoleViewer      = "viewer"      //观众
+)
+
+// 角色等级，等级高的可以管理等级低的
+var roleRank = map[string]int{
+	RoleOwner:       4,
+	RoleModerator:   3,
+	RoleParticipant: 2,
+	RoleViewer:      1,
+}
+
+// 以下方法只能在房间协程中调用
+
+// 检查房间人数，观众不占名额，替换同 Id 用户不重复计算
+func (r *Room) checkCapacity(user *User) error {
+	if r.maxUsers <= 0 || user.info.Role == RoleViewer {
+		return nil
+	}
+
+	count := 0
+	for id, u := range r.users {
+		if id != user.info.Id && u.info.Role != RoleViewer {
+			count++
+		}
+	}
+	if count >= r.maxUsers {
+		return msg.NewError(msg.ErrCodeRoomFull, "房间已满，最多 %d 人", r.maxUsers)
+	}
+	return nil
+}
+
+// 当前房主
+func (r *Room) owner() *User {
+	for _, u := range r.users {
+		if u.info.Role == RoleOwner {
+			return u
+		}
+	}
+	return nil
+}
+
+func (r *Room) setRole(user *User, role string) {
+	user.info.Role = role
+}
+
+// 房主离开后，把房主转给最早加入的主持人，没有主持人时转给最早加入的参与者
+func (r *Room) electOwner() {
+	var next *User
+	for _, u := range r.users {
+		if u.info.Role != RoleModerator && u.info.Role != RoleParticipant {
+			continue
+		}
+		if next == nil ||
+			roleRank[u.info.Role] > roleRank[next.info.Role] ||
+			(u.info.Role == next.info.Role && u.seq < next.seq) {
+			next = u
+		}
+	}
+	if next != nil {
+		r.setRole(next, RoleOwner)
+	}
+}
+
+// 检查操作者是否至少是 role，并且等级高于目标用户
+func (r *Room) checkModerator(from string, target string, role string) (*User, *User, error) {
+	actor, ok := r.users[from]
+	if !ok {
+		return nil, nil, msg.NewError(msg.ErrCodeForbidden, "没有加入房间 [%s]", r.Id)
+	}
+	if roleRank[actor.info.Role] < roleRank[role] {
+		return nil, nil, msg.NewError(msg.ErrCodeForbidden, "没有权限")
+	}
+
+	if len(target) == 0 {
+		return actor, nil, nil
+	}
+
+	user, ok := r.users[target]
+	if !ok {
+		return nil, nil, msg.NewError(msg.ErrCodeNotFound, "用户 [%s] 不存在", target)
+	}
+	if roleRank[actor.info.Role] <= roleRank[user.info.Role] {
+		return nil, nil, msg.NewError(msg.ErrCodeForbidden, "不能管理同级或更高角色的用户")
+	}
+	return actor, user, nil
+}
+
+// 踢出用户
+func (r *Room) kick(from string, data *msg.Moderation) error {
+	_, user, err := r.checkModerator(from, data.Target, RoleModerator)
+	if err != nil {
+		return err
+	}
+
+	user.conn.Send(utils.Marshal(msg.Msg{
+		Type: Kick,
+		Data: map[string]any{
+			"room_id": r.Id,
+			"by":      from,
+		},
+	}))
+
+	r.leave(user.info.Id, user.conn)
+	return nil
+}
+
+// 请求用户静音，由客户端自行关闭媒体
+func (r *Room) muteRequest(from string, data *msg.Moderation) error {
+	_, user, err := r.checkModerator(from, data.Target, RoleModerator)
+	if err != nil {
+		return err
+	}
+
+	kind := data.Kind
+	if len(kind) == 0 {
+		kind = "audio"
+	}
+
+	return user.conn.Send(utils.Marshal(msg.Msg{
+		Type: MuteRequest,
+		Data: map[string]any{
+			"room_id": r.Id,
+			"by":      from,
+			"kind":    kind,
+		},
+	}))
+}
+
+// 锁定/解锁房间
+func (r *Room) lock(from string, data *msg.LockRoom) error {
+	if _, _, err := r.checkModerator(from, "", RoleModerator); err != nil {
+		return err
+	}
+
+	r.locked = data.Locked
+
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: LockRoom,
+		Data: map[string]any{
+			"room_id": r.Id,
+			"by":      from,
+			"locked":  r.locked,
+		},
+	}), nil)
+	return nil
+}
+
+// 转让房主，原房主变为主持人
+func (r *Room) transferOwner(from string, data *msg.Moderation) error {
+	actor, user, err := r.checkModerator(from, data.Target, RoleOwner)
+	if err != nil {
+		return err
+	}
+	if user.info.Role == RoleViewer {
+		return msg.NewError(msg.ErrCodeInvalidParam, "不能把房主转让给观众")
+	}
+
+	r.setRole(actor, RoleModerator)
+	r.setRole(user, RoleOwner)
+
+	r.notifyUsersUpdate()
+	return nil
+}
+
+// 设置用户角色，只能设置为比自己低的角色
+func (r *Room) changeRole(from string, data *msg.Moderation) error {
+	actor, user, err := r.checkModerator(from, data.Target, RoleModerator)
+	if err != nil {
+		return err
+	}
+
+	rank, ok := roleRank[data.Role]
+	if !ok || data.Role == RoleOwner {
+		return msg.NewError(msg.ErrCodeInvalidParam, "role [%s] 无效", data.Role)
+	}
+	if rank >= roleRank[actor.info.Role] {
+		return msg.NewError(msg.ErrCodeForbidden, "不能设置同级或更高的角色")
+	}
+	if user.info.Role == RoleViewer && data.Role != RoleViewer {
+		tmp := *user
+		tmp.info.Role = data.Role
+		if err := r.checkCapacity(&tmp); err != nil {
+			return err
+		}
+	}
+
+	r.setRole(user, data.Role)
+
+	r.notifyUsersUpdate()
+	return nil
+}
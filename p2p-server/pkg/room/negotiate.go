@@ -0,0 +1,185 @@
+package room
+
+import (
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+const (
+	Renegotiate = "renegotiate" //通话中重新协商
+	Rollback    = "rollback"    //协商冲突，通知礼貌方回滚自己的 offer
+
+	//没有配置呼叫超时时，按 offer 登记的会话等待 answer 的时间
+	defaultOfferTimeout = 30 * time.Second
+)
+
+// 以下方法只能在房间协程中调用
+
+// 转发 offer/renegotiate，登记会话并处理双方同时发出 offer 的冲突
+// 冲突中失败的 offer 不转发，发送方会收到 rollback
+func (r *Room) forwardOffer(msgType string, data *msg.Relay, signal any, raw string) error {
+	_, existed := r.sessions[data.SessionId]
+	s, ok, err := r.trackOffer(msgType, data)
+	if err != nil || !ok {
+		return err
+	}
+	if raw, _, err = r.filterSignal(msgType, signal, raw); err != nil {
+		//被媒体策略拒绝的 offer 不留下会话
+		if s != nil && !existed {
+			r.removeSession(s)
+		}
+		return err
+	}
+	if r.resolveGlare(s, msgType, data) {
+		return r.relaySignal(msgType, data, raw)
+	}
+	return nil
+}
+
+// 转发 answer/candidate，被过滤的 candidate 直接丢弃，不返回错误
+func (r *Room) forwardSignal(msgType string, data *msg.Relay, signal any, raw string) error {
+	if msgType == Answer {
+		if err := r.trackAnswer(data); err != nil {
+			return err
+		}
+	}
+	raw, ok, err := r.filterSignal(msgType, signal, raw)
+	if err != nil || !ok {
+		return err
+	}
+	return r.relaySignal(msgType, data, raw)
+}
+
+// 登记 offer/renegotiate 所在的会话
+// 旧客户端不走 invite 流程，直接发 offer，双方都不在通话中时按 offer 中的 session_id 登记会话
+// 已经在通话中的用户之间的 offer 不登记，直接转发，每个用户最多只有一个这样登记的会话
+// 双方同时用不同的会话呼叫对方时以先登记的会话为准，后到的 offer 不再转发，返回 false
+func (r *Room) trackOffer(msgType string, data *msg.Relay) (*Session, bool, error) {
+	if len(data.SessionId) == 0 {
+		return nil, true, nil
+	}
+
+	if s, ok := r.sessions[data.SessionId]; ok {
+		if !s.Has(data.From) || !s.Has(data.To) {
+			return nil, false, msg.NewError(msg.ErrCodeForbidden, "不是会话 [%s] 的参与方", data.SessionId)
+		}
+		if msgType == Renegotiate && (s.State != SessionAccepted || !s.negotiated) {
+			return nil, false, msg.NewError(msg.ErrCodeConflict, "会话 [%s] 还没有完成协商", data.SessionId)
+		}
+		return s, true, nil
+	}
+	if msgType == Renegotiate {
+		return nil, false, msg.NewError(msg.ErrCodeNotFound, "会话 [%s] 不存在", data.SessionId)
+	}
+
+	if s := r.negotiating(data.To, data.From); s != nil {
+		r.rollback(data.From, data.SessionId, s)
+		return nil, false, nil
+	}
+
+	if r.Exists(data.From) && r.Exists(data.To) && !r.busy(data.From) && !r.busy(data.To) {
+		s := newSession(data.SessionId, data.From, data.To, data.Type, SessionAccepted)
+		r.sessions[s.Id] = s
+		r.expireOffer(s)
+		return s, true, nil
+	}
+	return nil, true, nil
+}
+
+// 按 offer 登记的会话在呼叫超时内没有收到 answer 时移除
+// 旧客户端不认识会话消息，移除时不发挂断
+func (r *Room) expireOffer(s *Session) {
+	timeout := r.inviteTimeout
+	if timeout <= 0 {
+		timeout = defaultOfferTimeout
+	}
+	id := s.Id
+	s.timer = time.AfterFunc(timeout, func() {
+		r.Post(func() {
+			if s, ok := r.sessions[id]; ok && !s.negotiated {
+				logger.Log.Infof("房间 [%s] 会话 [%s] 没有收到answer，移除", r.Id, id)
+				r.removeSession(s)
+			}
+		})
+	})
+}
+
+// from 发给 to 的、还在等待 answer 的会话
+func (r *Room) negotiating(from string, to string) *Session {
+	for _, s := range r.sessions {
+		if !s.Terminal() && s.offerFrom == from && s.Has(to) {
+			return s
+		}
+	}
+	return nil
+}
+
+// 处理同一会话中双方同时发出的 offer，不礼貌方的 offer 胜出
+// 返回 false 表示 offer 被丢弃，不再转发
+func (r *Room) resolveGlare(s *Session, msgType string, data *msg.Relay) bool {
+	if s == nil {
+		return true
+	}
+
+	if len(s.offerFrom) > 0 && s.offerFrom != data.From {
+		if data.From == s.Polite {
+			r.rollback(data.From, s.Id, s)
+			return false
+		}
+		//礼貌方的 offer 已经转发，通知礼貌方回滚后再转发不礼貌方的 offer
+		r.rollback(s.offerFrom, s.Id, s)
+	}
+
+	s.offerFrom = data.From
+	if msgType == Renegotiate {
+		s.renegotiations++
+	}
+	return true
+}
+
+// answer 完成一次协商，发出 offer 的一方不能回复
+func (r *Room) trackAnswer(data *msg.Relay) error {
+	s, ok := r.sessions[data.SessionId]
+	if !ok {
+		return nil
+	}
+	if !s.Has(data.From) || !s.Has(data.To) {
+		return msg.NewError(msg.ErrCodeForbidden, "不是会话 [%s] 的参与方", data.SessionId)
+	}
+	if s.offerFrom == data.From {
+		return msg.NewError(msg.ErrCodeConflict, "会话 [%s] 没有需要回复的offer", s.Id)
+	}
+	s.offerFrom = ""
+	s.negotiated = true
+	//按 offer 登记的会话完成协商后不再过期，invite 会话的超时在接听时已经停止
+	if s.State == SessionAccepted {
+		s.stopTimer()
+	}
+	return nil
+}
+
+// 通知协商冲突中失败的一方回滚自己的 offer
+// sessionId 是被丢弃的 offer 所在的会话，s 是胜出的会话
+func (r *Room) rollback(userId string, sessionId string, s *Session) {
+	logger.Log.Infof("房间 [%s] 会话 [%s] 协商冲突，用户 [%s] 回滚", r.Id, s.Id, userId)
+
+	user, ok := r.users[userId]
+	if !ok {
+		return
+	}
+	user.conn.Send(utils.Marshal(msg.Msg{
+		Type: Rollback,
+		Data: map[string]any{
+			"room_id": r.Id,
+			//被丢弃的 offer 所在的会话
+			"session_id": sessionId,
+			//继续协商的会话
+			"active_session_id": s.Id,
+			//胜出的一方
+			"winner": s.Peer(userId),
+			"polite": s.Polite,
+		},
+	}))
+}
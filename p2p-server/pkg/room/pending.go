@@ -0,0 +1,159 @@
+package room
+
+import (
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/metrics"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+const (
+	DeliveryFailed = "deliveryFailed" //转发的消息没有送达
+
+	defaultPendingSize = 64
+	defaultPendingTtl  = 30 * time.Second
+	//最多为多少个不在房间的用户缓存消息
+	maxPendingUsers = 256
+)
+
+// 消息没有送达的原因
+const (
+	DeliveryExpired  = "expired"  //接收方在有效期内没有加入
+	DeliveryOverflow = "overflow" //接收方的队列已满，丢弃最旧的消息
+	DeliveryLeft     = "left"     //接收方离开了房间
+)
+
+// 等待投递的消息
+type pendingMsg struct {
+	data string
+	//发送方，系统消息为空，没有送达时不通知
+	from      string
+	msgType   string
+	sessionId string
+	expires   time.Time
+}
+
+// 以下方法只能在房间协程中调用
+
+// 转发用户之间的信令，接收方还没加入或正在重连时放入待投递队列
+func (r *Room) relaySignal(msgType string, data *msg.Relay, raw string) error {
+	if user, ok := r.users[data.To]; ok && !user.reconnecting() {
+		return user.conn.Send(raw)
+	}
+	if _, ok := r.pending[data.To]; !ok && !r.Exists(data.To) && len(r.pending) >= maxPendingUsers {
+		return msg.NewError(msg.ErrCodeNotFound, "用户 [%s] 不存在", data.To)
+	}
+
+	r.enqueue(data.To, &pendingMsg{
+		data:      raw,
+		from:      data.From,
+		msgType:   msgType,
+		sessionId: data.SessionId,
+	})
+	return nil
+}
+
+// 放入接收方的队列，超过上限丢弃最旧的
+func (r *Room) enqueue(to string, m *pendingMsg) {
+	m.expires = time.Now().Add(r.pendingTtl)
+
+	queue := r.pending[to]
+	if len(queue) >= r.pendingSize {
+		r.deliveryFailed(to, queue[0], DeliveryOverflow)
+		queue = queue[1:]
+	}
+	r.pending[to] = append(queue, m)
+
+	if r.pendingTimer == nil {
+		r.schedulePending(r.pendingTtl)
+	}
+}
+
+// 接收方加入或恢复连接，按顺序投递队列中的消息
+func (r *Room) flushPending(user *User) {
+	queue := r.pending[user.info.Id]
+	if len(queue) == 0 {
+		return
+	}
+	delete(r.pending, user.info.Id)
+
+	for _, m := range queue {
+		user.conn.Send(m.data)
+	}
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 投递缓存的 %d 条消息", r.Id, user.info.Id, len(queue))
+}
+
+// 接收方离开房间，队列中的消息不再投递
+func (r *Room) dropPending(userId string) {
+	for _, m := range r.pending[userId] {
+		r.deliveryFailed(userId, m, DeliveryLeft)
+	}
+	delete(r.pending, userId)
+}
+
+func (r *Room) schedulePending(d time.Duration) {
+	r.pendingTimer = time.AfterFunc(d, func() {
+		r.Post(r.expirePending)
+	})
+}
+
+// 移除过期的消息并通知发送方，还有未过期的消息时等到最早的过期时间再检查
+func (r *Room) expirePending() {
+	r.pendingTimer = nil
+
+	now := time.Now()
+	var next time.Time
+	for to, queue := range r.pending {
+		i := 0
+		for ; i < len(queue) && !queue[i].expires.After(now); i++ {
+			r.deliveryFailed(to, queue[i], DeliveryExpired)
+		}
+		queue = queue[i:]
+		if len(queue) == 0 {
+			delete(r.pending, to)
+			continue
+		}
+		r.pending[to] = queue
+		if next.IsZero() || queue[0].expires.Before(next) {
+			next = queue[0].expires
+		}
+	}
+
+	if !next.IsZero() {
+		r.schedulePending(next.Sub(now))
+	}
+}
+
+// 通知发送方消息没有送达
+func (r *Room) deliveryFailed(to string, m *pendingMsg, reason string) {
+	if len(m.from) == 0 {
+		return
+	}
+	metrics.RelayFailures.WithLabelValues(m.msgType).Inc()
+
+	sender, ok := r.users[m.from]
+	if !ok || sender.reconnecting() {
+		return
+	}
+	sender.conn.Send(utils.Marshal(msg.Msg{
+		Type: DeliveryFailed,
+		Data: map[string]any{
+			"room_id":    r.Id,
+			"to":         to,
+			"type":       m.msgType,
+			"session_id": m.sessionId,
+			"reason":     reason,
+		},
+	}))
+}
+
+// 关闭房间时停止过期检查
+func (r *Room) stopPending() {
+	if r.pendingTimer != nil {
+		r.pendingTimer.Stop()
+		r.pendingTimer = nil
+	}
+	r.pending = make(map[string][]*pendingMsg)
+}
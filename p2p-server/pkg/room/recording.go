@@ -0,0 +1,97 @@
+package room
+
+import (
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/recorder"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	StartRecording = "startRecording" //开始录制
+	StopRecording  = "stopRecording"  //停止录制
+
+	recorderName = "录制"
+)
+
+// 以下方法只能在房间协程中调用
+
+// 开始录制，录制端以观众身份加入房间，所有人都会收到通知
+func (r *Room) startRecording(from string, api *webrtc.API, cfg recorder.Config) error {
+	if _, _, err := r.checkModerator(from, "", RoleModerator); err != nil {
+		return err
+	}
+	if r.recorder != nil {
+		return msg.NewError(msg.ErrCodeConflict, "房间 [%s] 正在录制", r.Id)
+	}
+
+	kinds, err := r.serverKinds(cfg.Kinds)
+	if err != nil {
+		return err
+	}
+	cfg.Kinds = kinds
+
+	rec, err := recorder.New(r.Id, from, api, cfg, r.serverRelay(), r.sfu)
+	if err != nil {
+		return msg.NewError(msg.ErrCodeInternal, "创建录制失败 %v", err)
+	}
+
+	r.recorder = rec
+	r.addServerUser(rec.UserId, recorderName, rec)
+	rec.Start()
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 开始录制 %s", r.Id, from, rec.Id)
+
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: StartRecording,
+		Data: map[string]any{
+			"room_id":      r.Id,
+			"recording_id": rec.Id,
+			"recorder":     rec.UserId,
+			"by":           from,
+		},
+	}), nil)
+	r.notifyUsersUpdate()
+
+	return nil
+}
+
+// 停止录制
+func (r *Room) stopRecording(from string) error {
+	if _, _, err := r.checkModerator(from, "", RoleModerator); err != nil {
+		return err
+	}
+	if r.recorder == nil {
+		return msg.NewError(msg.ErrCodeConflict, "房间 [%s] 没有在录制", r.Id)
+	}
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 停止录制 %s", r.Id, from, r.recorder.Id)
+
+	r.leave(r.recorder.UserId, r.recorder)
+	return nil
+}
+
+// 录制端离开房间后结束录制并通知所有人
+func (r *Room) endRecording() {
+	rec := r.recorder
+	r.recorder = nil
+
+	go func() {
+		path, err := rec.Stop()
+		if err != nil {
+			logger.Log.Errorf("房间 [%s] 录制 %s 结束失败 %v", rec.RoomId, rec.Id, err)
+			return
+		}
+		logger.Log.Infof("房间 [%s] 录制 %s 已结束 %s", rec.RoomId, rec.Id, path)
+	}()
+
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: StopRecording,
+		Data: map[string]any{
+			"room_id":      r.Id,
+			"recording_id": rec.Id,
+		},
+	}), nil)
+}
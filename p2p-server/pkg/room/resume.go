@@ -0,0 +1,66 @@
+package room
+
+import (
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// 以下方法只能在房间协程中调用
+
+// 连接断开，在宽限期内保留用户等待重连，正常关闭的连接直接离开房间
+func (r *Room) disconnect(userId string, conn Conn, code int) {
+	user, ok := r.users[userId]
+	if !ok || user.conn != conn {
+		return
+	}
+
+	if r.resumeGrace <= 0 || code == websocket.CloseNormalClosure {
+		r.leave(userId, conn)
+		return
+	}
+
+	user.info.State = UserReconnecting
+
+	token := user.resumeToken
+	user.graceTimer = time.AfterFunc(r.resumeGrace, func() {
+		r.Post(func() {
+			r.expireReconnect(userId, token)
+		})
+	})
+
+	logger.Log.Infof("用户 [%s] 断线，等待重连", userId)
+
+	r.notifyUsersUpdate()
+}
+
+// 宽限期结束仍未重连，离开房间
+func (r *Room) expireReconnect(userId string, token string) {
+	user, ok := r.users[userId]
+	if !ok || !user.reconnecting() || user.resumeToken != token {
+		return
+	}
+
+	logger.Log.Infof("用户 [%s] 重连超时", userId)
+
+	r.leave(userId, user.conn)
+}
+
+// 用户使用新连接恢复，重放断线期间缓存的消息
+func (r *Room) resume(user *User, conn Conn) {
+	user.stopGraceTimer()
+
+	user.conn = conn
+	user.info.State = UserOnline
+	user.resumeToken = utils.NewId()
+
+	r.replyJoin(user, true)
+
+	logger.Log.Infof("用户 [%s] 恢复连接", user.info.Id)
+
+	r.flushPending(user)
+
+	r.notifyUsersUpdate()
+}
@@ -1,14 +1,21 @@
 package room
 
 import (
-	"strings"
+	"crypto/subtle"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
 	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/ice"
 	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/media"
 	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/recorder"
+	"webrtc/p2p-server/pkg/serverpeer"
+	"webrtc/p2p-server/pkg/sfu"
 	"webrtc/p2p-server/pkg/utils"
-	"webrtc/p2p-server/pkg/ws"
-
-	"github.com/gin-gonic/gin"
 )
 
 const (
@@ -19,8 +26,31 @@ const (
 	HangUp         = "hangUp"         //挂断
 	LeaveRoom      = "leaveRoom"      //离开房间
 	UpdateUserList = "updateUserList" //更新房间用户列表
+	Invite         = "invite"         //发起呼叫
+	Ringing        = "ringing"        //被叫振铃
+	Accept         = "accept"         //被叫接听
+	Reject         = "reject"         //被叫拒绝
+	Busy           = "busy"           //被叫忙
+	Kick           = "kick"           //踢出用户
+	MuteRequest    = "muteRequest"    //请求用户静音
+	LockRoom       = "lockRoom"       //锁定/解锁房间
+	TransferOwner  = "transferOwner"  //转让房主
+	SetRole        = "setRole"        //设置用户角色
 )
 
+// ErrRoomClosed 房间已关闭，调用方需要重新获取房间
+var ErrRoomClosed = errors.New("room closed")
+
+// RoomHooks 房间事件回调，在房间协程中调用
+type RoomHooks struct {
+	//房间变空关闭
+	OnEmpty func(r *Room)
+	//用户离开房间
+	OnLeave func(r *Room, userId string, conn Conn)
+}
+
+// Room 房间
+// 房间的所有状态只在房间自己的协程中读写，外部通过 Do/Post 提交命令
 type Room struct {
 	//房间ID
 	Id string
@@ -28,242 +58,417 @@ type Room struct {
 	users map[string]*User
 	//所有会话
 	sessions map[string]*Session
+	//进行中的多人通话
+	groupCall *GroupCall
+	//SFU 模式下转发媒体，P2P 模式为 nil
+	sfu *sfu.SFU
+	//正在进行的录制
+	recorder *recorder.Recorder
+	//WHEP 观看端
+	watchers map[string]*serverpeer.Peer
+	//命令队列
+	cmds chan func()
+	//Post 提交的命令，按提交顺序执行
+	postMu sync.Mutex
+	posted []func()
+	//有新的 Post 命令
+	wake chan struct{}
+	//房间关闭信号
+	closed chan struct{}
+	//房间是否已停止，只在房间协程中访问
+	stopped bool
+	//房间事件回调
+	hooks RoomHooks
+	//呼叫超时
+	inviteTimeout time.Duration
+	//断线重连宽限期
+	resumeGrace time.Duration
+	//每个接收方最多缓存的待投递消息数
+	pendingSize int
+	//待投递消息的有效期
+	pendingTtl time.Duration
+	//发给断线或还没加入的用户的消息，按接收方缓存
+	pending map[string][]*pendingMsg
+	//待投递消息的过期检查
+	pendingTimer *time.Timer
+	//最多参与人数(不含观众)，0表示不限制
+	maxUsers int
+	//是否锁定，锁定后不能加入新用户
+	locked bool
+	//访问控制
+	opts RoomOptions
+	//签发邀请时写入的随机值，邀请只对这个房间实例有效
+	inviteNonce string
+	//加入房间时下发的 ICE 配置
+	ice *ice.Provider
+	//转发 offer/answer 时执行的媒体策略
+	media media.Policy
+	//房间变空后延迟关闭的定时器
+	emptyTimer *time.Timer
+	//用户加入序号
+	seq uint64
 }
 
-func (r *Room) GetUser(id string) *User {
-	return r.users[id]
+func NewRoom(id string, cfg *config.Config, hooks RoomHooks) *Room {
+	r := &Room{
+		Id:            id,
+		users:         make(map[string]*User),
+		sessions:      make(map[string]*Session),
+		watchers:      make(map[string]*serverpeer.Peer),
+		cmds:          make(chan func()),
+		wake:          make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		hooks:         hooks,
+		maxUsers:      cfg.Room.MaxParticipants,
+		inviteTimeout: time.Duration(cfg.Room.InviteTimeout) * time.Second,
+		resumeGrace:   time.Duration(cfg.Room.ResumeGrace) * time.Second,
+		pendingSize:   cfg.Room.ResumeBuffer,
+		pendingTtl:    time.Duration(cfg.Room.PendingTtl) * time.Second,
+		pending:       make(map[string][]*pendingMsg),
+		ice:           ice.NewProvider(cfg),
+		media:         media.NewPolicy(cfg),
+		inviteNonce:   utils.NewId(),
+	}
+	if r.pendingSize <= 0 {
+		r.pendingSize = defaultPendingSize
+	}
+	if r.pendingTtl <= 0 {
+		r.pendingTtl = defaultPendingTtl
+	}
+
+	go r.run()
+
+	return r
 }
 
-func (r *Room) AddUser(u *User) {
-	r.users[u.info.Id] = u
+func (r *Room) run() {
+	for {
+		select {
+		case cmd := <-r.cmds:
+			r.exec(cmd)
+		case <-r.wake:
+			r.runPosted()
+		case <-r.closed:
+			return
+		}
+	}
 }
 
-func (r *Room) RemoveUser(id string) {
-	delete(r.users, id)
+// 执行命令，命令 panic 不影响房间协程
+func (r *Room) exec(cmd func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Log.Errorf("房间 [%s] 命令执行panic %v\n%s", r.Id, err, debug.Stack())
+		}
+	}()
+	cmd()
 }
 
-func (r *Room) Exists(id string) bool {
-	_, ok := r.users[id]
-	return ok
+// Do 在房间协程中执行 fn 并等待完成
+// 不能在房间协程中调用，否则会死锁
+func (r *Room) Do(fn func()) error {
+	var err error
+	done := make(chan struct{})
+
+	cmd := func() {
+		defer close(done)
+		if r.stopped {
+			err = ErrRoomClosed
+			return
+		}
+		fn()
+	}
+
+	select {
+	case r.cmds <- cmd:
+		<-done
+		return err
+	case <-r.closed:
+		return ErrRoomClosed
+	}
 }
 
-func NewRoom(id string) *Room {
-	return &Room{
-		Id:       id,
-		users:    make(map[string]*User),
-		sessions: make(map[string]*Session),
+// Post 提交命令到房间协程，不等待执行结果
+// 同一房间 Post 的命令按提交顺序执行，房间关闭后的命令被丢弃
+func (r *Room) Post(fn func()) {
+	r.postMu.Lock()
+	r.posted = append(r.posted, fn)
+	r.postMu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
 	}
 }
 
-type RoomManager struct {
-	rooms map[string]*Room
-	cfg   *config.Config
+// 按顺序执行 Post 提交的命令
+func (r *Room) runPosted() {
+	r.postMu.Lock()
+	cmds := r.posted
+	r.posted = nil
+	r.postMu.Unlock()
+
+	for _, cmd := range cmds {
+		if r.stopped {
+			return
+		}
+		r.exec(cmd)
+	}
 }
 
-func NewRoomManager(cfg *config.Config) *RoomManager {
-	return &RoomManager{
-		rooms: make(map[string]*Room),
-		cfg:   cfg,
+// 关闭房间，只能在房间协程中调用
+func (r *Room) stop() {
+	if r.stopped {
+		return
 	}
+	r.stopped = true
+	close(r.closed)
 }
 
-func (rm *RoomManager) AddRoom(id string) *Room {
-	rm.rooms[id] = NewRoom(id)
-	return rm.rooms[id]
+// 房间没有用户时关闭房间，设置了保留时间的房间延迟关闭
+func (r *Room) closeIfEmpty() {
+	if len(r.users) > 0 || r.stopped {
+		return
+	}
+
+	if r.opts.KeepEmpty <= 0 {
+		r.close()
+		return
+	}
+
+	if r.emptyTimer == nil {
+		r.emptyTimer = time.AfterFunc(r.opts.KeepEmpty, func() {
+			r.Post(func() {
+				r.emptyTimer = nil
+				if len(r.users) == 0 {
+					r.close()
+				}
+			})
+		})
+	}
 }
 
-func (rm *RoomManager) RemoveRoom(id string) {
-	delete(rm.rooms, id)
+// 关闭房间并通知 RoomManager
+func (r *Room) close() {
+	if r.stopped {
+		return
+	}
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
+	}
+	r.stop()
+	r.stopPending()
+	if r.recorder != nil {
+		r.endRecording()
+	}
+	if r.sfu != nil {
+		go r.sfu.Close()
+	}
+	if r.hooks.OnEmpty != nil {
+		r.hooks.OnEmpty(r)
+	}
 }
 
-func (rm *RoomManager) GetRoom(id string) *Room {
-	return rm.rooms[id]
+// 以下方法只能在房间协程中调用
+
+func (r *Room) GetUser(id string) *User {
+	return r.users[id]
+}
+
+func (r *Room) AddUser(u *User) {
+	r.users[u.info.Id] = u
 }
 
-func (rm *RoomManager) Exists(id string) bool {
-	_, ok := rm.rooms[id]
+func (r *Room) RemoveUser(id string) {
+	delete(r.users, id)
+}
+
+func (r *Room) Exists(id string) bool {
+	_, ok := r.users[id]
 	return ok
 }
 
-func (rm *RoomManager) HandleMsg(conn *ws.WsConn, c *gin.Context) {
-	conn.On("message", func(message []byte) {
-		req := utils.Unmarshal(string(message))
+// 通知所有的用户更新
+func (r *Room) notifyUsersUpdate() {
+	//更新信息
+	infos := make([]UserInfo, 0, len(r.users))
+	for _, user := range r.users {
+		infos = append(infos, user.Info())
+	}
 
-		d, ok := req["data"]
-		if !ok {
-			logger.Log.Errorf("没有data")
-			return
-		}
-		t, ok := req["type"]
-		if !ok {
-			logger.Log.Errorf("没有type")
-			return
-		}
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: UpdateUserList,
+		Data: infos,
+	}), nil)
+}
 
-		logger.Log.Infof("收到的请求 %v", req)
-
-		dd := d.(map[string]any)
-		tt := t.(string)
-
-		switch tt {
-		case JoinRoom:
-			rm.onJoinRoom(conn, dd)
-		case Offer:
-			fallthrough
-		case Answer:
-			fallthrough
-		case Candidate:
-			rm.onCandidate(conn, dd, req)
-		case HangUp:
-			rm.onHangUp(conn, dd)
-		default:
-			logger.Log.Errorf("未知的请求 %v", req)
+// 发送消息给房间内除 except 外的所有用户
+func (r *Room) broadcast(data string, except *User) {
+	for _, user := range r.users {
+		if user != except {
+			user.conn.Send(data)
 		}
-	})
+	}
+}
 
-	conn.On("close", func(message []byte) {
-		rm.onClose(conn)
-	})
+// JoinReply 加入房间的回复
+type JoinReply struct {
+	RoomId string `json:"room_id"`
+	Id     string `json:"id"`
+	//角色
+	Role string `json:"role"`
+	//断线重连凭证，重连时在 joinRoom 中带上
+	ResumeToken string `json:"resume_token"`
+	//是否恢复了之前的连接
+	Resumed bool `json:"resumed"`
+	//STUN/TURN 配置，可以直接用于 RTCPeerConnection
+	Ice *ice.Config `json:"ice"`
 }
 
-func (rm *RoomManager) onJoinRoom(conn *ws.WsConn, data map[string]any) {
-	var room *Room
-	var user *User
+// 回复加入房间的结果
+func (r *Room) replyJoin(user *User, resumed bool) {
+	user.conn.Send(utils.Marshal(msg.Msg{
+		Type: JoinRoom,
+		Data: JoinReply{
+			RoomId:      r.Id,
+			Id:          user.info.Id,
+			Role:        user.info.Role,
+			ResumeToken: user.resumeToken,
+			Resumed:     resumed,
+			Ice:         r.ice.Config(user.info.Id, r.opts.IcePolicy),
+		},
+	}))
+}
 
-	userId := data["id"].(string)
-	userName := data["name"].(string)
-	roomId := data["room_id"].(string)
+// 用户加入房间，连接已关闭时返回 false
+// 带有效 resumeToken 时恢复断线前的用户
+func (r *Room) join(user *User, resumeToken string, password string, invite *auth.Invite) (bool, error) {
+	if user.conn.IsClosed() {
+		return false, nil
+	}
 
-	if !rm.Exists(roomId) {
-		room = rm.AddRoom(roomId)
-	} else {
-		room = rm.GetRoom(roomId)
+	old, exists := r.users[user.info.Id]
+	if exists && len(resumeToken) > 0 {
+		if subtle.ConstantTimeCompare([]byte(old.resumeToken), []byte(resumeToken)) != 1 {
+			return false, msg.NewError(msg.ErrCodeForbidden, "resume_token无效")
+		}
+		r.resume(old, user.conn)
+		return true, nil
+	}
+	//已有的用户(包括断线重连宽限期内的)只能通过 resume_token 恢复，不能被其他连接顶替
+	if exists && old.conn != user.conn {
+		return false, msg.NewError(msg.ErrCodeConflict, "用户 [%s] 已在房间中", user.info.Id)
+	}
+	if r.locked && !exists {
+		return false, msg.NewError(msg.ErrCodeRoomLocked, "房间已锁定")
+	}
+	if err := r.admit(user, password, invite); err != nil {
+		return false, err
+	}
+	if err := r.checkCapacity(user); err != nil {
+		return false, err
+	}
+	if exists {
+		old.stopGraceTimer()
+		if user.info.Role != RoleViewer {
+			user.info.Role = old.info.Role
+		}
 	}
 
-	if !room.Exists(userId) {
-		user = &User{
-			info: UserInfo{
-				Id:   userId,
-				Name: userName,
-			},
-			conn: conn,
+	//同一个连接在房间内只保留一个用户
+	for id, u := range r.users {
+		if u.conn == user.conn && id != user.info.Id {
+			r.endUserSessions(id)
+			r.RemoveUser(id)
+			if u.info.Role == RoleOwner {
+				r.electOwner()
+			}
 		}
-	} else {
-		user = room.GetUser(userId)
 	}
 
-	//添加用到房间
-	room.AddUser(user)
+	user.info.State = UserOnline
+	user.resumeToken = utils.NewId()
+	r.seq++
+	user.seq = r.seq
+	if len(user.info.Role) == 0 {
+		user.info.Role = RoleParticipant
+	}
 
-	rm.notifyUsersUpdate(conn, room.users)
-}
+	r.AddUser(user)
 
-// 通知所有的用户更新
-func (rm *RoomManager) notifyUsersUpdate(conn *ws.WsConn, users map[string]*User) {
-	//更新信息
-	var infos []UserInfo
-	for _, user := range users {
-		infos = append(infos, user.info)
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
 	}
 
-	//创建发送消息数据结构
-	data := utils.Marshal(msg.Msg{
-		Type: UpdateUserList,
-		Data: infos,
-	})
-
-	//迭代所有的User
-	for _, user := range users {
-		user.conn.Send(data)
+	if user.info.Role != RoleViewer && r.owner() == nil {
+		r.setRole(user, RoleOwner)
 	}
-}
 
-func (rm *RoomManager) onCandidate(conn *ws.WsConn, data map[string]any, req map[string]any) {
-	to := data["to"].(string)
-	roomId := data["room_id"].(string)
-	room := rm.GetRoom(roomId)
+	r.replyJoin(user, false)
+
+	r.flushPending(user)
 
-	if user, ok := room.users[to]; !ok {
-		logger.Log.Errorf("用户不存在")
+	r.notifyUsersUpdate()
+
+	return true, nil
+}
+
+// 用户离开房间，只移除仍然绑定在 conn 上的用户
+func (r *Room) leave(userId string, conn Conn) {
+	user, ok := r.users[userId]
+	if !ok || user.conn != conn {
 		return
-	} else {
-		user.conn.Send(utils.Marshal(req))
 	}
-}
 
-func (rm *RoomManager) onHangUp(conn *ws.WsConn, data map[string]any) {
-	sessionID := data["session_id"].(string)
-	ids := strings.Split(sessionID, "-")
+	user.stopGraceTimer()
 
-	roomId := data["room_id"].(string)
-	room := rm.GetRoom(roomId)
+	r.endUserSessions(userId)
 
-	//根据Id查找User
-	if user, ok := room.users[ids[0]]; !ok {
-		logger.Log.Warnf("用户 [" + ids[0] + "] 没有找到")
-		return
-	} else {
-		//发送信息给目标User,即自己[0]
-		user.conn.Send(utils.Marshal(msg.Msg{
-			Type: HangUp,
-			Data: map[string]any{
-				//0表示自己 1表示对方
-				"to": ids[0],
-				//会话Id
-				"session_id": sessionID,
-			},
-		}))
-	}
-
-	//根据Id查找User
-	if user, ok := room.users[ids[1]]; !ok {
-		logger.Log.Warnf("用户 [" + ids[1] + "] 没有找到")
-		return
-	} else {
-		//发送信息给目标User,即对方[1]
-		user.conn.Send(utils.Marshal(msg.Msg{
-			Type: HangUp,
-			Data: map[string]any{
-				//0表示自己  1表示对方
-				"to": ids[1],
-				//会话Id
-				"session_id": sessionID,
-			},
-		}))
+	r.RemoveUser(userId)
+
+	if r.sfu != nil {
+		r.sfu.RemovePeer(userId)
 	}
-}
 
-func (rm *RoomManager) onClose(conn *ws.WsConn) {
-	var userId string
-	var roomId string
+	r.removeServerUser(userId)
 
-	for _, room := range rm.rooms {
-		for _, user := range room.users {
-			if user.conn == conn {
-				userId = user.info.Id
-				roomId = room.Id
-				break
-			}
-		}
+	r.dropPending(userId)
+
+	if r.hooks.OnLeave != nil {
+		r.hooks.OnLeave(r, userId, conn)
 	}
 
-	if len(roomId) == 0 {
-		logger.Log.Errorf("没有查找到退出的房间")
-		return
+	if user.info.Role == RoleOwner {
+		r.electOwner()
 	}
 
-	room := rm.GetRoom(roomId)
+	r.broadcast(utils.Marshal(msg.Msg{
+		Type: LeaveRoom,
+		Data: userId,
+	}), nil)
 
-	for _, user := range room.users {
-		if user.conn != conn {
-			user.conn.Send(utils.Marshal(msg.Msg{
-				Type: LeaveRoom,
-				Data: userId,
-			}))
-		}
+	r.notifyUsersUpdate()
+
+	//只剩录制端、观看端时让它们离开，房间变空
+	if u := r.onlyServerUser(); u != nil {
+		r.leave(u.info.Id, u.conn)
+		return
 	}
 
-	room.RemoveUser(userId)
+	r.closeIfEmpty()
+}
 
-	rm.notifyUsersUpdate(conn, room.users)
+// 转发消息给目标用户
+func (r *Room) relay(to string, data string) error {
+	user, ok := r.users[to]
+	if !ok {
+		return msg.NewError(msg.ErrCodeNotFound, "用户 [%s] 不存在", to)
+	}
+	if user.reconnecting() {
+		r.enqueue(to, &pendingMsg{data: data})
+		return nil
+	}
+	return user.conn.Send(data)
 }
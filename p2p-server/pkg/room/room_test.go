@@ -0,0 +1,759 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/serverpeer"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// 记录收到的消息的连接
+type fakeConn struct {
+	mu     sync.Mutex
+	msgs   []string
+	closed bool
+}
+
+func (c *fakeConn) Send(data string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("连接已关闭")
+	}
+	c.msgs = append(c.msgs, data)
+	return nil
+}
+
+func (c *fakeConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *fakeConn) RTT() time.Duration {
+	return 0
+}
+
+func (c *fakeConn) Identity() *auth.Identity {
+	return nil
+}
+
+func (c *fakeConn) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+}
+
+// 收到的指定类型的消息
+func (c *fakeConn) received(msgType string) []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []json.RawMessage
+	for _, m := range c.msgs {
+		var req msg.Request
+		if json.Unmarshal([]byte(m), &req) == nil && req.Type == msgType {
+			out = append(out, req.Data)
+		}
+	}
+	return out
+}
+
+func newTestManager() *RoomManager {
+	return NewRoomManager(&config.Config{})
+}
+
+func dispatch(t *testing.T, rm *RoomManager, conn Conn, msgType string, data any) {
+	t.Helper()
+	message, err := json.Marshal(msg.Msg{Type: msgType, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.router.Dispatch(conn, message)
+}
+
+// 模拟 WebSocket 正常关闭
+func disconnect(rm *RoomManager, conn *fakeConn) {
+	conn.close()
+	rm.onClose(conn, websocket.CloseNormalClosure)
+	rm.router.ConnClosed(conn)
+}
+
+func userIds(t *testing.T, rm *RoomManager, roomId string) []string {
+	t.Helper()
+	detail, err := rm.RoomDetail(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(detail.Users))
+	for _, u := range detail.Users {
+		ids = append(ids, u.Id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestConcurrentJoinLeaveRelay(t *testing.T) {
+	const n = 20
+	const roomId = "room"
+	rm := newTestManager()
+
+	conns := make([]*fakeConn, n)
+	ids := make([]string, n)
+	for i := range conns {
+		conns[i] = &fakeConn{}
+		ids[i] = fmt.Sprintf("user-%02d", i)
+	}
+
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatch(t, rm, conns[i], JoinRoom, msg.JoinRoom{Id: ids[i], Name: ids[i], RoomId: roomId})
+		}()
+	}
+	wg.Wait()
+
+	if got := userIds(t, rm, roomId); !slices.Equal(got, ids) {
+		t.Fatalf("加入后用户列表 %v，期望 %v", got, ids)
+	}
+
+	//前一半用户离开，同时所有用户互相发送 candidate
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range conns {
+				if j == i {
+					continue
+				}
+				dispatch(t, rm, conns[i], Candidate, msg.Candidate{
+					Relay: msg.Relay{
+						To:        ids[j],
+						From:      ids[i],
+						SessionId: ids[i] + "-" + ids[j],
+						RoomId:    roomId,
+					},
+					Candidate: &msg.IceCandidate{Candidate: "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host"},
+				})
+			}
+			if i < n/2 {
+				disconnect(rm, conns[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	remain := ids[n/2:]
+	if got := userIds(t, rm, roomId); !slices.Equal(got, remain) {
+		t.Fatalf("离开后用户列表 %v，期望 %v", got, remain)
+	}
+
+	//留下的用户最后收到的用户列表与房间一致
+	for i := n / 2; i < n; i++ {
+		lists := conns[i].received(UpdateUserList)
+		if len(lists) == 0 {
+			t.Fatalf("用户 [%s] 没有收到用户列表", ids[i])
+		}
+		var infos []UserInfo
+		if err := json.Unmarshal(lists[len(lists)-1], &infos); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(infos))
+		for _, info := range infos {
+			got = append(got, info.Id)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, remain) {
+			t.Fatalf("用户 [%s] 最后收到的用户列表 %v，期望 %v", ids[i], got, remain)
+		}
+	}
+
+	//留下的用户之间的 candidate 全部送达
+	for i := n / 2; i < n; i++ {
+		for j := n / 2; j < n; j++ {
+			if i == j {
+				continue
+			}
+			count := 0
+			for _, data := range conns[j].received(Candidate) {
+				var c msg.Candidate
+				if err := json.Unmarshal(data, &c); err != nil {
+					t.Fatal(err)
+				}
+				if c.From == ids[i] {
+					count++
+				}
+			}
+			if count != 1 {
+				t.Fatalf("用户 [%s] 收到 [%s] 的 candidate %d 次", ids[j], ids[i], count)
+			}
+		}
+	}
+
+	//全部离开后房间关闭
+	for i := n / 2; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			disconnect(rm, conns[i])
+		}()
+	}
+	wg.Wait()
+
+	if rm.Exists(roomId) {
+		t.Fatal("所有用户离开后房间没有关闭")
+	}
+}
+
+func TestPostOrder(t *testing.T) {
+	r := NewRoom("room", &config.Config{}, RoomHooks{})
+
+	const n = 1000
+	var got []int
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := range n {
+		r.Post(func() {
+			defer wg.Done()
+			got = append(got, i)
+		})
+	}
+	wg.Wait()
+
+	if err := r.Do(func() {
+		for i, v := range got {
+			if v != i {
+				t.Errorf("第 %d 个命令执行的是 %d", i, v)
+				return
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Do(r.close)
+	if err := r.Do(func() {}); err != ErrRoomClosed {
+		t.Fatalf("房间关闭后 Do 返回 %v", err)
+	}
+}
+
+func TestJoinWithOnlineId(t *testing.T) {
+	const roomId = "room"
+	rm := newTestManager()
+
+	owner := &fakeConn{}
+	dispatch(t, rm, owner, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: roomId})
+	replies := owner.received(JoinRoom)
+	if len(replies) != 1 {
+		t.Fatalf("加入房间回复 %d 次", len(replies))
+	}
+	var reply JoinReply
+	if err := json.Unmarshal(replies[0], &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	//其他连接使用在线用户的Id加入
+	other := &fakeConn{}
+	dispatch(t, rm, other, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: roomId})
+	errs := other.received(msg.Error)
+	if len(errs) != 1 {
+		t.Fatalf("顶替在线用户没有返回错误")
+	}
+	var e msg.ErrorData
+	if err := json.Unmarshal(errs[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != msg.ErrCodeConflict {
+		t.Fatalf("错误码 %d，期望 %d", e.Code, msg.ErrCodeConflict)
+	}
+	if _, err := rm.userOf(other, roomId); err == nil {
+		t.Fatal("被拒绝的连接仍然绑定在房间中")
+	}
+	if userId, err := rm.userOf(owner, roomId); err != nil || userId != "alice" {
+		t.Fatalf("原连接绑定的用户 %q %v", userId, err)
+	}
+
+	//带 resume_token 可以接管
+	dispatch(t, rm, other, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: roomId, ResumeToken: reply.ResumeToken})
+	if len(other.received(JoinRoom)) != 1 {
+		t.Fatal("带 resume_token 加入失败")
+	}
+	detail, err := rm.RoomDetail(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Users) != 1 || detail.Users[0].Role != RoleOwner {
+		t.Fatalf("恢复后的用户 %+v", detail.Users)
+	}
+}
+
+func TestGroupCallTimeout(t *testing.T) {
+	const roomId = "room"
+	cfg := &config.Config{}
+	cfg.Room.InviteTimeout = 1
+	rm := NewRoomManager(cfg)
+
+	conns := map[string]*fakeConn{}
+	for _, id := range []string{"a", "b", "c"} {
+		conns[id] = &fakeConn{}
+		dispatch(t, rm, conns[id], JoinRoom, msg.JoinRoom{Id: id, Name: id, RoomId: roomId})
+	}
+
+	dispatch(t, rm, conns["a"], StartGroupCall, msg.StartGroupCall{RoomId: roomId})
+	plans := conns["a"].received(StartGroupCall)
+	if len(plans) != 1 {
+		t.Fatalf("发起人收到 %d 个通话分配", len(plans))
+	}
+	var plan GroupCallPlan
+	if err := json.Unmarshal(plans[0], &plan); err != nil {
+		t.Fatal(err)
+	}
+
+	//只有 a 与 b 的连接建立
+	var connected string
+	for _, peer := range plan.OfferTo {
+		if peer.User == "b" {
+			connected = peer.SessionId
+		}
+	}
+	dispatch(t, rm, conns["a"], PairConnected, msg.PairConnected{RoomId: roomId, SessionId: connected})
+
+	time.Sleep(1500 * time.Millisecond)
+
+	detail, err := rm.RoomDetail(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Sessions) != 1 || detail.Sessions[0].SessionId != connected {
+		t.Fatalf("超时后的会话 %+v，期望只保留 %s", detail.Sessions, connected)
+	}
+	if len(conns["c"].received(HangUp)) != 2 {
+		t.Fatal("没有建立的连接超时后没有挂断")
+	}
+
+	//超时后多人通话已清除，a 和 b 挂断后可以重新发起
+	dispatch(t, rm, conns["a"], HangUp, msg.HangUp{From: "a", RoomId: roomId, SessionId: connected})
+	dispatch(t, rm, conns["b"], StartGroupCall, msg.StartGroupCall{RoomId: roomId})
+	if errs := conns["b"].received(msg.Error); len(errs) != 0 {
+		t.Fatalf("重新发起多人通话失败 %s", errs[0])
+	}
+}
+
+func TestGroupCallMemberLeave(t *testing.T) {
+	const roomId = "room"
+	rm := newTestManager()
+
+	conns := map[string]*fakeConn{}
+	for _, id := range []string{"a", "b"} {
+		conns[id] = &fakeConn{}
+		dispatch(t, rm, conns[id], JoinRoom, msg.JoinRoom{Id: id, Name: id, RoomId: roomId})
+	}
+	dispatch(t, rm, conns["a"], StartGroupCall, msg.StartGroupCall{RoomId: roomId})
+
+	//剩余参与者不足两人，通话结束
+	disconnect(rm, conns["b"])
+
+	c := &fakeConn{}
+	dispatch(t, rm, c, JoinRoom, msg.JoinRoom{Id: "c", Name: "c", RoomId: roomId})
+	dispatch(t, rm, c, StartGroupCall, msg.StartGroupCall{RoomId: roomId})
+	if errs := c.received(msg.Error); len(errs) != 0 {
+		t.Fatalf("参与者离开后重新发起多人通话失败 %s", errs[0])
+	}
+}
+
+// 等待连接收到指定类型的消息
+func waitFor(t *testing.T, conn *fakeConn, msgType string) json.RawMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if data := conn.received(msgType); len(data) > 0 {
+			return data[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("没有收到 %s", msgType)
+	return nil
+}
+
+func TestServerPeerSessions(t *testing.T) {
+	const roomId = "room"
+	cfg := &config.Config{}
+	cfg.Whep.Enable = true
+	rm := NewRoomManager(cfg)
+
+	conns := map[string]*fakeConn{}
+	for _, id := range []string{"a", "b"} {
+		conns[id] = &fakeConn{}
+		dispatch(t, rm, conns[id], JoinRoom, msg.JoinRoom{Id: id, Name: id, RoomId: roomId})
+	}
+
+	p, err := rm.Watch(nil, roomId, "", "", serverpeer.Config{}, serverpeer.Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//服务端用户给每个参与者一个会话
+	sessions := map[string]bool{}
+	for id, conn := range conns {
+		var offer msg.Offer
+		if err := json.Unmarshal(waitFor(t, conn, Offer), &offer); err != nil {
+			t.Fatal(err)
+		}
+		if offer.From != p.UserId || offer.To != id {
+			t.Fatalf("用户 [%s] 收到的 offer %+v", id, offer.Relay)
+		}
+		sessions[offer.SessionId] = true
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("服务端用户的会话 %v", sessions)
+	}
+
+	detail, err := rm.RoomDetail(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range detail.Sessions {
+		if !sessions[s.SessionId] {
+			t.Fatalf("房间中多出的会话 %+v", s.SessionInfo)
+		}
+	}
+	if len(detail.Sessions) != 2 {
+		t.Fatalf("房间中的会话 %d 个，期望 2 个", len(detail.Sessions))
+	}
+
+	//服务端会话不算忙线，也不算进行中的通话
+	dispatch(t, rm, conns["a"], Invite, msg.Invite{To: "b", RoomId: roomId, Type: "video"})
+	if errs := conns["a"].received(msg.Error); len(errs) != 0 {
+		t.Fatalf("呼叫失败 %s", errs[0])
+	}
+	waitFor(t, conns["b"], Invite)
+	if n := rm.ActiveSessions(); n != 0 {
+		t.Fatalf("进行中的通话 %d 个", n)
+	}
+
+	//服务端用户离开后会话结束，参与者不会收到挂断
+	if err := rm.Unwatch(p); err != nil {
+		t.Fatal(err)
+	}
+	detail, err = rm.RoomDetail(roomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Sessions) != 1 || sessions[detail.Sessions[0].SessionId] {
+		t.Fatalf("服务端用户离开后的会话 %+v", detail.Sessions)
+	}
+	if len(conns["a"].received(HangUp)) != 0 {
+		t.Fatal("服务端会话结束时参与者收到了挂断")
+	}
+}
+
+// 只有一个 m= 段的 SDP
+func testSdp(kind string, codec string) string {
+	return "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=" + kind + " 9 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\na=mid:0\r\na=rtpmap:96 " + codec + "\r\n"
+}
+
+func offer(from string, to string, sessionId string, sdp string) msg.Offer {
+	return msg.Offer{
+		Relay:       msg.Relay{From: from, To: to, SessionId: sessionId, RoomId: "room"},
+		Description: &msg.Description{Type: "offer", Sdp: sdp},
+	}
+}
+
+// 被媒体策略拒绝的 offer 不留下会话，不影响之后反方向的 offer
+func TestRejectedOfferSession(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Media.Kinds = []string{"audio"}
+	rm := NewRoomManager(cfg)
+
+	a, b := &fakeConn{}, &fakeConn{}
+	dispatch(t, rm, a, JoinRoom, msg.JoinRoom{Id: "a", Name: "a", RoomId: "room"})
+	dispatch(t, rm, b, JoinRoom, msg.JoinRoom{Id: "b", Name: "b", RoomId: "room"})
+
+	dispatch(t, rm, a, Offer, offer("a", "b", "s1", testSdp("video", "VP8/90000")))
+	if len(a.received(msg.Error)) != 1 || len(b.received(Offer)) != 0 {
+		t.Fatal("不允许的视频 offer 被转发")
+	}
+	detail, err := rm.RoomDetail("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Sessions) != 0 {
+		t.Fatalf("被拒绝的 offer 留下了会话 %+v", detail.Sessions)
+	}
+
+	dispatch(t, rm, b, Offer, offer("b", "a", "s2", testSdp("audio", "opus/48000/2")))
+	if len(b.received(Rollback)) != 0 || len(a.received(Offer)) != 1 {
+		t.Fatal("反方向的 offer 没有转发")
+	}
+}
+
+func sessionIds(t *testing.T, rm *RoomManager) []string {
+	t.Helper()
+	detail, err := rm.RoomDetail("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(detail.Sessions))
+	for _, s := range detail.Sessions {
+		ids = append(ids, s.SessionId)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// 旧客户端直接发 offer，只在双方都空闲时登记会话，没有 answer 的会话超时后移除
+func TestImplicitOfferSessions(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Room.InviteTimeout = 1
+	rm := NewRoomManager(cfg)
+
+	conns := map[string]*fakeConn{}
+	for _, id := range []string{"a", "b", "c"} {
+		conns[id] = &fakeConn{}
+		dispatch(t, rm, conns[id], JoinRoom, msg.JoinRoom{Id: id, Name: id, RoomId: "room"})
+	}
+
+	sdp := testSdp("audio", "opus/48000/2")
+	dispatch(t, rm, conns["a"], Offer, offer("a", "b", "s1", sdp))
+	//a 已经在会话中，发给 c 的 offer 直接转发，不再登记
+	dispatch(t, rm, conns["a"], Offer, offer("a", "c", "s2", sdp))
+	dispatch(t, rm, conns["c"], Offer, offer("c", "b", "s3", sdp))
+	if len(conns["b"].received(Offer)) != 2 || len(conns["c"].received(Offer)) != 1 {
+		t.Fatal("offer 没有全部转发")
+	}
+	if ids := sessionIds(t, rm); !slices.Equal(ids, []string{"s1"}) {
+		t.Fatalf("登记的会话 %v，期望只有 s1", ids)
+	}
+
+	//没有 answer 的会话超时后移除，反方向的 offer 不再回滚
+	time.Sleep(1500 * time.Millisecond)
+	if ids := sessionIds(t, rm); len(ids) != 0 {
+		t.Fatalf("超时后的会话 %v", ids)
+	}
+	dispatch(t, rm, conns["b"], Offer, offer("b", "a", "s4", sdp))
+	if len(conns["b"].received(Rollback)) != 0 || len(conns["a"].received(Offer)) != 1 {
+		t.Fatal("过期会话导致反方向的 offer 回滚")
+	}
+
+	//其他用户不能回复别人会话中的 offer
+	dispatch(t, rm, conns["c"], Answer, msg.Answer{
+		Relay:       msg.Relay{From: "c", To: "b", SessionId: "s4", RoomId: "room"},
+		Description: &msg.Description{Type: "answer", Sdp: sdp},
+	})
+	if code := errorCode(t, conns["c"]); code != msg.ErrCodeForbidden {
+		t.Fatalf("非参与方回复 answer 返回 %d", code)
+	}
+
+	//完成协商的会话不再过期
+	dispatch(t, rm, conns["a"], Answer, msg.Answer{
+		Relay:       msg.Relay{From: "a", To: "b", SessionId: "s4", RoomId: "room"},
+		Description: &msg.Description{Type: "answer", Sdp: sdp},
+	})
+	time.Sleep(1500 * time.Millisecond)
+	if ids := sessionIds(t, rm); !slices.Equal(ids, []string{"s4"}) {
+		t.Fatalf("完成协商后的会话 %v，期望 s4", ids)
+	}
+}
+
+// WHIP 推流端与 joinRoom 一样需要房间密码
+func TestIngestPassword(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Sfu.Enable = true
+	rm := NewRoomManager(cfg)
+
+	owner := &fakeConn{}
+	dispatch(t, rm, owner, CreateRoom, msg.CreateRoom{Id: "owner", Name: "owner", RoomId: "room", Password: "secret", Mode: ModeSFU})
+	if errs := owner.received(msg.Error); len(errs) != 0 {
+		t.Fatalf("创建房间失败 %s", errs[0])
+	}
+
+	for _, c := range []struct {
+		password string
+		code     int
+	}{
+		{"", msg.ErrCodeUnauthorized},
+		{"wrong", msg.ErrCodeUnauthorized},
+		{"secret", 0},
+	} {
+		_, err := rm.Ingest(&fakeConn{}, "room", "pub", "pub", c.password, "")
+		var e *msg.ErrorMsg
+		if c.code == 0 && err != nil || c.code != 0 && (!errors.As(err, &e) || e.Code != c.code) {
+			t.Fatalf("密码 %q 推流返回 %v", c.password, err)
+		}
+	}
+	if ids := userIds(t, rm, "room"); !slices.Equal(ids, []string{"owner", "pub"}) {
+		t.Fatalf("房间内的用户 %v", ids)
+	}
+}
+
+// WHEP 观看端与 joinRoom 一样需要房间密码或邀请
+func TestWatchAccess(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Whep.Enable = true
+	cfg.Room.InviteSecret = "invite-secret"
+	rm := NewRoomManager(cfg)
+
+	owner := &fakeConn{}
+	dispatch(t, rm, owner, CreateRoom, msg.CreateRoom{Id: "owner", Name: "owner", RoomId: "room", Password: "secret"})
+	dispatch(t, rm, &fakeConn{}, CreateRoom, msg.CreateRoom{Id: "owner", Name: "owner", RoomId: "private", InviteOnly: true})
+
+	for _, c := range []struct {
+		roomId   string
+		password string
+		code     int
+	}{
+		{"room", "", msg.ErrCodeUnauthorized},
+		{"room", "wrong", msg.ErrCodeUnauthorized},
+		{"private", "", msg.ErrCodeForbidden},
+		{"room", "secret", 0},
+	} {
+		p, err := rm.Watch(nil, c.roomId, c.password, "", serverpeer.Config{}, serverpeer.Handlers{})
+		var e *msg.ErrorMsg
+		if c.code == 0 && err != nil || c.code != 0 && (!errors.As(err, &e) || e.Code != c.code) {
+			t.Fatalf("房间 [%s] 密码 %q 观看返回 %v", c.roomId, c.password, err)
+		}
+		if p != nil {
+			rm.Unwatch(p)
+		}
+	}
+}
+
+// 最近一次收到的错误码，没有错误时为 0
+func errorCode(t *testing.T, conn *fakeConn) int {
+	t.Helper()
+	errs := conn.received(msg.Error)
+	if len(errs) == 0 {
+		return 0
+	}
+	var e msg.ErrorData
+	if err := json.Unmarshal(errs[len(errs)-1], &e); err != nil {
+		t.Fatal(err)
+	}
+	return e.Code
+}
+
+// 邀请只对签发它的房间实例有效
+func TestInviteBoundToRoom(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Room.InviteSecret = "invite-secret"
+	rm := NewRoomManager(cfg)
+
+	owner := &fakeConn{}
+	dispatch(t, rm, owner, CreateRoom, msg.CreateRoom{Id: "owner", Name: "owner", RoomId: "room", Password: "secret"})
+	dispatch(t, rm, owner, CreateInvite, msg.CreateInvite{RoomId: "room"})
+	replies := owner.received(CreateInvite)
+	if len(replies) != 1 {
+		t.Fatal("没有收到邀请")
+	}
+	var invite struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(replies[0], &invite); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := &fakeConn{}
+	dispatch(t, rm, guest, JoinRoom, msg.JoinRoom{Id: "guest", Name: "guest", RoomId: "room", InviteToken: invite.Token})
+	if code := errorCode(t, guest); code != 0 {
+		t.Fatalf("凭邀请加入失败 %d", code)
+	}
+
+	//房间关闭后不能凭邀请重建
+	disconnect(rm, guest)
+	disconnect(rm, owner)
+	if rm.Exists("room") {
+		t.Fatal("房间没有关闭")
+	}
+	late := &fakeConn{}
+	dispatch(t, rm, late, JoinRoom, msg.JoinRoom{Id: "guest", Name: "guest", RoomId: "room", InviteToken: invite.Token})
+	if code := errorCode(t, late); code != msg.ErrCodeNotFound || rm.Exists("room") {
+		t.Fatalf("房间关闭后凭邀请加入返回 %d", code)
+	}
+
+	//同Id的新房间不接受旧邀请
+	dispatch(t, rm, &fakeConn{}, CreateRoom, msg.CreateRoom{Id: "other", Name: "other", RoomId: "room", Password: "other"})
+	again := &fakeConn{}
+	dispatch(t, rm, again, JoinRoom, msg.JoinRoom{Id: "guest", Name: "guest", RoomId: "room", InviteToken: invite.Token})
+	if code := errorCode(t, again); code != msg.ErrCodeUnauthorized {
+		t.Fatalf("新房间凭旧邀请加入返回 %d", code)
+	}
+}
+
+// 断线重连宽限期内，其他连接不带 resume_token 不能使用该用户Id
+func TestJoinWithReconnectingId(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Room.ResumeGrace = 5
+	rm := NewRoomManager(cfg)
+
+	owner := &fakeConn{}
+	dispatch(t, rm, owner, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: "room"})
+	var reply JoinReply
+	if err := json.Unmarshal(waitFor(t, owner, JoinRoom), &reply); err != nil {
+		t.Fatal(err)
+	}
+	owner.close()
+	rm.onClose(owner, websocket.CloseAbnormalClosure)
+
+	other := &fakeConn{}
+	dispatch(t, rm, other, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: "room"})
+	if code := errorCode(t, other); code != msg.ErrCodeConflict {
+		t.Fatalf("不带 resume_token 顶替断线用户返回 %d", code)
+	}
+
+	dispatch(t, rm, other, JoinRoom, msg.JoinRoom{Id: "alice", Name: "alice", RoomId: "room", ResumeToken: reply.ResumeToken})
+	if len(other.received(JoinRoom)) != 1 {
+		t.Fatal("带 resume_token 恢复失败")
+	}
+}
+
+// 只允许音频的房间中，服务端用户只接收音频，会话的媒体类型为 audio
+func TestServerPeerAudioOnly(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Whep.Enable = true
+	cfg.Media.Kinds = []string{"audio"}
+	rm := NewRoomManager(cfg)
+
+	a := &fakeConn{}
+	dispatch(t, rm, a, JoinRoom, msg.JoinRoom{Id: "a", Name: "a", RoomId: "room"})
+
+	p, err := rm.Watch(nil, "room", "", "", serverpeer.Config{}, serverpeer.Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Unwatch(p)
+
+	var offer msg.Offer
+	if err := json.Unmarshal(waitFor(t, a, Offer), &offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.Type != "audio" || strings.Contains(offer.Description.Sdp, "m=video") {
+		t.Fatalf("服务端用户的 offer 类型 %s\n%s", offer.Type, offer.Description.Sdp)
+	}
+	detail, err := rm.RoomDetail("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Sessions) != 1 || detail.Sessions[0].Type != "audio" {
+		t.Fatalf("服务端用户的会话 %+v", detail.Sessions)
+	}
+}
@@ -0,0 +1,331 @@
+package room
+
+import (
+	"time"
+	"webrtc/p2p-server/pkg/media"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+// SessionState 会话状态
+type SessionState string
+
+const (
+	SessionInviting SessionState = "inviting" //呼叫中
+	SessionRinging  SessionState = "ringing"  //对方振铃
+	SessionAccepted SessionState = "accepted" //已接听
+	SessionRejected SessionState = "rejected" //已拒绝
+	SessionBusy     SessionState = "busy"     //对方忙
+	SessionTimeout  SessionState = "timeout"  //呼叫超时
+	SessionEnded    SessionState = "ended"    //已结束
+)
+
+// 会话结束原因
+const (
+	ReasonHangUp     = "hangUp"     //主动挂断
+	ReasonCancel     = "cancel"     //接听前主叫取消
+	ReasonTimeout    = "timeout"    //无人接听
+	ReasonDisconnect = "disconnect" //一方断开连接
+)
+
+// 允许的状态迁移
+var sessionTransitions = map[SessionState][]SessionState{
+	SessionInviting: {SessionRinging, SessionAccepted, SessionRejected, SessionBusy, SessionTimeout, SessionEnded},
+	SessionRinging:  {SessionAccepted, SessionRejected, SessionBusy, SessionTimeout, SessionEnded},
+	SessionAccepted: {SessionEnded},
+}
+
+// Session 一次呼叫会话，只在房间协程中访问
+type Session struct {
+	Id string
+	//主叫
+	From string
+	//被叫
+	To string
+	//媒体类型
+	Type  string
+	State SessionState
+	//礼貌方，协商冲突时回滚自己的 offer，创建会话时指定为被叫
+	Polite string
+	//创建时间
+	CreatedAt time.Time
+	//呼叫超时定时器
+	timer *time.Timer
+	//最近一次 offer/answer 中的媒体
+	offer  *media.Description
+	answer *media.Description
+	//还在等待 answer 的 offer 的发送方
+	offerFrom string
+	//是否完成过一次协商
+	negotiated bool
+	//重新协商次数
+	renegotiations int
+	//服务端用户(录制端、观看端)与参与者的会话，不算忙线，也不算进行中的通话
+	server bool
+}
+
+// SessionInfo 会话消息的数据
+type SessionInfo struct {
+	SessionId string       `json:"session_id"`
+	RoomId    string       `json:"room_id"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Type      string       `json:"type,omitempty"`
+	State     SessionState `json:"state"`
+	Reason    string       `json:"reason,omitempty"`
+	//礼貌方
+	Polite string `json:"polite,omitempty"`
+}
+
+func newSession(id string, from string, to string, mediaType string, state SessionState) *Session {
+	if len(id) == 0 {
+		id = utils.NewId()
+	}
+	return &Session{
+		Id:        id,
+		From:      from,
+		To:        to,
+		Type:      mediaType,
+		State:     state,
+		Polite:    to,
+		CreatedAt: time.Now(),
+	}
+}
+
+// 状态迁移，不允许的迁移返回 false
+func (s *Session) transition(to SessionState) bool {
+	for _, state := range sessionTransitions[s.State] {
+		if state == to {
+			s.State = to
+			if s.Terminal() || to == SessionAccepted {
+				s.stopTimer()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal 会话是否已经结束
+func (s *Session) Terminal() bool {
+	return len(sessionTransitions[s.State]) == 0
+}
+
+// Has 用户是否是会话的参与方
+func (s *Session) Has(userId string) bool {
+	return s.From == userId || s.To == userId
+}
+
+// Peer 返回会话中的另一方
+func (s *Session) Peer(userId string) string {
+	if s.From == userId {
+		return s.To
+	}
+	return s.From
+}
+
+func (s *Session) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// 记录 offer/answer 中的媒体，新的 offer 需要等待新的 answer
+func (s *Session) setMedia(desc *media.Description, offer bool) {
+	if offer {
+		s.offer = desc
+		s.answer = nil
+		return
+	}
+	s.answer = desc
+}
+
+func (s *Session) info(roomId string, reason string) SessionInfo {
+	return SessionInfo{
+		SessionId: s.Id,
+		RoomId:    roomId,
+		From:      s.From,
+		To:        s.To,
+		Type:      s.Type,
+		State:     s.State,
+		Reason:    reason,
+		Polite:    s.Polite,
+	}
+}
+
+// 以下方法只能在房间协程中调用
+
+// 用户是否在未结束的会话中
+func (r *Room) busy(userId string) bool {
+	for _, s := range r.sessions {
+		if !s.Terminal() && !s.server && s.Has(userId) {
+			return true
+		}
+	}
+	return false
+}
+
+// 发送会话消息给用户
+func (r *Room) sendSession(userId string, msgType string, s *Session, reason string) {
+	if user, ok := r.users[userId]; ok {
+		user.conn.Send(utils.Marshal(msg.Msg{
+			Type: msgType,
+			Data: s.info(r.Id, reason),
+		}))
+	}
+}
+
+// 移除已结束的会话
+func (r *Room) removeSession(s *Session) {
+	s.stopTimer()
+	delete(r.sessions, s.Id)
+	r.dropGroupPair(s.Id)
+}
+
+// 发起呼叫
+func (r *Room) invite(from string, data *msg.Invite) error {
+	if from == data.To {
+		return msg.NewError(msg.ErrCodeInvalidParam, "不能呼叫自己")
+	}
+	if !r.Exists(data.To) {
+		return msg.NewError(msg.ErrCodeNotFound, "用户 [%s] 不存在", data.To)
+	}
+	if u, ok := r.users[from]; !ok || u.info.Role == RoleViewer {
+		return msg.NewError(msg.ErrCodeForbidden, "观众不能发起呼叫")
+	}
+	if r.busy(from) {
+		return msg.NewError(msg.ErrCodeConflict, "已经在通话中")
+	}
+
+	if r.busy(data.To) {
+		//对方忙，直接回复主叫
+		s := newSession("", from, data.To, data.Type, SessionBusy)
+		r.sendSession(from, Busy, s, "")
+		return nil
+	}
+
+	s := newSession("", from, data.To, data.Type, SessionInviting)
+	r.sessions[s.Id] = s
+
+	if r.inviteTimeout > 0 {
+		id := s.Id
+		s.timer = time.AfterFunc(r.inviteTimeout, func() {
+			r.Post(func() {
+				r.timeoutSession(id)
+			})
+		})
+	}
+
+	//主叫收到带 session_id 的确认，被叫收到呼叫
+	r.sendSession(from, Invite, s, "")
+	r.sendSession(data.To, Invite, s, "")
+
+	return nil
+}
+
+// 被叫回复 ringing/accept/reject/busy
+func (r *Room) replySession(from string, msgType string, data *msg.SessionReply) error {
+	s, ok := r.sessions[data.SessionId]
+	if !ok {
+		return msg.NewError(msg.ErrCodeNotFound, "会话 [%s] 不存在", data.SessionId)
+	}
+	if s.To != from {
+		return msg.NewError(msg.ErrCodeForbidden, "只有被叫可以回复会话 [%s]", data.SessionId)
+	}
+
+	var state SessionState
+	switch msgType {
+	case Ringing:
+		state = SessionRinging
+	case Accept:
+		state = SessionAccepted
+	case Reject:
+		state = SessionRejected
+	case Busy:
+		state = SessionBusy
+	}
+
+	if !s.transition(state) {
+		return msg.NewError(msg.ErrCodeConflict, "会话 [%s] 当前状态 %s 不能 %s", s.Id, s.State, msgType)
+	}
+
+	r.sendSession(s.From, msgType, s, "")
+
+	if s.Terminal() {
+		r.removeSession(s)
+	}
+	return nil
+}
+
+// 呼叫超时
+func (r *Room) timeoutSession(id string) {
+	s, ok := r.sessions[id]
+	if !ok || !s.transition(SessionTimeout) {
+		return
+	}
+
+	r.sendSession(s.From, HangUp, s, ReasonTimeout)
+	r.sendSession(s.To, HangUp, s, ReasonTimeout)
+
+	r.removeSession(s)
+}
+
+// 结束会话，通知双方
+func (r *Room) hangUp(from string, sessionId string) error {
+	s, ok := r.sessions[sessionId]
+	if !ok {
+		return msg.NewError(msg.ErrCodeNotFound, "会话 [%s] 不存在", sessionId)
+	}
+	if !s.Has(from) {
+		return msg.NewError(msg.ErrCodeForbidden, "不是会话 [%s] 的参与方", sessionId)
+	}
+
+	reason := ReasonHangUp
+	if s.State != SessionAccepted && from == s.From {
+		reason = ReasonCancel
+	}
+	r.endSession(s, reason)
+	return nil
+}
+
+// 结束会话并通知双方
+func (r *Room) endSession(s *Session, reason string) {
+	if !s.transition(SessionEnded) {
+		return
+	}
+	//服务端会话随服务端用户离开结束，参与者收到 leaveRoom 后关闭连接，不影响其他通话
+	if s.server {
+		r.removeSession(s)
+		return
+	}
+
+	for _, id := range []string{s.From, s.To} {
+		if user, ok := r.users[id]; ok {
+			user.conn.Send(utils.Marshal(msg.Msg{
+				Type: HangUp,
+				Data: map[string]any{
+					//接收方
+					"to": id,
+					//会话Id
+					"session_id": s.Id,
+					//会话双方
+					"users":  []string{s.From, s.To},
+					"state":  s.State,
+					"reason": reason,
+				},
+			}))
+		}
+	}
+
+	r.removeSession(s)
+}
+
+// 用户离开时结束其参与的所有会话
+func (r *Room) endUserSessions(userId string) {
+	for _, s := range r.sessions {
+		if s.Has(userId) {
+			r.endSession(s, ReasonDisconnect)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package room
+
+import (
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// 房间模式
+const (
+	ModeP2P = "p2p" //客户端之间直接连接
+	ModeSFU = "sfu" //通过服务端转发媒体
+)
+
+// SfuConfig 根据配置生成 SFU 设置
+func SfuConfig(cfg *config.Config) sfu.Config {
+	c := sfu.Config{
+		PortMin:   cfg.Sfu.PortMin,
+		PortMax:   cfg.Sfu.PortMax,
+		PublicIPs: cfg.Sfu.PublicIps,
+	}
+	if len(cfg.Sfu.IceServers) > 0 {
+		c.ICEServers = []webrtc.ICEServer{{URLs: cfg.Sfu.IceServers}}
+	}
+	return c
+}
+
+// 通过房间协程把 SFU 的信令发给用户
+type sfuSignaler struct {
+	r *Room
+}
+
+func (s sfuSignaler) Signal(userId string, msgType string, data any) {
+	s.r.Do(func() {
+		s.r.relay(userId, utils.Marshal(msg.Msg{
+			Type: msgType,
+			Data: data,
+		}))
+	})
+}
+
+func (s sfuSignaler) Broadcast(except string, msgType string, data any) {
+	s.r.Do(func() {
+		raw := utils.Marshal(msg.Msg{
+			Type: msgType,
+			Data: data,
+		})
+		for id := range s.r.users {
+			if id != except {
+				s.r.relay(id, raw)
+			}
+		}
+	})
+}
+
+// 开启 SFU 模式，只能在房间发布到 RoomManager 之前调用
+func (r *Room) enableSFU(api *webrtc.API, cfg sfu.Config) {
+	r.sfu = sfu.New(r.Id, api, cfg, sfuSignaler{r: r})
+}
+
+// 以下方法只能在房间协程中调用
+
+func (r *Room) mode() string {
+	if r.sfu != nil {
+		return ModeSFU
+	}
+	return ModeP2P
+}
+
+// 房间的 SFU，非 SFU 模式或观众发布时返回错误
+func (r *Room) sfuFor(userId string, publish bool) (*sfu.SFU, error) {
+	if r.sfu == nil {
+		return nil, msg.NewError(msg.ErrCodeConflict, "房间 [%s] 不是SFU模式", r.Id)
+	}
+	if u, ok := r.users[userId]; publish && (!ok || u.info.Role == RoleViewer) {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "观众不能发布")
+	}
+	return r.sfu, nil
+}
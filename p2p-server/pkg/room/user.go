@@ -1,21 +1,58 @@
 package room
 
 import (
-	"webrtc/p2p-server/pkg/ws"
+	"time"
+	"webrtc/p2p-server/pkg/router"
+)
+
+// Conn 用户的信令连接
+type Conn = router.Conn
+
+// 用户状态
+const (
+	UserOnline       = "online"       //在线
+	UserReconnecting = "reconnecting" //断线等待重连
 )
 
 type UserInfo struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
+	//信令连接的往返时间(毫秒)
+	Rtt int64 `json:"rtt"`
+	//用户状态
+	State string `json:"state"`
+	//角色
+	Role string `json:"role"`
 }
 
 type User struct {
 	info UserInfo
-	conn *ws.WsConn
+	conn Conn
+	//断线重连凭证
+	resumeToken string
+	//断线等待重连的定时器
+	graceTimer *time.Timer
+	//加入顺序
+	seq uint64
+}
+
+// Info 返回用户信息，附带连接当前的往返时间
+func (u *User) Info() UserInfo {
+	info := u.info
+	if info.State == UserOnline {
+		info.Rtt = u.conn.RTT().Milliseconds()
+	}
+	return info
+}
+
+// 是否在断线等待重连
+func (u *User) reconnecting() bool {
+	return u.info.State == UserReconnecting
 }
 
-type Session struct {
-	Id   string
-	from User
-	to   User
+func (u *User) stopGraceTimer() {
+	if u.graceTimer != nil {
+		u.graceTimer.Stop()
+		u.graceTimer = nil
+	}
 }
@@ -0,0 +1,169 @@
+package room
+
+import (
+	"slices"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/serverpeer"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const watcherName = "观看"
+
+// Watch 外部观看端(WHEP)以服务端观众的身份加入房间，拉取参与者的媒体
+// identity 为 nil 表示使用静态 token，进入房间与 joinRoom 一样需要房间密码或邀请
+func (rm *RoomManager) Watch(identity *auth.Identity, roomId string, password string, inviteToken string, cfg serverpeer.Config, handlers serverpeer.Handlers) (*serverpeer.Peer, error) {
+	if rm.api == nil {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "没有开启媒体服务")
+	}
+	if identity != nil && !identity.CanJoin(roomId) {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "没有进入房间 [%s] 的权限", roomId)
+	}
+	invite, err := rm.parseInvite(roomId, inviteToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.ICEServers) == 0 {
+		cfg.ICEServers = rm.sfuCfg.ICEServers
+	}
+
+	var p *serverpeer.Peer
+	if e := rm.doRoom(roomId, func(r *Room) {
+		p, err = r.addWatcher(rm, password, invite, cfg, handlers)
+	}); e != nil {
+		return nil, e
+	}
+	return p, err
+}
+
+// Unwatch 观看端离开房间
+func (rm *RoomManager) Unwatch(p *serverpeer.Peer) error {
+	return rm.doRoom(p.RoomId, func(r *Room) {
+		r.leave(p.UserId, p)
+	})
+}
+
+// 以下方法只能在房间协程中调用
+
+func (r *Room) addWatcher(rm *RoomManager, password string, invite *auth.Invite, cfg serverpeer.Config, handlers serverpeer.Handlers) (*serverpeer.Peer, error) {
+	if r.locked {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "房间 [%s] 已锁定", r.Id)
+	}
+	//观看端总是观众，邀请中的角色不生效
+	if err := r.admit(&User{}, password, invite); err != nil {
+		return nil, err
+	}
+	kinds, err := r.serverKinds(cfg.Kinds)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Kinds = kinds
+
+	p := serverpeer.New(r.Id, "whep-"+utils.NewId()[:8], rm.api, cfg, r.serverRelay(), r.sfu, handlers)
+	r.watchers[p.UserId] = p
+	r.addServerUser(p.UserId, watcherName, p)
+	p.Start()
+
+	logger.Log.Infof("房间 [%s] 观看端 [%s] 加入", r.Id, p.UserId)
+
+	r.notifyUsersUpdate()
+	return p, nil
+}
+
+// 服务端用户的信令回到房间协程中，与用户发出的信令一样转发
+// 服务端用户与每个参与者一个会话，第一次 offer 时登记
+func (r *Room) serverRelay() serverpeer.Relay {
+	return func(msgType string, data *msg.Relay, signal any) {
+		r.Do(func() {
+			raw := utils.Marshal(msg.Msg{
+				Type: msgType,
+				Data: signal,
+			})
+
+			var err error
+			if msgType == Offer {
+				var created *Session
+				if _, ok := r.sessions[data.SessionId]; !ok && r.Exists(data.From) && r.Exists(data.To) {
+					created = newSession(data.SessionId, data.From, data.To, data.Type, SessionAccepted)
+					created.server = true
+					r.sessions[created.Id] = created
+				}
+				err = r.forwardOffer(msgType, data, signal, raw)
+				if err != nil && created != nil {
+					r.removeSession(created)
+				}
+			} else {
+				err = r.forwardSignal(msgType, data, signal, raw)
+			}
+			if err != nil {
+				logger.Log.Errorf("房间 [%s] 服务端用户 [%s] 转发 %s 给 [%s] 失败 %v", r.Id, data.From, msgType, data.To, err)
+			}
+		})
+	}
+}
+
+// 服务端用户接收的媒体类型，去掉房间媒体策略不允许的类型
+// kinds 为空表示音频和视频，都不允许时返回错误
+func (r *Room) serverKinds(kinds []webrtc.RTPCodecType) ([]webrtc.RTPCodecType, error) {
+	if len(r.media.Kinds) == 0 {
+		return kinds, nil
+	}
+	if len(kinds) == 0 {
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	}
+	allowed := make([]webrtc.RTPCodecType, 0, len(kinds))
+	for _, kind := range kinds {
+		if slices.Contains(r.media.Kinds, kind.String()) {
+			allowed = append(allowed, kind)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, msg.NewError(msg.ErrCodeForbidden, "房间不允许接收的媒体")
+	}
+	return allowed, nil
+}
+
+// 服务端用户以观众身份加入房间
+func (r *Room) addServerUser(userId string, name string, conn Conn) {
+	r.seq++
+	r.AddUser(&User{
+		info: UserInfo{
+			Id:    userId,
+			Name:  name,
+			State: UserOnline,
+			Role:  RoleViewer,
+		},
+		conn: conn,
+		seq:  r.seq,
+	})
+}
+
+// 服务端用户离开房间后断开连接
+func (r *Room) removeServerUser(userId string) {
+	if r.recorder != nil && userId == r.recorder.UserId {
+		r.endRecording()
+		return
+	}
+	if p, ok := r.watchers[userId]; ok {
+		delete(r.watchers, userId)
+		go p.Close()
+	}
+}
+
+// 房间内只剩服务端用户时返回其中一个，没有真实用户的房间需要关闭
+func (r *Room) onlyServerUser() *User {
+	servers := len(r.watchers)
+	if r.recorder != nil {
+		servers++
+	}
+	if servers == 0 || servers != len(r.users) {
+		return nil
+	}
+	for _, user := range r.users {
+		return user
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/metrics"
+	"webrtc/p2p-server/pkg/msg"
+
+	"golang.org/x/time/rate"
+)
+
+// Recovery 处理函数 panic 时回复内部错误
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Log.Errorf("处理请求 %s panic %v\n%s", ctx.Type, r, debug.Stack())
+					err = msg.NewError(msg.ErrCodeInternal, "服务器内部错误")
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// Logging 记录请求和处理结果
+// 只记录消息类型和房间Id，原始消息中有密码、邀请和 resume token，不写入日志
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			var data struct {
+				RoomId string `json:"room_id"`
+			}
+			json.Unmarshal(ctx.Request.Data, &data)
+			logger.Log.Infof("收到的请求 %s 房间 [%s]", ctx.Type, data.RoomId)
+
+			err := next(ctx)
+			if err != nil {
+				logger.Log.Errorf("处理请求 %s 失败 %v 耗时 %v", ctx.Type, err, time.Since(ctx.Start))
+			}
+			return err
+		}
+	}
+}
+
+// Metrics 统计收到的消息和失败的消息，未注册的类型统一记为 unknown，解析失败的记为 invalid
+func (r *Router) Metrics() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			label := ctx.Type
+			if len(label) == 0 {
+				label = "invalid"
+			} else if !r.Known(label) {
+				label = "unknown"
+			}
+			metrics.MessagesIn.WithLabelValues(label).Inc()
+
+			err := next(ctx)
+			if err != nil {
+				metrics.MessageErrors.WithLabelValues(label, strconv.Itoa(ErrorCode(err))).Inc()
+			}
+			return err
+		}
+	}
+}
+
+// Auth 校验请求，exempt 中的消息类型不校验
+func Auth(check func(ctx *Context) error, exempt ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			if !slices.Contains(exempt, ctx.Type) {
+				if err := check(ctx); err != nil {
+					return err
+				}
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// RateLimit 按连接限制每秒消息数，连接关闭后清理
+func (r *Router) RateLimit(limit float64, burst int) Middleware {
+	var limiters sync.Map
+
+	r.OnConnClose(func(conn Conn) {
+		limiters.Delete(conn)
+	})
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			l, ok := limiters.Load(ctx.Conn)
+			if !ok {
+				l, _ = limiters.LoadOrStore(ctx.Conn, rate.NewLimiter(rate.Limit(limit), burst))
+			}
+			if !l.(*rate.Limiter).Allow() {
+				return msg.NewError(msg.ErrCodeRateLimited, "请求过于频繁")
+			}
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+)
+
+// Conn 信令连接
+type Conn interface {
+	Send(msg string) error
+	IsClosed() bool
+	RTT() time.Duration
+	//认证后的身份，未开启认证时为 nil
+	Identity() *auth.Identity
+}
+
+// Context 一次请求的上下文
+type Context struct {
+	Conn    Conn
+	Type    string
+	Request *msg.Request
+	//收到请求的时间
+	Start time.Time
+}
+
+// HandlerFunc 消息处理函数，返回的错误会以 error 消息回复给客户端
+type HandlerFunc func(ctx *Context) error
+
+// Middleware 包装消息处理函数
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router 按消息类型分发信令消息
+type Router struct {
+	mu          sync.RWMutex
+	handlers    map[string]HandlerFunc
+	middlewares []Middleware
+	//连接关闭时的清理函数
+	closers []func(conn Conn)
+}
+
+func New() *Router {
+	return &Router{
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Use 添加中间件，先添加的在外层
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, mw...)
+}
+
+// HandleFunc 注册消息处理函数，同一类型重复注册时覆盖
+func (r *Router) HandleFunc(msgType string, h HandlerFunc) {
+	if len(msgType) == 0 {
+		panic("message type cannot be empty")
+	}
+	if h == nil {
+		panic("handler cannot be nil")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = h
+}
+
+// Handle 注册带类型的消息处理函数，data 解析并校验后再调用 h
+func Handle[T any, PT interface {
+	*T
+	msg.Validator
+}](r *Router, msgType string, h func(ctx *Context, data PT) error) {
+	r.HandleFunc(msgType, func(ctx *Context) error {
+		data := PT(new(T))
+		if err := ctx.Request.Bind(data); err != nil {
+			return err
+		}
+		return h(ctx, data)
+	})
+}
+
+// Types 返回已注册的消息类型
+func (r *Router) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.handlers))
+	for t := range r.handlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+// OnConnClose 注册连接关闭时的清理函数
+func (r *Router) OnConnClose(fn func(conn Conn)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closers = append(r.closers, fn)
+}
+
+// ConnClosed 连接关闭时调用，清理中间件保存的连接状态
+func (r *Router) ConnClosed(conn Conn) {
+	r.mu.RLock()
+	closers := r.closers
+	r.mu.RUnlock()
+
+	for _, fn := range closers {
+		fn(conn)
+	}
+}
+
+// Dispatch 解析消息并交给对应的处理函数，处理失败时回复 error 消息
+// 解析失败的消息同样经过中间件，Type 为空，限流等中间件对它同样生效
+func (r *Router) Dispatch(conn Conn, message []byte) {
+	ctx := &Context{
+		Conn:  conn,
+		Start: time.Now(),
+	}
+
+	var h HandlerFunc
+	req, err := msg.Decode(message)
+	if err != nil {
+		ctx.Request = &msg.Request{Raw: message}
+		h = func(ctx *Context) error {
+			return err
+		}
+	} else {
+		ctx.Type = req.Type
+		ctx.Request = req
+	}
+
+	r.mu.RLock()
+	if h == nil {
+		h = r.handlers[ctx.Type]
+	}
+	middlewares := r.middlewares
+	r.mu.RUnlock()
+
+	if h == nil {
+		h = unknownHandler
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	if err := h(ctx); err != nil {
+		r.replyError(ctx, err)
+	}
+}
+
+// Known 消息类型是否已注册
+func (r *Router) Known(msgType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.handlers[msgType]
+	return ok
+}
+
+func unknownHandler(ctx *Context) error {
+	return msg.NewError(msg.ErrCodeUnknownType, "未知的请求 %s", ctx.Type)
+}
+
+func (r *Router) replyError(ctx *Context, err error) {
+	ctx.Conn.Send(utils.Marshal(msg.NewErrorReply(ctx.Type, err)))
+}
+
+// ErrorCode 错误码，非 ErrorMsg 的错误视为内部错误
+func ErrorCode(err error) int {
+	var e *msg.ErrorMsg
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return msg.ErrCodeInternal
+}
@@ -0,0 +1,174 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// 记录发送的消息
+type fakeConn struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (c *fakeConn) Send(m string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, m)
+	return nil
+}
+
+func (c *fakeConn) IsClosed() bool           { return false }
+func (c *fakeConn) RTT() time.Duration       { return 0 }
+func (c *fakeConn) Identity() *auth.Identity { return nil }
+
+// 回复的错误码，没有回复时为 0
+func (c *fakeConn) errorCode(t *testing.T) int {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sent) == 0 {
+		return 0
+	}
+	var reply struct {
+		Type string        `json:"type"`
+		Data msg.ErrorData `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(c.sent[len(c.sent)-1]), &reply); err != nil || reply.Type != msg.Error {
+		t.Fatalf("回复的不是错误 %v %s", err, c.sent[len(c.sent)-1])
+	}
+	return reply.Data.Code
+}
+
+func request(msgType string) []byte {
+	return []byte(`{"type":"` + msgType + `","data":{"room_id":"room"}}`)
+}
+
+func TestDispatch(t *testing.T) {
+	r := New()
+	r.Use(Recovery())
+	r.HandleFunc("ok", func(ctx *Context) error { return nil })
+	r.HandleFunc("fail", func(ctx *Context) error { return msg.NewError(msg.ErrCodeForbidden, "禁止") })
+	r.HandleFunc("internal", func(ctx *Context) error { return errors.New("内部错误") })
+	r.HandleFunc("panic", func(ctx *Context) error { panic("panic") })
+
+	cases := []struct {
+		name    string
+		message []byte
+		code    int
+	}{
+		{"成功", request("ok"), 0},
+		{"处理失败", request("fail"), msg.ErrCodeForbidden},
+		{"非ErrorMsg错误", request("internal"), msg.ErrCodeInternal},
+		{"panic", request("panic"), msg.ErrCodeInternal},
+		{"未知类型", request("missing"), msg.ErrCodeUnknownType},
+		{"格式错误", []byte("{"), msg.ErrCodeBadRequest},
+		{"没有type", []byte(`{"data":{}}`), msg.ErrCodeBadRequest},
+		{"没有data", []byte(`{"type":"ok"}`), msg.ErrCodeBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &fakeConn{}
+			r.Dispatch(conn, c.message)
+			if code := conn.errorCode(t); code != c.code {
+				t.Fatalf("错误码 %d，期望 %d", code, c.code)
+			}
+		})
+	}
+}
+
+// 先添加的中间件在外层
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context) error {
+				order = append(order, name)
+				return next(ctx)
+			}
+		}
+	}
+
+	r := New()
+	r.Use(mw("a"), mw("b"))
+	r.Use(mw("c"))
+	r.HandleFunc("ok", func(ctx *Context) error {
+		order = append(order, "handler")
+		return nil
+	})
+	r.Dispatch(&fakeConn{}, request("ok"))
+
+	if want := []string{"a", "b", "c", "handler"}; !slices.Equal(order, want) {
+		t.Fatalf("调用顺序 %v，期望 %v", order, want)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	r := New()
+	r.Use(Auth(func(ctx *Context) error {
+		return msg.NewError(msg.ErrCodeUnauthorized, "未认证")
+	}, "public"))
+	r.HandleFunc("public", func(ctx *Context) error { return nil })
+	r.HandleFunc("private", func(ctx *Context) error { return nil })
+
+	conn := &fakeConn{}
+	r.Dispatch(conn, request("public"))
+	if code := conn.errorCode(t); code != 0 {
+		t.Fatalf("豁免的消息返回 %d", code)
+	}
+	r.Dispatch(conn, request("private"))
+	if code := conn.errorCode(t); code != msg.ErrCodeUnauthorized {
+		t.Fatalf("需要认证的消息返回 %d", code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	r := New()
+	r.Use(r.RateLimit(0.001, 2))
+	handled := 0
+	r.HandleFunc("ok", func(ctx *Context) error {
+		handled++
+		return nil
+	})
+
+	a := &fakeConn{}
+	b := &fakeConn{}
+	//突发之内的请求都处理，格式错误的消息同样计数
+	r.Dispatch(a, request("ok"))
+	r.Dispatch(a, []byte("{"))
+	if code := a.errorCode(t); code != msg.ErrCodeBadRequest {
+		t.Fatalf("格式错误的消息返回 %d", code)
+	}
+	r.Dispatch(a, request("ok"))
+	if code := a.errorCode(t); code != msg.ErrCodeRateLimited {
+		t.Fatalf("超过限制返回 %d", code)
+	}
+
+	//按连接分别限流
+	r.Dispatch(b, request("ok"))
+	if code := b.errorCode(t); code != 0 || handled != 2 {
+		t.Fatalf("其他连接返回 %d，处理了 %d 个请求", code, handled)
+	}
+
+	//连接关闭后清理限流状态
+	r.ConnClosed(a)
+	r.Dispatch(a, request("ok"))
+	if handled != 3 {
+		t.Fatalf("连接关闭后处理了 %d 个请求", handled)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SuccessCode = 200
+	ErrorCode   = 500
+)
+
+type Response struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data any    `json:"data"`
+}
+
+// Success 返回成功响应
+func Success(c *gin.Context, data any) {
+	c.JSON(http.StatusOK, Response{
+		Code: SuccessCode,
+		Msg:  "success",
+		Data: data,
+	})
+}
+
+// Error 返回错误响应，code 同时作为 HTTP 状态码
+func Error(c *gin.Context, code int, msg string) {
+	c.AbortWithStatusJSON(code, Response{
+		Code: code,
+		Msg:  msg,
+		Data: nil,
+	})
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"webrtc/p2p-server/pkg/auth"
 	"webrtc/p2p-server/pkg/config"
 	"webrtc/p2p-server/pkg/logger"
 	"webrtc/p2p-server/pkg/ws"
@@ -16,6 +21,16 @@ type Server struct {
 	cfg       *config.Config
 	upgrader  websocket.Upgrader
 	handleMsg ws.HandleFunc
+	//token 校验，未开启认证时为 nil
+	verifier *auth.Verifier
+	//所有连接
+	conns  map[*ws.WsConn]struct{}
+	connMu sync.Mutex
+	//下线中，不再接受新连接
+	draining   atomic.Bool
+	httpServer *http.Server
+	//路由只注册一次
+	routes sync.Once
 }
 
 func NewServer(handleMsg ws.HandleFunc, cfg *config.Config) *Server {
@@ -31,36 +46,120 @@ func NewServer(handleMsg ws.HandleFunc, cfg *config.Config) *Server {
 		Engine: r,
 		cfg:    cfg,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin: checkOrigin(cfg.Http.AllowedOrigins),
 		},
 		handleMsg: handleMsg,
+		conns:     make(map[*ws.WsConn]struct{}),
+	}
+
+	if cfg.Auth.Enable {
+		verifier, err := auth.NewVerifier(&cfg.Auth)
+		if err != nil {
+			panic(fmt.Errorf("Fatal error auth config: %s \n", err))
+		}
+		s.verifier = verifier
 	}
 
 	return s
 }
 
+// 校验升级请求的 Origin，没有配置时返回 nil，由 websocket 只允许同源
+// 没有 Origin 的请求不是来自浏览器，不做限制
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			return true
+		}
+		for _, o := range allowed {
+			if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+				return true
+			}
+		}
+		logger.Log.Warnf("拒绝来源 %s 的WebSocket连接", origin)
+		return false
+	}
+}
+
+// 校验升级请求中的 token
+func (s *Server) authenticate(c *gin.Context) (*auth.Identity, http.Header, bool) {
+	if s.verifier == nil {
+		return nil, nil, true
+	}
+
+	token, protocol, err := s.verifier.TokenFromRequest(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": err.Error()})
+		return nil, nil, false
+	}
+
+	identity, err := s.verifier.Verify(token)
+	if err != nil {
+		logger.Log.Warnf("token校验失败 %v", err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "token无效"})
+		return nil, nil, false
+	}
+
+	var header http.Header
+	if len(protocol) > 0 {
+		header = http.Header{"Sec-Websocket-Protocol": []string{protocol}}
+	}
+
+	return identity, header, true
+}
+
 func (s *Server) handlerUpgrade(c *gin.Context) {
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if s.draining.Load() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"msg": "服务下线中"})
+		return
+	}
+
+	identity, header, ok := s.authenticate(c)
+	if !ok {
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, header)
 	if err != nil {
 		logger.Log.Infof("upgrade err: %v", err)
+		return
 	}
 
 	wsConn := ws.NewWsConn(conn, s.cfg)
+	wsConn.SetIdentity(identity)
+
+	s.addConn(wsConn)
 
 	s.handleMsg(wsConn, c)
 
 	wsConn.Loop()
 }
 
-func (s *Server) Run() error {
-	s.GET(s.cfg.Http.WsPath, s.handlerUpgrade)
+// Handler 注册信令和健康检查路由，返回完整的 HTTP 处理器
+// 测试中可以直接交给 httptest.NewServer
+func (s *Server) Handler() http.Handler {
+	s.routes.Do(func() {
+		s.GET(s.cfg.Http.WsPath, s.handlerUpgrade)
 
-	s.StaticFS("/html", http.Dir(s.cfg.Http.HtmlRoot))
+		s.StaticFS("/html", http.Dir(s.cfg.Http.HtmlRoot))
 
-	err := s.RunTLS(fmt.Sprintf("%s:%d", s.cfg.Http.Ip, s.cfg.Http.Port), s.cfg.Http.Cert, s.cfg.Http.Key)
-	if err != nil {
+		s.GET("/healthz", s.handleHealthz)
+		s.GET("/readyz", s.handleReadyz)
+	})
+	return s.Engine
+}
+
+func (s *Server) Run() error {
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", s.cfg.Http.Ip, s.cfg.Http.Port),
+		Handler: s.Handler(),
+	}
+
+	err := s.httpServer.ListenAndServeTLS(s.cfg.Http.Cert, s.cfg.Http.Key)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	return nil
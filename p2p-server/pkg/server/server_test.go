@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"webrtc/p2p-server/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+func TestCheckOrigin(t *testing.T) {
+	if checkOrigin(nil) != nil {
+		t.Fatal("没有配置来源时应该由 websocket 只允许同源")
+	}
+
+	cases := []struct {
+		name    string
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{"没有Origin", []string{"https://example.com"}, "", true},
+		{"允许的来源", []string{"https://example.com"}, "https://example.com", true},
+		{"大小写和末尾斜杠", []string{"https://Example.com/"}, "https://example.com", true},
+		{"不同协议", []string{"https://example.com"}, "http://example.com", false},
+		{"其他来源", []string{"https://example.com"}, "https://evil.com", false},
+		{"不同端口", []string{"https://example.com"}, "https://example.com:8443", false},
+		{"不限制", []string{"*"}, "https://evil.com", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if len(c.origin) > 0 {
+				r.Header.Set("Origin", c.origin)
+			}
+			if ok := checkOrigin(c.allowed)(r); ok != c.ok {
+				t.Fatalf("来源 %q 校验结果 %v，期望 %v", c.origin, ok, c.ok)
+			}
+		})
+	}
+}
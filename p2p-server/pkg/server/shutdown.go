@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+	"webrtc/p2p-server/pkg/ws"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ServerShutdown = "serverShutdown" //服务即将关闭
+
+	defaultDrainTime = 30 * time.Second
+	//重连提示的最大随机延迟，避免所有客户端同时重连
+	defaultReconnectJitter = 5 * time.Second
+)
+
+// 登记连接，连接关闭时自动移除
+func (s *Server) addConn(wc *ws.WsConn) {
+	s.connMu.Lock()
+	s.conns[wc] = struct{}{}
+	s.connMu.Unlock()
+
+	wc.On("close", func(message []byte) {
+		s.connMu.Lock()
+		delete(s.conns, wc)
+		s.connMu.Unlock()
+	})
+}
+
+// 当前所有连接
+func (s *Server) connList() []*ws.WsConn {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	list := make([]*ws.WsConn, 0, len(s.conns))
+	for wc := range s.conns {
+		list = append(list, wc)
+	}
+	return list
+}
+
+func (s *Server) handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s *Server) handleReadyz(c *gin.Context) {
+	if s.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// Drain 停止接受新连接，通知所有连接服务即将关闭
+func (s *Server) Drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+
+	drain := s.DrainTime()
+	conns := s.connList()
+
+	logger.Log.Infof("开始下线，通知 %d 个连接", len(conns))
+
+	for _, wc := range conns {
+		wc.Send(utils.Marshal(msg.Msg{
+			Type: ServerShutdown,
+			Data: map[string]any{
+				//建议客户端多久后重连(毫秒)
+				"reconnect_after": rand.Int64N(int64(defaultReconnectJitter / time.Millisecond)),
+				//服务等待进行中通话结束的时间(秒)
+				"drain": int(drain / time.Second),
+			},
+		}))
+	}
+}
+
+// Shutdown 下线并关闭服务
+// 等待 activeCalls 归零或者下线时间结束后关闭所有连接，再关闭 HTTP 服务
+func (s *Server) Shutdown(ctx context.Context, activeCalls func() int) error {
+	s.Drain()
+
+	deadline := time.NewTimer(s.DrainTime())
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+wait:
+	for activeCalls != nil && activeCalls() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			logger.Log.Warnf("下线等待超时，还有 %d 个通话", activeCalls())
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	for _, wc := range s.connList() {
+		wc.CloseWithCode(websocket.CloseGoingAway, "server shutdown")
+	}
+
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+// DrainTime 下线时等待进行中通话结束的时间，未配置时使用默认值
+func (s *Server) DrainTime() time.Duration {
+	if s.cfg.Http.DrainTime > 0 {
+		return time.Duration(s.cfg.Http.DrainTime) * time.Second
+	}
+	return defaultDrainTime
+}
@@ -0,0 +1,468 @@
+package serverpeer
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// 服务端用户处理的房间消息，与 room 中的定义一致
+const (
+	updateUserList = "updateUserList"
+	leaveRoom      = "leaveRoom"
+	answer         = "answer"
+	candidate      = "candidate"
+	offer          = "offer"
+	roleViewer     = "viewer"
+)
+
+// ErrClosed 服务端用户已离开
+var ErrClosed = errors.New("server peer closed")
+
+// Config 服务端用户设置
+type Config struct {
+	//STUN/TURN 服务器
+	ICEServers []webrtc.ICEServer
+	//只接收这些编码，为空表示不限制
+	Codecs []webrtc.RTPCodecParameters
+	//只拉取这些用户的媒体，为空表示所有参与者
+	Users []string
+	//P2P 房间中接收的媒体类型，为空表示音频和视频
+	Kinds []webrtc.RTPCodecType
+}
+
+// Relay 把服务端用户的信令交给房间，与用户发出的信令一样登记会话、执行房间策略后转发
+// data 是 signal 中的转发信息，signal 为 *msg.Offer 或 *msg.Candidate
+type Relay func(msgType string, data *msg.Relay, signal any)
+
+// Handlers 事件回调，在 pion 或队列协程中调用
+type Handlers struct {
+	//收到参与者的轨道，轨道结束前不要返回
+	OnTrack func(userId string, pc *webrtc.PeerConnection, track *webrtc.TrackRemote)
+	//参与者加入
+	OnJoin func(userId string, name string)
+	//参与者离开
+	OnLeave func(userId string)
+	//服务端用户关闭，离开房间或房间关闭时调用
+	OnClose func()
+}
+
+// Peer 只接收媒体的服务端用户，以观众身份加入房间
+// P2P 房间中主动给每个参与者发 offer，SFU 房间中订阅轨道
+// 实现房间的 Conn 接口，房间转发给它的消息从 Send 进入
+type Peer struct {
+	RoomId string
+	//在房间中的用户Id
+	UserId   string
+	api      *webrtc.API
+	cfg      Config
+	relay    Relay
+	handlers Handlers
+	//SFU 房间的 SFU，P2P 房间为 nil
+	sfu *sfu.SFU
+	//按顺序处理收到的消息
+	in *utils.TaskQueue
+	//按顺序发出信令，保证 candidate 在 offer/answer 之后
+	out *utils.TaskQueue
+
+	mu sync.Mutex
+	//P2P 模式下与每个参与者的连接
+	peers map[string]*webrtc.PeerConnection
+	//P2P 模式下与每个参与者的会话Id，每个参与者一个会话
+	sessions map[string]string
+	//SFU 模式下的订阅连接
+	sub    *webrtc.PeerConnection
+	closed bool
+}
+
+func New(roomId string, userId string, api *webrtc.API, cfg Config, relay Relay, s *sfu.SFU, handlers Handlers) *Peer {
+	return &Peer{
+		RoomId:   roomId,
+		UserId:   userId,
+		api:      api,
+		cfg:      cfg,
+		relay:    relay,
+		handlers: handlers,
+		sfu:      s,
+		in:       utils.NewTaskQueue(),
+		out:      utils.NewTaskQueue(),
+		peers:    make(map[string]*webrtc.PeerConnection),
+		sessions: make(map[string]string),
+	}
+}
+
+// Start 加入房间后调用，P2P 房间收到用户列表后再呼叫参与者
+func (p *Peer) Start() {
+	if p.sfu == nil {
+		return
+	}
+	p.in.Push(func() {
+		if _, err := p.sfu.Subscribe(p.UserId, p.cfg.Users); err != nil {
+			logger.Log.Errorf("房间 [%s] 用户 [%s] 订阅失败 %v", p.RoomId, p.UserId, err)
+		}
+	})
+}
+
+// Close 关闭所有连接，正在接收的轨道随之结束
+func (p *Peer) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	pcs := make([]*webrtc.PeerConnection, 0, len(p.peers)+1)
+	for _, pc := range p.peers {
+		pcs = append(pcs, pc)
+	}
+	if p.sub != nil {
+		pcs = append(pcs, p.sub)
+	}
+	p.mu.Unlock()
+
+	p.in.Close()
+	p.out.Close()
+	for _, pc := range pcs {
+		pc.Close()
+	}
+	if p.handlers.OnClose != nil {
+		p.handlers.OnClose()
+	}
+}
+
+// Send 接收房间转发的消息
+func (p *Peer) Send(data string) error {
+	if p.IsClosed() {
+		return ErrClosed
+	}
+	p.in.Push(func() {
+		p.handle(data)
+	})
+	return nil
+}
+
+func (p *Peer) IsClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *Peer) RTT() time.Duration {
+	return 0
+}
+
+func (p *Peer) Identity() *auth.Identity {
+	return nil
+}
+
+// 处理收到的消息，在 in 队列中执行
+func (p *Peer) handle(data string) {
+	req, err := msg.Decode([]byte(data))
+	if err != nil {
+		return
+	}
+
+	switch req.Type {
+	case updateUserList:
+		var users []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if err := json.Unmarshal(req.Data, &users); err != nil {
+			return
+		}
+		for _, u := range users {
+			if u.Id == p.UserId || u.Role == roleViewer {
+				continue
+			}
+			if len(p.cfg.Users) > 0 && !slices.Contains(p.cfg.Users, u.Id) {
+				continue
+			}
+			p.join(u.Id, u.Name)
+		}
+	case leaveRoom:
+		var userId string
+		if err := json.Unmarshal(req.Data, &userId); err == nil {
+			p.leave(userId)
+		}
+	case answer:
+		var data msg.Answer
+		if err := req.Bind(&data); err == nil {
+			p.onAnswer(&data)
+		}
+	case candidate:
+		var data msg.Candidate
+		if err := req.Bind(&data); err == nil {
+			p.onCandidate(&data)
+		}
+	case sfu.SfuOffer:
+		var data sfu.DescriptionSignal
+		if err := json.Unmarshal(req.Data, &data); err == nil {
+			p.onSfuOffer(data.Description)
+		}
+	case sfu.SfuCandidate:
+		var data sfu.CandidateSignal
+		if err := json.Unmarshal(req.Data, &data); err == nil {
+			p.mu.Lock()
+			pc := p.sub
+			p.mu.Unlock()
+			if pc != nil {
+				pc.AddICECandidate(data.Candidate)
+			}
+		}
+	}
+}
+
+// 参与者加入，P2P 房间中呼叫参与者
+func (p *Peer) join(userId string, name string) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	_, calling := p.peers[userId]
+	if p.sfu == nil && !calling {
+		if err := p.call(userId); err != nil {
+			logger.Log.Errorf("房间 [%s] 用户 [%s] 呼叫用户 [%s] 失败 %v", p.RoomId, p.UserId, userId, err)
+		}
+	}
+	p.mu.Unlock()
+
+	if p.handlers.OnJoin != nil {
+		p.handlers.OnJoin(userId, name)
+	}
+}
+
+// 参与者离开
+func (p *Peer) leave(userId string) {
+	p.mu.Lock()
+	pc := p.peers[userId]
+	delete(p.peers, userId)
+	delete(p.sessions, userId)
+	p.mu.Unlock()
+
+	if pc != nil {
+		pc.Close()
+	}
+	if p.handlers.OnLeave != nil {
+		p.handlers.OnLeave(userId)
+	}
+}
+
+func (p *Peer) newPeerConnection(onCandidate func(c webrtc.ICECandidateInit)) (*webrtc.PeerConnection, error) {
+	pc, err := p.api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: p.cfg.ICEServers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		init := c.ToJSON()
+		p.out.Push(func() {
+			onCandidate(init)
+		})
+	})
+	return pc, nil
+}
+
+// 给参与者发只接收的 offer，需要持有 mu
+func (p *Peer) call(userId string) error {
+	sessionId := utils.NewId()
+	pc, err := p.newPeerConnection(func(c webrtc.ICECandidateInit) {
+		signal := &msg.Candidate{
+			Relay: p.relayTo(userId, sessionId),
+			Candidate: &msg.IceCandidate{
+				Candidate:     c.Candidate,
+				SdpMid:        c.SDPMid,
+				SdpMLineIndex: c.SDPMLineIndex,
+			},
+		}
+		p.relay(candidate, &signal.Relay, signal)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range p.kinds() {
+		t, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		if codecs := p.codecs(kind); len(codecs) > 0 {
+			if err := t.SetCodecPreferences(codecs); err != nil {
+				pc.Close()
+				return err
+			}
+		}
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if p.handlers.OnTrack != nil {
+			p.handlers.OnTrack(userId, pc, track)
+		}
+	})
+
+	desc, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	//先提交 offer 再开始收集 candidate
+	p.out.Push(func() {
+		signal := &msg.Offer{
+			Relay: p.relayTo(userId, sessionId),
+			Description: &msg.Description{
+				Sdp:  desc.SDP,
+				Type: desc.Type.String(),
+			},
+		}
+		p.relay(offer, &signal.Relay, signal)
+	})
+	if err := pc.SetLocalDescription(desc); err != nil {
+		pc.Close()
+		return err
+	}
+
+	p.peers[userId] = pc
+	p.sessions[userId] = sessionId
+	return nil
+}
+
+// 指定类型的编码限制
+func (p *Peer) codecs(kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
+	var codecs []webrtc.RTPCodecParameters
+	for _, c := range p.cfg.Codecs {
+		if strings.HasPrefix(strings.ToLower(c.MimeType), kind.String()+"/") {
+			codecs = append(codecs, c)
+		}
+	}
+	return codecs
+}
+
+// 接收的媒体类型
+func (p *Peer) kinds() []webrtc.RTPCodecType {
+	if len(p.cfg.Kinds) == 0 {
+		return []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	}
+	return p.cfg.Kinds
+}
+
+// 会话的媒体类型，接收视频时为 video，只接收音频时为 audio
+func (p *Peer) mediaType() string {
+	if slices.Contains(p.kinds(), webrtc.RTPCodecTypeVideo) {
+		return webrtc.RTPCodecTypeVideo.String()
+	}
+	return webrtc.RTPCodecTypeAudio.String()
+}
+
+func (p *Peer) relayTo(userId string, sessionId string) msg.Relay {
+	return msg.Relay{
+		To:        userId,
+		From:      p.UserId,
+		SessionId: sessionId,
+		RoomId:    p.RoomId,
+		Type:      p.mediaType(),
+	}
+}
+
+// 参与者在对应会话中的连接，会话不一致时返回 nil
+func (p *Peer) peerOf(userId string, sessionId string) *webrtc.PeerConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[userId] != sessionId {
+		return nil
+	}
+	return p.peers[userId]
+}
+
+func (p *Peer) onAnswer(data *msg.Answer) {
+	pc := p.peerOf(data.From, data.SessionId)
+
+	if pc == nil {
+		return
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  data.Description.Sdp,
+	}); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] answer无效 %v", p.RoomId, data.From, err)
+	}
+}
+
+func (p *Peer) onCandidate(data *msg.Candidate) {
+	pc := p.peerOf(data.From, data.SessionId)
+
+	if pc == nil {
+		return
+	}
+	pc.AddICECandidate(webrtc.ICECandidateInit{
+		Candidate:     data.Candidate.Candidate,
+		SDPMid:        data.Candidate.SdpMid,
+		SDPMLineIndex: data.Candidate.SdpMLineIndex,
+	})
+}
+
+// SFU 订阅连接的 offer
+func (p *Peer) onSfuOffer(desc webrtc.SessionDescription) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	pc := p.sub
+	if pc == nil {
+		var err error
+		pc, err = p.newPeerConnection(func(c webrtc.ICECandidateInit) {
+			p.sfu.Candidate(p.UserId, sfu.TargetSubscriber, c)
+		})
+		if err != nil {
+			p.mu.Unlock()
+			logger.Log.Errorf("房间 [%s] 用户 [%s] 创建订阅连接失败 %v", p.RoomId, p.UserId, err)
+			return
+		}
+		//SFU 转发的轨道 stream id 是发布者Id
+		pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			if p.handlers.OnTrack != nil {
+				p.handlers.OnTrack(track.StreamID(), pc, track)
+			}
+		})
+		p.sub = pc
+	}
+	p.mu.Unlock()
+
+	if err := pc.SetRemoteDescription(desc); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] offer无效 %v", p.RoomId, p.UserId, err)
+		return
+	}
+	ans, err := pc.CreateAnswer(nil)
+	if err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 创建answer失败 %v", p.RoomId, p.UserId, err)
+		return
+	}
+	p.out.Push(func() {
+		if err := p.sfu.Answer(p.UserId, ans); err != nil {
+			logger.Log.Errorf("房间 [%s] 用户 [%s] 回复answer失败 %v", p.RoomId, p.UserId, err)
+		}
+	})
+	if err := pc.SetLocalDescription(ans); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 设置answer失败 %v", p.RoomId, p.UserId, err)
+	}
+}
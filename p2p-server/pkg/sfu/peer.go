@@ -0,0 +1,63 @@
+package sfu
+
+import (
+	"slices"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var errClosed = msg.NewError(msg.ErrCodeNotFound, "房间已关闭")
+
+// Peer SFU 中的一个用户，由 SFU.mu 保护
+type Peer struct {
+	UserId string
+	//发布连接
+	pub *webrtc.PeerConnection
+	//订阅连接
+	sub *webrtc.PeerConnection
+	//是否已订阅
+	subscribed bool
+	//订阅的发布者，为空表示所有人
+	publishers []string
+	//轨道Id -> 订阅连接中的 sender
+	senders map[string]*webrtc.RTPSender
+	//等待 answer
+	negotiating bool
+	//收到 answer 后需要重新协商
+	pending bool
+	//发布连接关闭后的回调
+	onClose func()
+}
+
+func newPeer(userId string) *Peer {
+	return &Peer{
+		UserId:  userId,
+		senders: make(map[string]*webrtc.RTPSender),
+	}
+}
+
+// 是否需要转发轨道给该用户
+func (p *Peer) wants(t *Track) bool {
+	if !p.subscribed || t.Publisher == p.UserId {
+		return false
+	}
+	return len(p.publishers) == 0 || slices.Contains(p.publishers, t.Publisher)
+}
+
+// 订阅连接关闭后清空状态
+func (p *Peer) reset() {
+	p.subscribed = false
+	p.publishers = nil
+	p.senders = make(map[string]*webrtc.RTPSender)
+	p.negotiating = false
+	p.pending = false
+}
+
+func (p *Peer) close() {
+	for _, pc := range []*webrtc.PeerConnection{p.pub, p.sub} {
+		if pc != nil {
+			pc.Close()
+		}
+	}
+}
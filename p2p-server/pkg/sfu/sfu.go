@@ -0,0 +1,542 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// 信令消息类型
+const (
+	Publish          = "publish"          //发布本地轨道
+	Subscribe        = "subscribe"        //订阅其他用户的轨道
+	Unpublish        = "unpublish"        //取消发布
+	SfuOffer         = "sfuOffer"         //服务端发给订阅端的 offer
+	SfuAnswer        = "sfuAnswer"        //订阅端回复的 answer
+	SfuCandidate     = "sfuCandidate"     //双向的 candidate
+	TrackPublished   = "trackPublished"   //有新的轨道可以订阅
+	TrackUnpublished = "trackUnpublished" //轨道已取消发布
+)
+
+// 推流端等待 candidate 收集的最长时间
+const gatherTimeout = 5 * time.Second
+
+// candidate 所属的连接
+const (
+	TargetPublisher  = "publisher"  //客户端发布用的连接
+	TargetSubscriber = "subscriber" //客户端订阅用的连接
+)
+
+// Signaler 把 SFU 产生的信令发给用户
+// 房间中通过 WebSocket 发送，测试时可以直接交给另一端的 pion peer
+type Signaler interface {
+	//发送给指定用户
+	Signal(userId string, msgType string, data any)
+	//发送给除 except 外的所有用户
+	Broadcast(except string, msgType string, data any)
+}
+
+// Config SFU 设置
+type Config struct {
+	//STUN/TURN 服务器
+	ICEServers []webrtc.ICEServer
+	//UDP 端口范围，0表示不限制
+	PortMin uint16
+	PortMax uint16
+	//服务器的公网IP，部署在 NAT 后面时使用
+	PublicIPs []string
+}
+
+// DescriptionSignal sfuOffer 和 publish 回复的数据
+type DescriptionSignal struct {
+	RoomId      string                    `json:"room_id"`
+	Description webrtc.SessionDescription `json:"description"`
+}
+
+// CandidateSignal sfuCandidate 的数据
+type CandidateSignal struct {
+	RoomId    string                  `json:"room_id"`
+	Target    string                  `json:"target"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+// NewAPI 创建所有房间共用的 pion API
+func NewAPI(cfg Config) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	se := webrtc.SettingEngine{}
+	if cfg.PortMin > 0 || cfg.PortMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.PublicIPs) > 0 {
+		if err := se.SetICEAddressRewriteRules(webrtc.ICEAddressRewriteRule{
+			External:        cfg.PublicIPs,
+			AsCandidateType: webrtc.ICECandidateTypeHost,
+			Mode:            webrtc.ICEAddressRewriteReplace,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se)), nil
+}
+
+// SFU 一个房间的选择性转发单元
+// 每个用户最多两个连接：发布连接由客户端发 offer，订阅连接由服务端发 offer
+type SFU struct {
+	RoomId string
+	api    *webrtc.API
+	cfg    Config
+	sig    Signaler
+	//按顺序发送信令，保证 candidate 不会先于 offer 到达
+	out *utils.TaskQueue
+	//设置本地 description 并发出期间，candidate 等待 description 入队后再发送
+	sigMu sync.Mutex
+
+	mu sync.Mutex
+	//所有用户
+	peers map[string]*Peer
+	//所有发布的轨道
+	tracks map[string]*Track
+	closed bool
+}
+
+func New(roomId string, api *webrtc.API, cfg Config, sig Signaler) *SFU {
+	return &SFU{
+		RoomId: roomId,
+		api:    api,
+		cfg:    cfg,
+		sig:    sig,
+		out:    utils.NewTaskQueue(),
+		peers:  make(map[string]*Peer),
+		tracks: make(map[string]*Track),
+	}
+}
+
+func (s *SFU) signal(userId string, msgType string, data any) {
+	s.out.Push(func() {
+		s.sig.Signal(userId, msgType, data)
+	})
+}
+
+func (s *SFU) broadcast(except string, msgType string, data any) {
+	s.out.Push(func() {
+		s.sig.Broadcast(except, msgType, data)
+	})
+}
+
+// 获取用户，不存在则创建，需要持有 mu
+func (s *SFU) peer(userId string) *Peer {
+	p, ok := s.peers[userId]
+	if !ok {
+		p = newPeer(userId)
+		s.peers[userId] = p
+	}
+	return p
+}
+
+// trickle 为 false 时不发送 candidate，由调用方等待收集完成后一次性返回
+func (s *SFU) newPeerConnection(userId string, target string, trickle bool) (*webrtc.PeerConnection, error) {
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: s.cfg.ICEServers,
+	})
+	if err != nil {
+		return nil, msg.NewError(msg.ErrCodeInternal, "创建连接失败 %v", err)
+	}
+
+	if trickle {
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			if c == nil {
+				return
+			}
+			s.sigMu.Lock()
+			defer s.sigMu.Unlock()
+			s.signal(userId, SfuCandidate, CandidateSignal{
+				RoomId:    s.RoomId,
+				Target:    target,
+				Candidate: c.ToJSON(),
+			})
+		})
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Log.Infof("房间 [%s] 用户 [%s] %s 连接状态 %s", s.RoomId, userId, target, state)
+		if state == webrtc.PeerConnectionStateFailed {
+			s.dropPeerConnection(userId, pc)
+		}
+	})
+
+	return pc, nil
+}
+
+// 设置本地 description 后把最终的 description 发给用户
+// 持有 sigMu，开始收集后产生的 candidate 排在 description 之后
+func (s *SFU) setLocal(pc *webrtc.PeerConnection, userId string, msgType string, desc webrtc.SessionDescription) error {
+	s.sigMu.Lock()
+	defer s.sigMu.Unlock()
+
+	if err := pc.SetLocalDescription(desc); err != nil {
+		return err
+	}
+	s.signal(userId, msgType, DescriptionSignal{
+		RoomId:      s.RoomId,
+		Description: *pc.LocalDescription(),
+	})
+	return nil
+}
+
+// 连接失败后移除，客户端需要重新 publish/subscribe
+func (s *SFU) dropPeerConnection(userId string, pc *webrtc.PeerConnection) {
+	s.mu.Lock()
+	p, ok := s.peers[userId]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	var removed []*Track
+	var onClose func()
+	switch pc {
+	case p.pub:
+		p.pub = nil
+		removed = s.tracksOf(userId)
+		onClose = p.onClose
+	case p.sub:
+		p.sub = nil
+		p.reset()
+	}
+	s.mu.Unlock()
+
+	pc.Close()
+	for _, t := range removed {
+		s.removeTrack(t)
+	}
+	if onClose != nil {
+		onClose()
+	}
+}
+
+// 获取用户的发布连接，不存在则创建，需要持有 mu
+func (s *SFU) publisher(p *Peer, trickle bool) (*webrtc.PeerConnection, error) {
+	if p.pub != nil {
+		return p.pub, nil
+	}
+
+	pc, err := s.newPeerConnection(p.UserId, TargetPublisher, trickle)
+	if err != nil {
+		return nil, err
+	}
+	userId := p.UserId
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		s.onTrack(userId, pc, remote, receiver)
+	})
+	p.pub = pc
+	return pc, nil
+}
+
+// Publish 处理发布连接的 offer，answer 通过 publish 消息发给客户端
+// 客户端增减轨道后再次 publish 即可重新协商
+func (s *SFU) Publish(userId string, offer webrtc.SessionDescription) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+
+	pc, err := s.publisher(s.peer(userId), true)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return msg.NewError(msg.ErrCodeBadRequest, "offer无效 %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return msg.NewError(msg.ErrCodeInternal, "创建answer失败 %v", err)
+	}
+	if err := s.setLocal(pc, userId, Publish, answer); err != nil {
+		return msg.NewError(msg.ErrCodeInternal, "设置answer失败 %v", err)
+	}
+	return nil
+}
+
+// Ingest 处理 WHIP 推流端的 offer，等待 candidate 收集完成后返回完整的 answer
+// 推流连接关闭或失败后调用 onClose
+func (s *SFU) Ingest(userId string, offer webrtc.SessionDescription, onClose func()) (*webrtc.SessionDescription, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errClosed
+	}
+	p := s.peer(userId)
+	if p.pub != nil {
+		s.mu.Unlock()
+		return nil, msg.NewError(msg.ErrCodeConflict, "用户 [%s] 已经在推流", userId)
+	}
+	pc, err := s.publisher(p, false)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.mu.Unlock()
+
+	fail := func(err error) (*webrtc.SessionDescription, error) {
+		s.dropPeerConnection(userId, pc)
+		return nil, err
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fail(msg.NewError(msg.ErrCodeBadRequest, "offer无效 %v", err))
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(msg.NewError(msg.ErrCodeInternal, "创建answer失败 %v", err))
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail(msg.NewError(msg.ErrCodeInternal, "设置answer失败 %v", err))
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		logger.Log.Warnf("房间 [%s] 用户 [%s] candidate收集超时", s.RoomId, userId)
+	}
+
+	s.mu.Lock()
+	p.onClose = onClose
+	s.mu.Unlock()
+	return pc.LocalDescription(), nil
+}
+
+// Subscribe 订阅发布者的轨道，publishers 为空表示订阅所有人，返回当前可订阅的轨道
+// 轨道变化时服务端发送 sfuOffer，客户端回复 sfuAnswer
+func (s *SFU) Subscribe(userId string, publishers []string) ([]TrackInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errClosed
+	}
+
+	p := s.peer(userId)
+	if p.sub == nil {
+		pc, err := s.newPeerConnection(userId, TargetSubscriber, true)
+		if err != nil {
+			return nil, err
+		}
+		p.sub = pc
+	}
+	p.subscribed = true
+	p.publishers = publishers
+
+	changed := false
+	infos := make([]TrackInfo, 0, len(s.tracks))
+	for id, t := range s.tracks {
+		_, has := p.senders[id]
+		want := p.wants(t)
+		if want {
+			infos = append(infos, t.Info())
+		}
+		if want && !has {
+			s.addSender(p, t)
+			changed = true
+		} else if !want && has {
+			s.removeSender(p, id)
+			changed = true
+		}
+	}
+
+	if changed {
+		s.negotiate(p)
+	}
+	return infos, nil
+}
+
+// Answer 订阅连接的 answer
+func (s *SFU) Answer(userId string, answer webrtc.SessionDescription) error {
+	s.mu.Lock()
+	p, ok := s.peers[userId]
+	if !ok || p.sub == nil {
+		s.mu.Unlock()
+		return msg.NewError(msg.ErrCodeConflict, "没有订阅")
+	}
+	pc := p.sub
+	s.mu.Unlock()
+
+	err := pc.SetRemoteDescription(answer)
+
+	//answer 无效时同样结束这次协商，有等待的变化时重新发 offer
+	s.mu.Lock()
+	if p.sub == pc {
+		p.negotiating = false
+		if p.pending {
+			p.pending = false
+			s.negotiate(p)
+		}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return msg.NewError(msg.ErrCodeBadRequest, "answer无效 %v", err)
+	}
+	return nil
+}
+
+// Candidate 客户端的 candidate
+func (s *SFU) Candidate(userId string, target string, candidate webrtc.ICECandidateInit) error {
+	s.mu.Lock()
+	var pc *webrtc.PeerConnection
+	if p, ok := s.peers[userId]; ok {
+		if target == TargetSubscriber {
+			pc = p.sub
+		} else {
+			pc = p.pub
+		}
+	}
+	s.mu.Unlock()
+
+	if pc == nil {
+		return msg.NewError(msg.ErrCodeConflict, "%s 连接不存在", target)
+	}
+	if err := pc.AddICECandidate(candidate); err != nil {
+		return msg.NewError(msg.ErrCodeBadRequest, "candidate无效 %v", err)
+	}
+	return nil
+}
+
+// Unpublish 取消发布，trackIds 为空表示取消所有轨道并关闭发布连接
+func (s *SFU) Unpublish(userId string, trackIds []string) error {
+	s.mu.Lock()
+	p, ok := s.peers[userId]
+	if !ok || p.pub == nil {
+		s.mu.Unlock()
+		return msg.NewError(msg.ErrCodeConflict, "没有发布")
+	}
+
+	var pc *webrtc.PeerConnection
+	var removed []*Track
+	if len(trackIds) == 0 {
+		pc = p.pub
+		p.pub = nil
+		removed = s.tracksOf(userId)
+	} else {
+		for _, id := range trackIds {
+			if t, ok := s.tracks[trackId(userId, id)]; ok {
+				t.receiver.Stop()
+				removed = append(removed, t)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if pc != nil {
+		pc.Close()
+	}
+	for _, t := range removed {
+		s.removeTrack(t)
+	}
+	return nil
+}
+
+// RemovePeer 用户离开房间，立即移除用户，连接在后台关闭
+// 返回后同一用户重新加入创建的是新的 Peer，不会被后台的关闭影响，可以在房间协程中调用
+func (s *SFU) RemovePeer(userId string) {
+	s.mu.Lock()
+	p, ok := s.peers[userId]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.peers, userId)
+	removed := s.tracksOf(userId)
+	s.mu.Unlock()
+
+	go func() {
+		p.close()
+		for _, t := range removed {
+			s.removeTrack(t)
+		}
+	}()
+}
+
+// Close 房间关闭
+func (s *SFU) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	peers := s.peers
+	s.peers = make(map[string]*Peer)
+	s.tracks = make(map[string]*Track)
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		p.close()
+	}
+	s.out.Close()
+}
+
+// Tracks 当前发布的所有轨道
+func (s *SFU) Tracks() []TrackInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]TrackInfo, 0, len(s.tracks))
+	for _, t := range s.tracks {
+		infos = append(infos, t.Info())
+	}
+	return infos
+}
+
+// 用户发布的轨道，需要持有 mu
+func (s *SFU) tracksOf(userId string) []*Track {
+	var tracks []*Track
+	for _, t := range s.tracks {
+		if t.Publisher == userId {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// 给订阅连接发 offer，上一次协商未完成时等 answer 后再发，需要持有 mu
+func (s *SFU) negotiate(p *Peer) {
+	if p.sub == nil {
+		return
+	}
+	if p.negotiating {
+		p.pending = true
+		return
+	}
+
+	offer, err := p.sub.CreateOffer(nil)
+	if err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 创建offer失败 %v", s.RoomId, p.UserId, err)
+		return
+	}
+
+	if err := s.setLocal(p.sub, p.UserId, SfuOffer, offer); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 设置offer失败 %v", s.RoomId, p.UserId, err)
+		return
+	}
+	p.negotiating = true
+}
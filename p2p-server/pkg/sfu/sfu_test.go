@@ -0,0 +1,197 @@
+package sfu
+
+import (
+	"os"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// 把 SFU 的信令直接交给测试中的客户端连接
+type loopback struct {
+	t   *testing.T
+	sfu *SFU
+	//用户Id -> 客户端的发布/订阅连接
+	pub map[string]*webrtc.PeerConnection
+	sub map[string]*webrtc.PeerConnection
+}
+
+func (l *loopback) Signal(userId string, msgType string, data any) {
+	switch msgType {
+	case Publish:
+		desc := data.(DescriptionSignal).Description
+		if err := l.pub[userId].SetRemoteDescription(desc); err != nil {
+			l.t.Errorf("设置 publish answer 失败 %v", err)
+		}
+	case SfuOffer:
+		pc := l.sub[userId]
+		if err := pc.SetRemoteDescription(data.(DescriptionSignal).Description); err != nil {
+			l.t.Errorf("设置 sfuOffer 失败 %v", err)
+			return
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			l.t.Errorf("创建 answer 失败 %v", err)
+			return
+		}
+		gathered := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(answer); err != nil {
+			l.t.Errorf("设置 answer 失败 %v", err)
+			return
+		}
+		<-gathered
+		if err := l.sfu.Answer(userId, *pc.LocalDescription()); err != nil {
+			l.t.Errorf("sfuAnswer 失败 %v", err)
+		}
+	case SfuCandidate:
+		c := data.(CandidateSignal)
+		pc := l.pub[userId]
+		if c.Target == TargetSubscriber {
+			pc = l.sub[userId]
+		}
+		if err := pc.AddICECandidate(c.Candidate); err != nil {
+			l.t.Errorf("添加 candidate 失败 %v", err)
+		}
+	}
+}
+
+func (l *loopback) Broadcast(except string, msgType string, data any) {}
+
+func newClient(t *testing.T) *webrtc.PeerConnection {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// 发布端的 RTP 经 SFU 转发到订阅端
+func TestLoopback(t *testing.T) {
+	api, err := NewAPI(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &loopback{
+		t:   t,
+		pub: map[string]*webrtc.PeerConnection{"alice": newClient(t)},
+		sub: map[string]*webrtc.PeerConnection{"bob": newClient(t)},
+	}
+	s := New("room", api, Config{}, sig)
+	sig.sfu = s
+	defer s.Close()
+
+	received := make(chan *rtp.Packet, 1)
+	sig.sub["bob"].OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if remote.StreamID() != "alice" {
+			t.Errorf("订阅端收到的 stream id %s", remote.StreamID())
+		}
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			t.Errorf("读取 RTP 失败 %v", err)
+			return
+		}
+		received <- pkt
+	})
+
+	if _, err := s.Subscribe("bob", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	//发布端收集完 candidate 后一次性发 offer
+	pc := sig.pub["alice"]
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := s.Publish("alice", *pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+	timeout := time.After(10 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for seq := uint16(0); ; seq++ {
+		select {
+		case pkt := <-received:
+			if string(pkt.Payload) != string(payload) {
+				t.Fatalf("订阅端收到的负载 %x，期望 %x", pkt.Payload, payload)
+			}
+			if infos := s.Tracks(); len(infos) != 1 || infos[0].Publisher != "alice" {
+				t.Fatalf("SFU 中的轨道 %+v", infos)
+			}
+			return
+		case <-timeout:
+			t.Fatal("订阅端没有收到 RTP")
+		case <-ticker.C:
+			if err := track.WriteRTP(&rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					SequenceNumber: seq,
+					Timestamp:      uint32(seq) * 3000,
+				},
+				Payload: payload,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// 丢弃所有信令
+type discard struct{}
+
+func (discard) Signal(userId string, msgType string, data any)    {}
+func (discard) Broadcast(except string, msgType string, data any) {}
+
+// 离开后马上重新加入，后台关闭旧连接不影响新的 Peer
+func TestRemovePeerRejoin(t *testing.T) {
+	api, err := NewAPI(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("room", api, Config{}, discard{})
+	defer s.Close()
+
+	if _, err := s.Subscribe("bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	old := s.peers["bob"]
+	s.mu.Unlock()
+
+	s.RemovePeer("bob")
+	if _, err := s.Subscribe("bob", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers["bob"]
+	if !ok || p == old || p.sub == nil {
+		t.Fatal("重新加入的用户被移除")
+	}
+}
@@ -0,0 +1,171 @@
+package sfu
+
+import (
+	"errors"
+	"io"
+	"webrtc/p2p-server/pkg/logger"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Track 转发的轨道
+type Track struct {
+	//发布者Id/客户端轨道Id
+	Id        string
+	Publisher string
+	Kind      string
+	//转发给订阅者的本地轨道
+	local *webrtc.TrackLocalStaticRTP
+	//发布连接中的 receiver
+	receiver *webrtc.RTPReceiver
+	//发布连接，用于请求关键帧
+	pc   *webrtc.PeerConnection
+	ssrc uint32
+}
+
+// TrackInfo 轨道信息
+type TrackInfo struct {
+	TrackId   string `json:"track_id"`
+	Publisher string `json:"publisher"`
+	Kind      string `json:"kind"`
+	//订阅端收到的 stream id，与发布者Id相同
+	StreamId string `json:"stream_id"`
+}
+
+func (t *Track) Info() TrackInfo {
+	return TrackInfo{
+		TrackId:   t.local.ID(),
+		Publisher: t.Publisher,
+		Kind:      t.Kind,
+		StreamId:  t.local.StreamID(),
+	}
+}
+
+func trackId(publisher string, id string) string {
+	return publisher + "/" + id
+}
+
+// 请求发布者发送关键帧
+func (t *Track) requestKeyframe() {
+	if t.Kind != webrtc.RTPCodecTypeVideo.String() {
+		return
+	}
+	t.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: t.ssrc}})
+}
+
+// 收到发布者的轨道
+func (s *SFU) onTrack(userId string, pc *webrtc.PeerConnection, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	//订阅端用发布者Id作为 stream id 区分不同用户
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), userId)
+	if err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 创建转发轨道失败 %v", s.RoomId, userId, err)
+		return
+	}
+
+	t := &Track{
+		Id:        trackId(userId, remote.ID()),
+		Publisher: userId,
+		Kind:      remote.Kind().String(),
+		local:     local,
+		receiver:  receiver,
+		pc:        pc,
+		ssrc:      uint32(remote.SSRC()),
+	}
+
+	s.mu.Lock()
+	if p, ok := s.peers[userId]; s.closed || !ok || p.pub != pc {
+		s.mu.Unlock()
+		return
+	}
+	s.tracks[t.Id] = t
+	for _, p := range s.peers {
+		if p.wants(t) {
+			s.addSender(p, t)
+			s.negotiate(p)
+		}
+	}
+	s.mu.Unlock()
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 发布轨道 %s %s", s.RoomId, userId, t.Kind, t.Id)
+	s.broadcast(userId, TrackPublished, t.Info())
+
+	s.forward(t, remote)
+}
+
+// 转发 RTP 包，发布者的轨道结束后移除
+func (s *SFU) forward(t *Track, remote *webrtc.TrackRemote) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			break
+		}
+		if _, err := t.local.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			break
+		}
+	}
+	s.removeTrack(t)
+}
+
+// 移除轨道并通知其他用户
+// 按实例移除，用户重新加入后发布的同Id轨道不受旧轨道影响
+func (s *SFU) removeTrack(t *Track) {
+	s.mu.Lock()
+	if s.tracks[t.Id] != t {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.tracks, t.Id)
+	for _, p := range s.peers {
+		if _, ok := p.senders[t.Id]; ok {
+			s.removeSender(p, t.Id)
+			s.negotiate(p)
+		}
+	}
+	s.mu.Unlock()
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 取消发布轨道 %s", s.RoomId, t.Publisher, t.Id)
+	s.broadcast(t.Publisher, TrackUnpublished, t.Info())
+}
+
+// 把轨道加入订阅连接，需要持有 mu
+func (s *SFU) addSender(p *Peer, t *Track) {
+	if p.sub == nil {
+		return
+	}
+	sender, err := p.sub.AddTrack(t.local)
+	if err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 订阅轨道 %s 失败 %v", s.RoomId, p.UserId, t.Id, err)
+		return
+	}
+	p.senders[t.Id] = sender
+
+	go readRTCP(sender, t)
+	t.requestKeyframe()
+}
+
+// 从订阅连接移除轨道，需要持有 mu
+func (s *SFU) removeSender(p *Peer, id string) {
+	sender := p.senders[id]
+	delete(p.senders, id)
+	if err := p.sub.RemoveTrack(sender); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 移除轨道 %s 失败 %v", s.RoomId, p.UserId, id, err)
+	}
+}
+
+// 读取订阅端的 RTCP，收到 PLI/FIR 时请求发布者发送关键帧
+func readRTCP(sender *webrtc.RTPSender, t *Track) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				t.requestKeyframe()
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import "sync"
+
+// TaskQueue 在单独的协程中按提交顺序执行任务，不限制长度，Push 不会阻塞
+type TaskQueue struct {
+	mu    sync.Mutex
+	items []func()
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewTaskQueue 创建队列并启动执行协程
+func NewTaskQueue() *TaskQueue {
+	q := &TaskQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Push 提交任务，队列关闭后提交的任务不会执行
+func (q *TaskQueue) Push(fn func()) {
+	q.mu.Lock()
+	q.items = append(q.items, fn)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *TaskQueue) run() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+
+		for {
+			q.mu.Lock()
+			if len(q.items) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			fn := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+
+			fn()
+		}
+	}
+}
+
+// Close 关闭队列，未执行的任务丢弃
+func (q *TaskQueue) Close() {
+	q.once.Do(func() {
+		close(q.done)
+	})
+}
@@ -1,6 +1,10 @@
 package utils
 
-import "encoding/json"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
 
 func Marshal(d any) string {
 	if data, err := json.Marshal(d); err != nil {
@@ -17,3 +21,12 @@ func Unmarshal(str string) map[string]any {
 	}
 	return data
 }
+
+// NewId 生成随机Id
+func NewId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,155 @@
+package whip
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+	"webrtc/p2p-server/pkg/server"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	contentTypeSdp     = "application/sdp"
+	contentTypeSdpFrag = "application/trickle-ice-sdpfrag"
+
+	//offer 最大长度
+	maxBodySize = 1 << 20
+
+	//进入房间的凭证，与 joinRoom 的 password、invite_token 相同
+	headerPassword = "X-Room-Password"
+	headerInvite   = "X-Room-Invite"
+)
+
+// WHIP/WHEP 共用的 Bearer token 认证
+type authenticator struct {
+	//接口名称，用于日志
+	name string
+	//开启认证时用 JWT 校验 Bearer token
+	verifier *auth.Verifier
+	//未开启认证时的静态 token
+	token string
+}
+
+func newAuthenticator(cfg *config.Config, name string, token string) *authenticator {
+	a := &authenticator{
+		name:  name,
+		token: token,
+	}
+
+	if cfg.Auth.Enable {
+		verifier, err := auth.NewVerifier(&cfg.Auth)
+		if err != nil {
+			panic(fmt.Errorf("Fatal error auth config: %s \n", err))
+		}
+		a.verifier = verifier
+	}
+
+	return a
+}
+
+// 校验 Authorization: Bearer <token>
+// 开启认证时 token 为 JWT，否则与配置的静态 token 比较
+func (a *authenticator) authenticate(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		server.Error(c, http.StatusUnauthorized, "未认证")
+		return
+	}
+
+	if a.verifier != nil {
+		identity, err := a.verifier.Verify(token)
+		if err != nil {
+			logger.Log.Warnf("%s token校验失败 %v", a.name, err)
+			server.Error(c, http.StatusUnauthorized, "token无效")
+			return
+		}
+		c.Set("identity", identity)
+		c.Next()
+		return
+	}
+
+	if len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		server.Error(c, http.StatusUnauthorized, "未认证")
+		return
+	}
+	c.Next()
+}
+
+func identityOf(c *gin.Context) *auth.Identity {
+	if v, ok := c.Get("identity"); ok {
+		return v.(*auth.Identity)
+	}
+	return nil
+}
+
+// 把房间错误转换为响应，标准的错误码直接作为 HTTP 状态码
+// 房间已满返回 503，推流端/观看端可以稍后重试
+func fail(c *gin.Context, err error) {
+	var e *msg.ErrorMsg
+	if errors.As(err, &e) {
+		if e.Code == msg.ErrCodeRoomFull {
+			server.Error(c, http.StatusServiceUnavailable, e.Message)
+			return
+		}
+		if e.Code >= 400 && e.Code < 600 && len(http.StatusText(e.Code)) > 0 {
+			server.Error(c, e.Code, e.Message)
+			return
+		}
+	}
+	server.Error(c, http.StatusInternalServerError, err.Error())
+}
+
+// 读取指定 Content-Type 的请求体，失败时已经写入响应
+func readBody(c *gin.Context, contentType string) ([]byte, bool) {
+	if !strings.HasPrefix(c.ContentType(), contentType) {
+		server.Error(c, http.StatusUnsupportedMediaType, "Content-Type必须是"+contentType)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBodySize))
+	if err != nil {
+		server.Error(c, http.StatusBadRequest, "读取请求失败")
+		return nil, false
+	}
+	return body, true
+}
+
+// 解析 trickle-ice-sdpfrag 中的 candidate，a=mid 之后的 candidate 属于该媒体
+func parseSdpFrag(frag string) []webrtc.ICECandidateInit {
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	var index uint16
+	mline := -1
+
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mline++
+			index = uint16(mline)
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			c := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			}
+			if mline >= 0 {
+				i := index
+				c.SDPMLineIndex = &i
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,77 @@
+package whip
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseSdpFrag(t *testing.T) {
+	const (
+		host  = "candidate:1 1 udp 2122260223 192.168.1.10 50000 typ host"
+		relay = "candidate:2 1 udp 41885439 198.51.100.7 3478 typ relay raddr 0.0.0.0 rport 0"
+	)
+	type want struct {
+		candidate string
+		mid       string
+		//-1 表示没有 mline index
+		index int
+	}
+
+	cases := []struct {
+		name string
+		frag string
+		want []want
+	}{
+		{"空", "", nil},
+		{"没有candidate", "a=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n", nil},
+		{"CRLF", "a=ice-ufrag:abcd\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=" + host + "\r\na=end-of-candidates\r\n",
+			[]want{{host, "0", 0}}},
+		{"LF", "m=audio 9 UDP/TLS/RTP/SAVPF 0\na=mid:0\na=" + host + "\n",
+			[]want{{host, "0", 0}}},
+		{"多个媒体", "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:a\r\na=" + host + "\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:v\r\na=" + relay + "\r\n",
+			[]want{{host, "a", 0}, {relay, "v", 1}}},
+		//mid 只对当前 m= 段有效
+		{"m=段没有mid", "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:a\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=" + relay + "\r\n",
+			[]want{{relay, "", 1}}},
+		{"m=之前的candidate", "a=" + host + "\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n",
+			[]want{{host, "", -1}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseSdpFrag(c.frag)
+			if len(got) != len(c.want) {
+				t.Fatalf("解析出 %d 个candidate，期望 %d 个", len(got), len(c.want))
+			}
+			for i, w := range c.want {
+				if !match(got[i], w.candidate, w.mid, w.index) {
+					t.Fatalf("第%d个candidate %+v，期望 %+v", i, describe(got[i]), w)
+				}
+			}
+		})
+	}
+}
+
+func match(c webrtc.ICECandidateInit, candidate string, mid string, index int) bool {
+	if c.Candidate != candidate {
+		return false
+	}
+	if (c.SDPMid == nil) != (len(mid) == 0) || (c.SDPMid != nil && *c.SDPMid != mid) {
+		return false
+	}
+	if index < 0 {
+		return c.SDPMLineIndex == nil
+	}
+	return c.SDPMLineIndex != nil && int(*c.SDPMLineIndex) == index
+}
+
+func describe(c webrtc.ICECandidateInit) map[string]any {
+	d := map[string]any{"candidate": c.Candidate}
+	if c.SDPMid != nil {
+		d["mid"] = *c.SDPMid
+	}
+	if c.SDPMLineIndex != nil {
+		d["index"] = *c.SDPMLineIndex
+	}
+	return d
+}
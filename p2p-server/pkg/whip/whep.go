@@ -0,0 +1,531 @@
+package whip
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/room"
+	"webrtc/p2p-server/pkg/server"
+	"webrtc/p2p-server/pkg/serverpeer"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultWhepPath = "/whep"
+
+	//等待 candidate 收集的最长时间
+	gatherTimeout = 5 * time.Second
+)
+
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// 观看端可选的视频编码，参与者按这个编码发给服务端
+var videoCodecs = map[string]webrtc.RTPCodecCapability{
+	"vp8": {
+		MimeType:     webrtc.MimeTypeVP8,
+		ClockRate:    90000,
+		RTCPFeedback: videoFeedback,
+	},
+	"vp9": {
+		MimeType:     webrtc.MimeTypeVP9,
+		ClockRate:    90000,
+		SDPFmtpLine:  "profile-id=0",
+		RTCPFeedback: videoFeedback,
+	},
+	"h264": {
+		MimeType:     webrtc.MimeTypeH264,
+		ClockRate:    90000,
+		SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		RTCPFeedback: videoFeedback,
+	},
+}
+
+var audioCodec = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+// Whep WHEP 播放接口，观看端不需要加入信令协议
+// 服务端用户以观众身份加入房间，向参与者拉取媒体后转发给观看端
+type Whep struct {
+	rm   *room.RoomManager
+	cfg  *config.Config
+	auth *authenticator
+	//观看端连接使用的 WebRTC 实例
+	api        *webrtc.API
+	iceServers []webrtc.ICEServer
+
+	mu      sync.Mutex
+	viewers map[string]*viewer
+}
+
+// 观看端选择的媒体，来自 query 参数
+type selection struct {
+	//只看这个用户，同一用户有多个同类轨道时转发最先到达的
+	user string
+	//只看这个轨道，SFU 轨道Id(发布者Id/轨道Id)或参与者的轨道Id
+	track string
+	//simulcast 层(rid)，为空时接收任意层
+	layer string
+	//是否接收音频、视频
+	audio bool
+	video bool
+	//视频编码
+	codec webrtc.RTPCodecCapability
+}
+
+// 一个观看会话
+type viewer struct {
+	id     string
+	roomId string
+	//认证后的身份，使用静态 token 时为 nil
+	identity *auth.Identity
+	sel      *selection
+	//观看端的连接
+	pc *webrtc.PeerConnection
+	//代观看端拉取媒体的服务端用户
+	peer *serverpeer.Peer
+	//按媒体类型发给观看端的轨道
+	outputs map[webrtc.RTPCodecType]*output
+	closed  atomic.Bool
+}
+
+// 发给观看端的一个轨道，同一时间只转发一个源
+// 选中的用户有多个同类轨道时，当前源结束后由下一个收到的源接替
+type output struct {
+	local *webrtc.TrackLocalStaticRTP
+
+	mu     sync.Mutex
+	source *webrtc.TrackRemote
+	//源所在的连接，用于请求关键帧
+	pc *webrtc.PeerConnection
+	//切换源后改写序号和时间戳，观看端看到的是一条连续的流
+	rebase    bool
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+}
+
+func NewWhep(rm *room.RoomManager, cfg *config.Config) *Whep {
+	sfuCfg := room.SfuConfig(cfg)
+	api, err := sfu.NewAPI(sfuCfg)
+	if err != nil {
+		panic(fmt.Errorf("Fatal error webrtc config: %s \n", err))
+	}
+
+	return &Whep{
+		rm:         rm,
+		cfg:        cfg,
+		auth:       newAuthenticator(cfg, "WHEP", cfg.Whep.Token),
+		api:        api,
+		iceServers: sfuCfg.ICEServers,
+		viewers:    make(map[string]*viewer),
+	}
+}
+
+// Register 注册 WHEP 路由
+func (w *Whep) Register(r gin.IRouter) {
+	path := w.cfg.Whep.Path
+	if len(path) == 0 {
+		path = defaultWhepPath
+	}
+
+	g := r.Group(path, w.auth.authenticate)
+	g.POST("/:room_id", w.play)
+	g.PATCH("/:room_id/:resource_id", w.trickle)
+	g.DELETE("/:room_id/:resource_id", w.stop)
+}
+
+// 解析 query 参数
+// user、track 选择源，至少指定一个，每种媒体只有一个发送轨道，不能同时转发多个参与者
+// layer 选择 simulcast 层，audio=0/video=0 不接收该媒体，codec 为 vp8/vp9/h264
+func parseSelection(c *gin.Context) (*selection, error) {
+	sel := &selection{
+		user:  c.Query("user"),
+		track: c.Query("track"),
+		layer: c.Query("layer"),
+		audio: c.DefaultQuery("audio", "1") != "0",
+		video: c.DefaultQuery("video", "1") != "0",
+	}
+
+	codec, ok := videoCodecs[strings.ToLower(c.DefaultQuery("codec", "vp8"))]
+	if !ok {
+		return nil, fmt.Errorf("不支持的视频编码 %s", c.Query("codec"))
+	}
+	sel.codec = codec
+
+	if !sel.audio && !sel.video {
+		return nil, fmt.Errorf("audio和video不能都关闭")
+	}
+	if len(sel.user) == 0 && len(sel.track) == 0 {
+		return nil, fmt.Errorf("需要用user或track指定观看的源")
+	}
+	return sel, nil
+}
+
+// 指定类型的媒体使用的编码，不接收时返回 false
+func (s *selection) codecOf(kind webrtc.RTPCodecType) (webrtc.RTPCodecCapability, bool) {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return audioCodec, s.audio
+	case webrtc.RTPCodecTypeVideo:
+		return s.codec, s.video
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// 服务端用户的设置，参与者只发送观看端能接收的编码
+func (s *selection) peerConfig() serverpeer.Config {
+	cfg := serverpeer.Config{}
+	if s.audio {
+		cfg.Codecs = append(cfg.Codecs, webrtc.RTPCodecParameters{RTPCodecCapability: audioCodec})
+		cfg.Kinds = append(cfg.Kinds, webrtc.RTPCodecTypeAudio)
+	}
+	if s.video {
+		cfg.Codecs = append(cfg.Codecs, webrtc.RTPCodecParameters{RTPCodecCapability: s.codec})
+		cfg.Kinds = append(cfg.Kinds, webrtc.RTPCodecTypeVideo)
+	}
+	if len(s.user) > 0 {
+		cfg.Users = []string{s.user}
+	}
+	return cfg
+}
+
+// 轨道是否符合选择条件
+func (s *selection) matches(userId string, track *webrtc.TrackRemote) bool {
+	if len(s.user) > 0 && s.user != userId {
+		return false
+	}
+	if len(s.track) > 0 && s.track != track.ID() && s.track != userId+"/"+track.ID() {
+		return false
+	}
+	if len(s.layer) > 0 && len(track.RID()) > 0 && s.layer != track.RID() {
+		return false
+	}
+	return true
+}
+
+// 开始观看，body 为 SDP offer，返回 201 和完整的 SDP answer
+// 凭证与推流相同，放在 X-Room-Password、X-Room-Invite 中
+func (w *Whep) play(c *gin.Context) {
+	offer, ok := readBody(c, contentTypeSdp)
+	if !ok {
+		return
+	}
+	if len(offer) == 0 {
+		server.Error(c, http.StatusBadRequest, "offer不能为空")
+		return
+	}
+	sel, err := parseSelection(c)
+	if err != nil {
+		server.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := &viewer{
+		id:       utils.NewId(),
+		roomId:   c.Param("room_id"),
+		identity: identityOf(c),
+		sel:      sel,
+		outputs:  make(map[webrtc.RTPCodecType]*output),
+	}
+
+	pc, err := w.api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: w.iceServers,
+	})
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	v.pc = pc
+
+	answer, err := v.answer(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	})
+	if err != nil {
+		pc.Close()
+		server.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	peer, err := w.rm.Watch(v.identity, v.roomId, c.GetHeader(headerPassword), c.GetHeader(headerInvite), sel.peerConfig(), serverpeer.Handlers{
+		OnTrack: v.forward,
+		OnClose: func() {
+			w.remove(v)
+		},
+	})
+	if err != nil {
+		pc.Close()
+		fail(c, err)
+		return
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			w.remove(v)
+		}
+	})
+
+	w.mu.Lock()
+	v.peer = peer
+	if !v.closed.Load() {
+		w.viewers[v.id] = v
+	}
+	w.mu.Unlock()
+
+	//加入房间期间已经被移除
+	if v.closed.Load() {
+		w.rm.Unwatch(peer)
+		server.Error(c, http.StatusNotFound, "房间已关闭")
+		return
+	}
+
+	logger.Log.Infof("房间 [%s] 观看端 [%s] 开始WHEP播放 %s", v.roomId, peer.UserId, v.id)
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+v.id)
+	c.Data(http.StatusCreated, contentTypeSdp, []byte(answer.SDP))
+}
+
+// 查找观看会话，校验房间和用户
+func (w *Whep) find(c *gin.Context) *viewer {
+	w.mu.Lock()
+	v, ok := w.viewers[c.Param("resource_id")]
+	w.mu.Unlock()
+
+	if !ok || v.roomId != c.Param("room_id") {
+		server.Error(c, http.StatusNotFound, "播放不存在")
+		return nil
+	}
+	if identity := identityOf(c); identity != nil && (v.identity == nil || identity.Subject != v.identity.Subject) {
+		server.Error(c, http.StatusForbidden, "没有权限")
+		return nil
+	}
+	return v
+}
+
+// trickle ICE，body 为 SDP 片段
+func (w *Whep) trickle(c *gin.Context) {
+	v := w.find(c)
+	if v == nil {
+		return
+	}
+	frag, ok := readBody(c, contentTypeSdpFrag)
+	if !ok {
+		return
+	}
+
+	for _, candidate := range parseSdpFrag(string(frag)) {
+		if err := v.pc.AddICECandidate(candidate); err != nil {
+			server.Error(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// 停止观看
+func (w *Whep) stop(c *gin.Context) {
+	v := w.find(c)
+	if v == nil {
+		return
+	}
+	w.remove(v)
+	c.Status(http.StatusOK)
+}
+
+// 关闭观看端连接，服务端用户离开房间，重复调用只执行一次
+func (w *Whep) remove(v *viewer) {
+	if v.closed.Swap(true) {
+		return
+	}
+
+	w.mu.Lock()
+	delete(w.viewers, v.id)
+	peer := v.peer
+	w.mu.Unlock()
+
+	v.pc.Close()
+	if peer == nil {
+		return
+	}
+	if !peer.IsClosed() {
+		if err := w.rm.Unwatch(peer); err != nil {
+			logger.Log.Warnf("房间 [%s] 观看端 [%s] 离开房间失败 %v", v.roomId, peer.UserId, err)
+		}
+	}
+	logger.Log.Infof("房间 [%s] 观看端 [%s] 结束WHEP播放 %s", v.roomId, peer.UserId, v.id)
+}
+
+// 按观看端的 offer 为每种媒体创建一个发送轨道，返回收集完 candidate 的 answer
+func (v *viewer) answer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	pc := v.pc
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return nil, fmt.Errorf("offer无效 %v", err)
+	}
+
+	var kinds []webrtc.RTPCodecType
+	for _, t := range pc.GetTransceivers() {
+		kinds = append(kinds, t.Kind())
+	}
+	for _, kind := range kinds {
+		codec, ok := v.sel.codecOf(kind)
+		if _, exists := v.outputs[kind]; exists || !ok {
+			continue
+		}
+		local, err := webrtc.NewTrackLocalStaticRTP(codec, kind.String(), v.roomId)
+		if err != nil {
+			return nil, err
+		}
+		sender, err := pc.AddTrack(local)
+		if err != nil {
+			return nil, err
+		}
+		out := &output{local: local}
+		v.outputs[kind] = out
+		go out.readRTCP(sender)
+	}
+	if len(v.outputs) == 0 {
+		return nil, fmt.Errorf("offer中没有可接收的媒体")
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建answer失败 %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("设置answer失败 %v", err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		logger.Log.Warnf("房间 [%s] WHEP播放 %s candidate收集超时", v.roomId, v.id)
+	}
+	return pc.LocalDescription(), nil
+}
+
+// 把参与者的轨道转发给观看端，直到轨道结束
+func (v *viewer) forward(userId string, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	out, ok := v.outputs[track.Kind()]
+	if !ok || !v.sel.matches(userId, track) {
+		return
+	}
+	if !strings.EqualFold(track.Codec().MimeType, out.local.Codec().MimeType) {
+		logger.Log.Warnf("房间 [%s] WHEP播放 %s 用户 [%s] 的编码 %s 与观看端不一致", v.roomId, v.id, userId, track.Codec().MimeType)
+		return
+	}
+	defer out.detach(track)
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		//其他源正在转发时丢弃，等它结束后接替
+		if !out.attach(pc, track) {
+			continue
+		}
+		if err := out.write(packet); err != nil {
+			return
+		}
+	}
+}
+
+// 成为当前源，已经是当前源或成功接替时返回 true
+func (o *output) attach(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) bool {
+	o.mu.Lock()
+	if o.source == track {
+		o.mu.Unlock()
+		return true
+	}
+	if o.source != nil {
+		o.mu.Unlock()
+		return false
+	}
+	o.source = track
+	o.pc = pc
+	o.rebase = true
+	o.mu.Unlock()
+
+	o.requestKeyframe()
+	return true
+}
+
+// 源结束
+func (o *output) detach(track *webrtc.TrackRemote) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.source == track {
+		o.source = nil
+		o.pc = nil
+	}
+}
+
+func (o *output) write(packet *rtp.Packet) error {
+	o.mu.Lock()
+	if o.rebase {
+		o.rebase = false
+		if o.started {
+			o.seqOffset = o.lastSeq + 1 - packet.SequenceNumber
+			o.tsOffset = o.lastTs + 1 - packet.Timestamp
+		}
+	}
+	packet.SequenceNumber += o.seqOffset
+	packet.Timestamp += o.tsOffset
+	o.lastSeq = packet.SequenceNumber
+	o.lastTs = packet.Timestamp
+	o.started = true
+	o.mu.Unlock()
+
+	return o.local.WriteRTP(packet)
+}
+
+// 向当前源请求关键帧
+func (o *output) requestKeyframe() {
+	o.mu.Lock()
+	pc, source := o.pc, o.source
+	o.mu.Unlock()
+
+	if source == nil || source.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(source.SSRC())}})
+}
+
+// 观看端请求关键帧时转给当前源
+func (o *output) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				o.requestKeyframe()
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package whip
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webrtc/p2p-server/pkg/auth"
+	"webrtc/p2p-server/pkg/config"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/room"
+	"webrtc/p2p-server/pkg/server"
+	"webrtc/p2p-server/pkg/sfu"
+	"webrtc/p2p-server/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultPath = "/whip"
+
+// Whip WHIP 推流接口，推流端以参与者身份加入 SFU 房间
+type Whip struct {
+	rm   *room.RoomManager
+	cfg  *config.Config
+	auth *authenticator
+
+	mu        sync.Mutex
+	resources map[string]*resource
+}
+
+// 一个推流会话，实现房间的 Conn
+type resource struct {
+	id     string
+	roomId string
+	userId string
+	//认证后的身份，使用静态 token 时为 nil
+	identity *auth.Identity
+	sfu      *sfu.SFU
+	closed   atomic.Bool
+}
+
+// Send 推流端没有信令通道，房间消息直接丢弃
+func (r *resource) Send(data string) error {
+	return nil
+}
+
+func (r *resource) IsClosed() bool {
+	return r.closed.Load()
+}
+
+func (r *resource) RTT() time.Duration {
+	return 0
+}
+
+func (r *resource) Identity() *auth.Identity {
+	return r.identity
+}
+
+func NewWhip(rm *room.RoomManager, cfg *config.Config) *Whip {
+	return &Whip{
+		rm:        rm,
+		cfg:       cfg,
+		auth:      newAuthenticator(cfg, "WHIP", cfg.Whip.Token),
+		resources: make(map[string]*resource),
+	}
+}
+
+// Register 注册 WHIP 路由
+func (w *Whip) Register(r gin.IRouter) {
+	path := w.cfg.Whip.Path
+	if len(path) == 0 {
+		path = defaultPath
+	}
+
+	g := r.Group(path, w.auth.authenticate)
+	g.POST("/:room_id", w.publish)
+	g.PATCH("/:room_id/:resource_id", w.trickle)
+	g.DELETE("/:room_id/:resource_id", w.stop)
+}
+
+// 开始推流，body 为 SDP offer，返回 201 和完整的 SDP answer
+// 有密码或只能邀请加入的房间需要在 X-Room-Password、X-Room-Invite 中带上凭证
+func (w *Whip) publish(c *gin.Context) {
+	offer, ok := readBody(c, contentTypeSdp)
+	if !ok {
+		return
+	}
+	if len(offer) == 0 {
+		server.Error(c, http.StatusBadRequest, "offer不能为空")
+		return
+	}
+
+	res := &resource{
+		id:       utils.NewId(),
+		roomId:   c.Param("room_id"),
+		identity: identityOf(c),
+	}
+	//JWT 认证时用 token 中的用户，否则生成推流用户
+	res.userId = "whip-" + res.id[:8]
+	if res.identity != nil {
+		res.userId = res.identity.Subject
+	}
+	name := c.DefaultQuery("name", res.userId)
+
+	s, err := w.rm.Ingest(res, res.roomId, res.userId, name, c.GetHeader(headerPassword), c.GetHeader(headerInvite))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	res.sfu = s
+
+	answer, err := s.Ingest(res.userId, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	}, func() {
+		w.remove(res)
+	})
+	if err != nil {
+		w.remove(res)
+		fail(c, err)
+		return
+	}
+
+	w.mu.Lock()
+	w.resources[res.id] = res
+	w.mu.Unlock()
+
+	logger.Log.Infof("房间 [%s] 用户 [%s] 开始WHIP推流 %s", res.roomId, res.userId, res.id)
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+res.id)
+	c.Data(http.StatusCreated, contentTypeSdp, []byte(answer.SDP))
+}
+
+// 查找推流会话，校验房间和用户
+func (w *Whip) find(c *gin.Context) *resource {
+	w.mu.Lock()
+	res, ok := w.resources[c.Param("resource_id")]
+	w.mu.Unlock()
+
+	if !ok || res.roomId != c.Param("room_id") {
+		server.Error(c, http.StatusNotFound, "推流不存在")
+		return nil
+	}
+	if identity := identityOf(c); identity != nil && identity.Subject != res.userId {
+		server.Error(c, http.StatusForbidden, "没有权限")
+		return nil
+	}
+	return res
+}
+
+// trickle ICE，body 为 SDP 片段
+func (w *Whip) trickle(c *gin.Context) {
+	res := w.find(c)
+	if res == nil {
+		return
+	}
+	frag, ok := readBody(c, contentTypeSdpFrag)
+	if !ok {
+		return
+	}
+
+	for _, candidate := range parseSdpFrag(string(frag)) {
+		if err := res.sfu.Candidate(res.userId, sfu.TargetPublisher, candidate); err != nil {
+			fail(c, err)
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// 停止推流
+func (w *Whip) stop(c *gin.Context) {
+	res := w.find(c)
+	if res == nil {
+		return
+	}
+	w.remove(res)
+	c.Status(http.StatusOK)
+}
+
+// 推流端离开房间，重复调用只执行一次
+func (w *Whip) remove(res *resource) {
+	if res.closed.Swap(true) {
+		return
+	}
+
+	w.mu.Lock()
+	delete(w.resources, res.id)
+	w.mu.Unlock()
+
+	if err := w.rm.LeaveRoom(res, res.roomId); err != nil {
+		logger.Log.Errorf("房间 [%s] 用户 [%s] 结束WHIP推流失败 %v", res.roomId, res.userId, err)
+		return
+	}
+	logger.Log.Infof("房间 [%s] 用户 [%s] 结束WHIP推流 %s", res.roomId, res.userId, res.id)
+}
@@ -0,0 +1,86 @@
+package ws
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingTime       = 5 * time.Second
+	defaultMaxMissedPongs = 3
+)
+
+// 连接存活检测
+type keepalive struct {
+	//ping 间隔
+	interval time.Duration
+	//允许连续丢失的 pong 次数
+	maxMissed int32
+	//连续未收到 pong 的次数
+	missed atomic.Int32
+	//最近一次测得的往返时间(纳秒)
+	rtt atomic.Int64
+}
+
+func newKeepalive(pingTime int, maxMissed int) *keepalive {
+	ka := &keepalive{
+		interval:  time.Duration(pingTime) * time.Second,
+		maxMissed: int32(maxMissed),
+	}
+	if ka.interval <= 0 {
+		ka.interval = defaultPingTime
+	}
+	if ka.maxMissed <= 0 {
+		ka.maxMissed = defaultMaxMissedPongs
+	}
+	return ka
+}
+
+// 收到 pong，payload 是发送 ping 时的时间戳
+func (wc *WsConn) handlePong(payload string) error {
+	wc.ka.missed.Store(0)
+
+	if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+		rtt := time.Since(time.Unix(0, sent))
+		if rtt >= 0 {
+			wc.ka.rtt.Store(int64(rtt))
+		}
+	}
+	return nil
+}
+
+// 定时发送 ping，连续丢失 pong 超过阈值时关闭连接
+func (wc *WsConn) pingLoop() {
+	ticker := time.NewTicker(wc.ka.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wc.closed:
+			return
+		case <-ticker.C:
+			if wc.ka.missed.Load() >= wc.ka.maxMissed {
+				logger.Log.Warnf("连续 %d 次没有收到pong，关闭连接", wc.ka.maxMissed)
+				wc.shutdown(websocket.CloseAbnormalClosure, "ping timeout")
+				return
+			}
+
+			wc.ka.missed.Add(1)
+
+			//WriteControl 可以和写协程并发调用
+			payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := wc.conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(wc.writeTimeout)); err != nil {
+				logger.Log.Warnf("发送ping错误 %v", err)
+			}
+		}
+	}
+}
+
+// RTT 返回最近一次测得的往返时间，还没有测量时返回 0
+func (wc *WsConn) RTT() time.Duration {
+	return time.Duration(wc.ka.rtt.Load())
+}
@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/metrics"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/gorilla/websocket"
+)
+
+// 发送队列满时的处理策略
+const (
+	OverflowDropOldest = "drop_oldest" //丢弃队列中最旧的消息
+	OverflowDropNewest = "drop_newest" //丢弃当前要发送的消息
+	OverflowDisconnect = "disconnect"  //断开慢消费者
+)
+
+const (
+	defaultSendQueueSize = 256
+	defaultWriteTimeout  = 10 * time.Second
+)
+
+var (
+	ErrClosed    = errors.New("closed")
+	ErrQueueFull = errors.New("send queue full")
+)
+
+// QueueStats 发送队列统计
+type QueueStats struct {
+	//当前队列长度
+	Depth int `json:"depth"`
+	//队列容量
+	Capacity int `json:"capacity"`
+	//历史最大队列长度
+	MaxDepth int `json:"max_depth"`
+	//已写出的消息数
+	Sent uint64 `json:"sent"`
+	//被丢弃的消息数
+	Dropped uint64 `json:"dropped"`
+}
+
+// 出站队列
+type outQueue struct {
+	ch       chan []byte
+	policy   string
+	maxDepth atomic.Int64
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+func newOutQueue(size int, policy string) *outQueue {
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+	switch policy {
+	case OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+	default:
+		policy = OverflowDisconnect
+	}
+	return &outQueue{
+		ch:     make(chan []byte, size),
+		policy: policy,
+	}
+}
+
+// 入队，队列满时按策略处理，返回 false 表示消息没有入队
+// 调用方需要保证入队串行
+func (q *outQueue) push(data []byte) bool {
+	select {
+	case q.ch <- data:
+		q.updateMaxDepth()
+		metrics.QueueDepth.Inc()
+		return true
+	default:
+	}
+
+	if q.policy == OverflowDropOldest {
+		select {
+		case <-q.ch:
+			q.dropped.Add(1)
+			metrics.QueueDropped.Inc()
+			metrics.QueueDepth.Dec()
+		default:
+		}
+		select {
+		case q.ch <- data:
+			q.updateMaxDepth()
+			metrics.QueueDepth.Inc()
+			return true
+		default:
+		}
+	}
+
+	q.dropped.Add(1)
+	metrics.QueueDropped.Inc()
+	return false
+}
+
+// 连接关闭后丢弃队列中剩余的消息
+func (q *outQueue) drain() {
+	for {
+		select {
+		case <-q.ch:
+			metrics.QueueDepth.Dec()
+		default:
+			return
+		}
+	}
+}
+
+func (q *outQueue) updateMaxDepth() {
+	depth := int64(len(q.ch))
+	for {
+		old := q.maxDepth.Load()
+		if depth <= old || q.maxDepth.CompareAndSwap(old, depth) {
+			return
+		}
+	}
+}
+
+func (q *outQueue) stats() QueueStats {
+	return QueueStats{
+		Depth:    len(q.ch),
+		Capacity: cap(q.ch),
+		MaxDepth: int(q.maxDepth.Load()),
+		Sent:     q.sent.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
+
+// 写协程，连接上唯一调用 WriteMessage 的地方
+func (wc *WsConn) writePump() {
+	defer wc.out.drain()
+
+	for {
+		select {
+		case <-wc.closed:
+			return
+		case data := <-wc.out.ch:
+			metrics.QueueDepth.Dec()
+			wc.conn.SetWriteDeadline(time.Now().Add(wc.writeTimeout))
+			if err := wc.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				logger.Log.Warnf("写消息错误 %v", err)
+				wc.shutdown(websocket.CloseAbnormalClosure, err.Error())
+				return
+			}
+			wc.out.sent.Add(1)
+			metrics.MessagesOut.WithLabelValues(msg.PeekType(data)).Inc()
+		}
+	}
+}
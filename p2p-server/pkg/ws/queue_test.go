@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/msg"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// 队列中剩余的消息
+func queued(q *outQueue) []string {
+	var out []string
+	for {
+		select {
+		case data := <-q.ch:
+			out = append(out, string(data))
+		default:
+			return out
+		}
+	}
+}
+
+func TestOutQueueOverflow(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  string
+		pushed  []bool
+		queued  []string
+		dropped uint64
+	}{
+		{"丢弃最旧", OverflowDropOldest, []bool{true, true, true}, []string{"b", "c"}, 1},
+		{"丢弃最新", OverflowDropNewest, []bool{true, true, false}, []string{"a", "b"}, 1},
+		{"断开", OverflowDisconnect, []bool{true, true, false}, []string{"a", "b"}, 1},
+		{"未知策略按断开处理", "unknown", []bool{true, true, false}, []string{"a", "b"}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := newOutQueue(2, c.policy)
+			var pushed []bool
+			for _, data := range []string{"a", "b", "c"} {
+				pushed = append(pushed, q.push([]byte(data)))
+			}
+			if !slices.Equal(pushed, c.pushed) {
+				t.Fatalf("入队结果 %v，期望 %v", pushed, c.pushed)
+			}
+
+			stats := q.stats()
+			if stats.Capacity != 2 || stats.Depth != 2 || stats.MaxDepth != 2 || stats.Dropped != c.dropped {
+				t.Fatalf("队列统计 %+v", stats)
+			}
+			if got := queued(q); !slices.Equal(got, c.queued) {
+				t.Fatalf("队列中的消息 %v，期望 %v", got, c.queued)
+			}
+		})
+	}
+}
+
+func TestOutQueueDefaults(t *testing.T) {
+	q := newOutQueue(0, "")
+	if cap(q.ch) != defaultSendQueueSize || q.policy != OverflowDisconnect {
+		t.Fatalf("默认队列 %d %s", cap(q.ch), q.policy)
+	}
+}
+
+// 建立一条真实的 websocket 连接，不启动写协程，队列满后不会被消费
+func newTestConn(t *testing.T, policy string) *WsConn {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc := &WsConn{
+		Emitter: NewEmitter[[]byte](),
+		conn:    conn,
+		closed:  make(chan struct{}),
+		out:     newOutQueue(1, policy),
+	}
+	t.Cleanup(wc.Close)
+	return wc
+}
+
+func TestSendOverflow(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy string
+		err    error
+		closed bool
+	}{
+		{"断开慢消费者", OverflowDisconnect, ErrQueueFull, true},
+		{"丢弃最新", OverflowDropNewest, ErrQueueFull, false},
+		{"丢弃最旧", OverflowDropOldest, nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wc := newTestConn(t, c.policy)
+			closed := make(chan msg.Close, 1)
+			wc.On("close", func(data []byte) {
+				var m msg.Close
+				json.Unmarshal(data, &m)
+				closed <- m
+			})
+
+			if err := wc.Send("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := wc.Send("b"); !errors.Is(err, c.err) {
+				t.Fatalf("队列满时返回 %v，期望 %v", err, c.err)
+			}
+
+			if !c.closed {
+				select {
+				case <-closed:
+					t.Fatal("队列满时断开了连接")
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+			select {
+			case m := <-closed:
+				if m.Code != websocket.CloseTryAgainLater {
+					t.Fatalf("关闭码 %d", m.Code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("队列满时没有断开连接")
+			}
+			if err := wc.Send("c"); !errors.Is(err, ErrClosed) {
+				t.Fatalf("断开后发送返回 %v", err)
+			}
+		})
+	}
+}
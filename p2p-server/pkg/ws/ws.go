@@ -1,12 +1,14 @@
 package ws
 
 import (
-	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
+	"webrtc/p2p-server/pkg/auth"
 	"webrtc/p2p-server/pkg/config"
 	"webrtc/p2p-server/pkg/logger"
+	"webrtc/p2p-server/pkg/metrics"
 	"webrtc/p2p-server/pkg/msg"
 	"webrtc/p2p-server/pkg/utils"
 
@@ -22,7 +24,19 @@ type WsConn struct {
 	cfg      *config.Config
 	closed   chan struct{}
 	isClosed atomic.Bool
-	msg      chan []byte
+	//close 事件是否已派发
+	closeEmitted atomic.Bool
+	msg          chan []byte
+	//出站队列
+	out *outQueue
+	//入队与关闭标记互斥
+	sendMu sync.Mutex
+	//写超时
+	writeTimeout time.Duration
+	//存活检测
+	ka *keepalive
+	//认证后的身份，未开启认证时为 nil
+	identity *auth.Identity
 }
 
 func NewWsConn(conn *websocket.Conn, cfg *config.Config) *WsConn {
@@ -32,27 +46,37 @@ func NewWsConn(conn *websocket.Conn, cfg *config.Config) *WsConn {
 		cfg:     cfg,
 		closed:  make(chan struct{}),
 		msg:     make(chan []byte),
+		out:     newOutQueue(cfg.Ws.SendQueueSize, cfg.Ws.OverflowPolicy),
+		ka:      newKeepalive(cfg.Ws.PingTime, cfg.Ws.MaxMissedPongs),
+	}
+
+	wc.writeTimeout = time.Duration(cfg.Ws.WriteTimeout) * time.Second
+	if wc.writeTimeout <= 0 {
+		wc.writeTimeout = defaultWriteTimeout
 	}
 
 	wc.conn.SetCloseHandler(func(code int, text string) error {
 		logger.Log.Warnf("%s %d", text, code)
 
-		wc.Emit("close", []byte(utils.Marshal(msg.Close{
-			Code: code,
-			Text: text,
-		})))
-
-		wc.Close()
+		wc.shutdown(code, text)
 
 		return nil
 	})
 
+	wc.conn.SetPongHandler(wc.handlePong)
+
+	metrics.Connections.Inc()
+
+	go wc.writePump()
+
 	return wc
 }
 
 func (wc *WsConn) Loop() {
 	ticker := time.NewTicker(time.Duration(wc.cfg.Ws.HeartbeatTime) * time.Second)
 
+	go wc.pingLoop()
+
 	go func() {
 		for {
 			_, data, err := wc.conn.ReadMessage()
@@ -60,25 +84,21 @@ func (wc *WsConn) Loop() {
 				logger.Log.Warnf("读取消息错误 %v", err)
 
 				if c, ok := err.(*websocket.CloseError); ok {
-					wc.Emit("close", []byte(utils.Marshal(msg.Close{
-						Code: c.Code,
-						Text: c.Text,
-					})))
+					wc.shutdown(c.Code, c.Text)
+				} else if c, ok := err.(*net.OpError); ok {
+					wc.shutdown(1008, c.Error())
 				} else {
-					if c, ok := err.(*net.OpError); ok {
-						wc.Emit("close", []byte(utils.Marshal(msg.Close{
-							Code: 1008,
-							Text: c.Error(),
-						})))
-					}
+					wc.shutdown(websocket.CloseAbnormalClosure, err.Error())
 				}
-
-				wc.Close()
 				break
 			}
 
 			//消息放入通道
-			wc.msg <- data
+			select {
+			case wc.msg <- data:
+			case <-wc.closed:
+				return
+			}
 		}
 	}()
 
@@ -94,25 +114,88 @@ func (wc *WsConn) Loop() {
 				Data: "",
 			})); err != nil {
 				logger.Log.Errorf("发送心跳包错误 %v", err)
+				metrics.HeartbeatErrors.Inc()
 				ticker.Stop()
 			}
 		}
 	}
 }
 
-func (wc *WsConn) Send(msg string) error {
-	select {
-	case <-wc.closed:
-		return errors.New("closed")
-	default:
-		return wc.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+// Send 把消息放入出站队列，由写协程发送，不会阻塞调用方
+// 关闭检查和入队在同一把锁内，关闭后不会再有消息入队
+func (wc *WsConn) Send(data string) error {
+	wc.sendMu.Lock()
+	if wc.IsClosed() {
+		wc.sendMu.Unlock()
+		return ErrClosed
+	}
+	ok := wc.out.push([]byte(data))
+	wc.sendMu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	if wc.out.policy == OverflowDisconnect {
+		logger.Log.Warnf("发送队列已满，断开慢消费者")
+		//异步关闭，Send 可能在房间协程中调用，close 事件的监听器会等待房间协程
+		go wc.shutdown(websocket.CloseTryAgainLater, "slow consumer")
 	}
+	return ErrQueueFull
+}
+
+// Stats 返回发送队列统计
+func (wc *WsConn) Stats() QueueStats {
+	return wc.out.stats()
+}
+
+// 关闭连接并派发 close 事件
+// 先标记关闭再派发，监听器中可以通过 IsClosed 判断连接状态，close 事件只派发一次
+func (wc *WsConn) shutdown(code int, text string) {
+	wc.Close()
+
+	if !wc.closeEmitted.Swap(true) {
+		wc.Emit("close", []byte(utils.Marshal(msg.Close{
+			Code: code,
+			Text: text,
+		})))
+	}
+}
+
+// SetIdentity 绑定认证后的身份，需要在 Loop 之前调用
+func (wc *WsConn) SetIdentity(identity *auth.Identity) {
+	wc.identity = identity
+}
+
+// Identity 返回认证后的身份，未认证时为 nil
+func (wc *WsConn) Identity() *auth.Identity {
+	return wc.identity
+}
+
+func (wc *WsConn) IsClosed() bool {
+	return wc.isClosed.Load()
+}
+
+// CloseWithCode 发送关闭帧后关闭连接
+func (wc *WsConn) CloseWithCode(code int, text string) {
+	if wc.IsClosed() {
+		return
+	}
+	wc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wc.writeTimeout))
+	wc.shutdown(code, text)
 }
 
 func (wc *WsConn) Close() {
-	if !wc.isClosed.Swap(true) {
+	//与 Send 互斥，写协程退出时清空的队列之后不会再有消息入队
+	wc.sendMu.Lock()
+	closed := wc.isClosed.Swap(true)
+	wc.sendMu.Unlock()
+
+	if !closed {
 		wc.conn.Close()
 
 		close(wc.closed)
+
+		metrics.Connections.Dec()
 	}
 }
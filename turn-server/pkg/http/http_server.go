@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 	"webrtc/turn-server/pkg/config"
 	"webrtc/turn-server/pkg/turn"
@@ -53,10 +55,11 @@ func NewHttpServer(ts *turn.TurnServer, cfg *config.Config) *HttpServer {
 	return s
 }
 
+// TURN REST 凭证的密码 base64(hmac-sha1(key, username))，/api/turn 和信令服务下发的凭证都用它计算
 func (s *HttpServer) makePwd(data string, key string) string {
 	hash := hmac.New(sha1.New, []byte(key))
 	hash.Write([]byte(data))
-	return base64.RawStdEncoding.EncodeToString(hash.Sum(nil))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
 }
 
 func (s *HttpServer) AuthHandler(username string, realm string, srcAddr net.Addr) (key string, ok bool) {
@@ -64,7 +67,23 @@ func (s *HttpServer) AuthHandler(username string, realm string, srcAddr net.Addr
 		cred := value.(turn.TurnCreds)
 		return cred.Password, true
 	}
-	return "", false
+	return s.restAuth(username)
+}
+
+// 校验信令服务下发的 REST 凭证，用户名为 "过期时间:用户Id"，密码由共享密钥计算
+func (s *HttpServer) restAuth(username string) (string, bool) {
+	if len(s.cfg.Http.TurnKey) == 0 {
+		return "", false
+	}
+	timestamp, _, found := strings.Cut(username, ":")
+	if !found {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return s.makePwd(username, s.cfg.Http.TurnKey), true
 }
 
 func (s *HttpServer) HandleTurnCreds(c *gin.Context) {
@@ -79,14 +98,14 @@ func (s *HttpServer) HandleTurnCreds(c *gin.Context) {
 		return
 	}
 
-	//生成用户名
-	timestamp := time.Now().Unix()
-	turnUserName := fmt.Sprintf("%d:%s", timestamp, username)
+	ttl := 86400
+
+	//生成用户名，前缀与 REST 凭证一样是过期时间
+	expires := time.Now().Unix() + int64(ttl)
+	turnUserName := fmt.Sprintf("%d:%s", expires, username)
 	//生成密码
 	turnPassword := s.makePwd(turnUserName, s.cfg.Http.TurnKey)
 
-	ttl := 86400
-
 	cred := turn.TurnCreds{
 		Username: turnUserName,
 		Password: turnPassword,